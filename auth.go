@@ -0,0 +1,97 @@
+package radigo
+
+import (
+	"crypto/subtle"
+)
+
+const (
+	CHAPPasswordNumber  = 3  // CHAP-Password AVP number, rfc2865 5.3
+	CHAPChallengeNumber = 60 // CHAP-Challenge AVP number, rfc2865 5.40
+)
+
+// AuthFailure is the reason of a failed password verification
+// the text is suitable for the Reply-Message of the Access-Reject
+type AuthFailure string
+
+func (af AuthFailure) Error() string {
+	return string(af)
+}
+
+const (
+	AuthFailureNoPassword       AuthFailure = "missing User-Password or CHAP-Password"
+	AuthFailureInvalidCHAP      AuthFailure = "invalid CHAP-Password"
+	AuthFailureInvalidChallenge AuthFailure = "invalid CHAP-Challenge"
+	AuthFailureWrongPassword    AuthFailure = "wrong password"
+)
+
+// rawAttribute returns the raw value of the first AVP with attrNr
+func (p *Packet) rawAttribute(attrNr uint8) []byte {
+	for _, avp := range p.AVPs {
+		if avp.Number == attrNr {
+			return avp.RawValue
+		}
+	}
+	return nil
+}
+
+// VerifyPassword authenticates the request with PAP or CHAP, based on the attributes present
+// password is the cleartext one, as known by the backend
+func (p *Packet) VerifyPassword(password string) error {
+	p.RLock()
+	defer p.RUnlock()
+	if pass := p.rawAttribute(UserPasswordNumber); pass != nil {
+		return verifyPAP(pass, password)
+	}
+	if chapPass := p.rawAttribute(CHAPPasswordNumber); chapPass != nil {
+		return p.verifyCHAP(chapPass, password)
+	}
+	return AuthFailureNoPassword
+}
+
+// VerifyPAP authenticates the request based on the (decrypted) User-Password
+func (p *Packet) VerifyPAP(password string) error {
+	p.RLock()
+	defer p.RUnlock()
+	pass := p.rawAttribute(UserPasswordNumber)
+	if pass == nil {
+		return AuthFailureNoPassword
+	}
+	return verifyPAP(pass, password)
+}
+
+// VerifyCHAP authenticates the request based on CHAP-Password
+// the challenge is taken out of CHAP-Challenge or, if missing, out of request Authenticator
+func (p *Packet) VerifyCHAP(password string) error {
+	p.RLock()
+	defer p.RUnlock()
+	chapPass := p.rawAttribute(CHAPPasswordNumber)
+	if chapPass == nil {
+		return AuthFailureNoPassword
+	}
+	return p.verifyCHAP(chapPass, password)
+}
+
+func verifyPAP(pass []byte, password string) error {
+	if subtle.ConstantTimeCompare(pass, []byte(password)) != 1 {
+		return AuthFailureWrongPassword
+	}
+	return nil
+}
+
+// verifyCHAP checks the CHAP-Password: CHAP Ident(1) + String(16), rfc2865 5.3
+func (p *Packet) verifyCHAP(chapPass []byte, password string) error {
+	if len(chapPass) != 17 {
+		return AuthFailureInvalidCHAP
+	}
+	challenge := p.Authenticator[:]
+	if chapChallenge := p.rawAttribute(CHAPChallengeNumber); chapChallenge != nil {
+		if len(chapChallenge) < 5 { // rfc2865 5.40
+			return AuthFailureInvalidChallenge
+		}
+		challenge = chapChallenge
+	}
+	if !AuthenticateCHAP([]byte(password), challenge, chapPass) {
+		return AuthFailureWrongPassword
+	}
+	return nil
+}
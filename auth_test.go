@@ -0,0 +1,82 @@
+package radigo
+
+import (
+	"testing"
+)
+
+func TestAuthVerifyPAP(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if err := req.VerifyPassword("CGRateSPassword"); err != AuthFailureNoPassword {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureNoPassword, err)
+	}
+	req.AVPs = append(req.AVPs, &AVP{Number: UserPasswordNumber, RawValue: []byte("CGRateSPassword")})
+	if err := req.VerifyPassword("CGRateSPassword"); err != nil {
+		t.Error(err)
+	}
+	if err := req.VerifyPAP("CGRateSPassword1"); err != AuthFailureWrongPassword {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureWrongPassword, err)
+	}
+	if err := req.VerifyCHAP("CGRateSPassword"); err != AuthFailureNoPassword {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureNoPassword, err)
+	}
+}
+
+func TestAuthVerifyPAPDecoded(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.Authenticator = [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2}
+	req.AVPs = append(req.AVPs, &AVP{Number: UserPasswordNumber, RawValue: []byte("CGRateS")}) // hidden by Encode
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err := rcv.VerifyPassword("CGRateS"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthVerifyCHAP(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.Authenticator = [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2}
+	req.AVPs = append(req.AVPs, &AVP{Number: CHAPPasswordNumber,
+		RawValue: EncodeCHAPPassword([]byte("CGRateSPassword"), req.Authenticator[:])})
+	if err := req.VerifyPassword("CGRateSPassword"); err != nil {
+		t.Error(err)
+	}
+	if err := req.VerifyCHAP("CGRateSPassword1"); err != AuthFailureWrongPassword {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureWrongPassword, err)
+	}
+	// CHAP-Challenge takes precedence over Authenticator
+	challenge := []byte("CGRateS.org challenge")
+	req.AVPs = []*AVP{
+		{Number: CHAPPasswordNumber, RawValue: EncodeCHAPPassword([]byte("CGRateSPassword"), challenge)},
+		{Number: CHAPChallengeNumber, RawValue: challenge},
+	}
+	if err := req.VerifyCHAP("CGRateSPassword"); err != nil {
+		t.Error(err)
+	}
+	req.AVPs[1].RawValue = []byte("CGR")
+	if err := req.VerifyCHAP("CGRateSPassword"); err != AuthFailureInvalidChallenge {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureInvalidChallenge, err)
+	}
+	req.AVPs = []*AVP{{Number: CHAPPasswordNumber, RawValue: []byte("CGRateS")}}
+	if err := req.VerifyCHAP("CGRateSPassword"); err != AuthFailureInvalidCHAP {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AuthFailureInvalidCHAP, err)
+	}
+}
+
+func TestAuthFailureReplyMessage(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	err := req.VerifyPassword("CGRateSPassword")
+	rply := req.NegativeReply(err.Error())
+	if avps := rply.AttributesWithNumber(ReplyMessage, NoVendor); len(avps) != 1 ||
+		avps[0].GetStringValue() != string(AuthFailureNoPassword) {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	}
+}
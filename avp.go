@@ -5,31 +5,175 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+const (
+	longExtendedMore = 0x80 // M flag of the Long Extended attributes, rfc6929 2.2
+	maxTag           = 0x1f // greater values are part of the attribute value, rfc2868 3.1
+)
+
+// isExtendedNumber returns true for the attribute numbers of the rfc6929 Extended and Long Extended types
+func isExtendedNumber(attrNr uint8) bool {
+	return attrNr >= 241 && attrNr <= 246
+}
+
+// isLongExtendedNumber returns true for the attribute numbers of the rfc6929 Long Extended types
+func isLongExtendedNumber(attrNr uint8) bool {
+	return attrNr == 245 || attrNr == 246
+}
+
 type AVP struct {
-	Number      uint8       // attribute number
-	Name        string      // attribute name
-	Type        string      // type of the value helping us to convert to concrete
-	RawValue    []byte      // original value as byte
-	Value       interface{} // holds the concrete value defined in dictionary, extracted back with type (eg: avp.Value.(string) or avp.Value.(*VSA))
-	StringValue string      // stores the string value for convenience and pretty print
+	Number       uint8       // attribute number
+	ExtendedType uint8       // rfc6929 Extended-Type, considered for attribute numbers 241-246
+	Name         string      // attribute name
+	Type         string      // type of the value helping us to convert to concrete
+	RawValue     []byte      // original value as byte
+	Value        interface{} // holds the concrete value defined in dictionary, extracted back with type (eg: avp.Value.(string) or avp.Value.(*VSA))
+	StringValue  string      // stores the string value for convenience and pretty print
+	Tag          uint8       // rfc2868 tag, considered for attributes with has_tag flag
 }
 
 func (a *AVP) Encode(b []byte) (n int, err error) {
-	fullLen := len(a.RawValue) + 2 //type and length
+	if isLongExtendedNumber(a.Number) {
+		return a.encodeLongExtended(b)
+	}
+	hdrLen := 2 // type and length
+	if isExtendedNumber(a.Number) {
+		hdrLen = 3 // extended type
+	}
+	fullLen := len(a.RawValue) + hdrLen
 	if fullLen > 255 || fullLen < 2 {
 		return 0, errors.New("value too big for attribute")
 	}
 	b[0] = uint8(a.Number)
 	b[1] = uint8(fullLen)
-	copy(b[2:], a.RawValue)
+	if hdrLen == 3 {
+		b[2] = a.ExtendedType
+	}
+	copy(b[hdrLen:], a.RawValue)
 	return fullLen, err
 }
 
+// encodeConcat splits the value over consecutive attributes of the same type
+// VSAs are split into consecutive VSAs with the same vendor and type
+func (a *AVP) encodeConcat(b []byte) (n int, err error) {
+	hdrLen, maxFrag := 2, 253
+	var vsaHdr []byte
+	val := a.RawValue
+	if a.Number == VendorSpecificNumber {
+		if len(val) < 6 {
+			return 0, errors.New("invalid VSA length")
+		}
+		hdrLen, maxFrag = 8, 247
+		vsaHdr, val = val[:5], val[6:] // length of the concatenated VSA is not relevant
+	}
+	for {
+		frag := val
+		if len(frag) > maxFrag {
+			frag = val[:maxFrag]
+		}
+		if n+hdrLen+len(frag) > len(b) {
+			return 0, errors.New("value too big for attribute")
+		}
+		b[n] = a.Number
+		b[n+1] = uint8(hdrLen + len(frag))
+		if vsaHdr != nil {
+			copy(b[n+2:], vsaHdr)
+			b[n+7] = uint8(2 + len(frag))
+		}
+		copy(b[n+hdrLen:], frag)
+		n += hdrLen + len(frag)
+		if val = val[len(frag):]; len(val) == 0 {
+			return
+		}
+	}
+}
+
+// encodeLongExtended fragments the value over consecutive attributes using the M flag, rfc6929 2.2
+func (a *AVP) encodeLongExtended(b []byte) (n int, err error) {
+	val := a.RawValue
+	for {
+		frag, flags := val, uint8(0)
+		if len(frag) > 251 {
+			frag, flags = val[:251], longExtendedMore
+		}
+		if n+4+len(frag) > len(b) {
+			return 0, errors.New("value too big for attribute")
+		}
+		b[n] = a.Number
+		b[n+1] = uint8(4 + len(frag))
+		b[n+2] = a.ExtendedType
+		b[n+3] = flags
+		copy(b[n+4:], frag)
+		n += 4 + len(frag)
+		if val = val[len(frag):]; len(val) == 0 {
+			return
+		}
+	}
+}
+
+// decodeExtended populates the AVP out of the extended attribute(s) at the beginning of b
+// Long Extended fragments are reassembled, returns the number of bytes consumed
+func (a *AVP) decodeExtended(b []byte) (n int, err error) {
+	hdrLen := 3
+	isLong := isLongExtendedNumber(b[0])
+	if isLong {
+		hdrLen = 4
+	}
+	a.Number = b[0]
+	for {
+		if len(b) < 2 {
+			return 0, errors.New("invalid long extended attribute fragment")
+		}
+		length := int(b[1])
+		if length < hdrLen || length > len(b) {
+			return 0, errors.New("invalid length")
+		}
+		if n == 0 {
+			a.ExtendedType = b[2]
+		} else if b[0] != a.Number || b[2] != a.ExtendedType {
+			return 0, errors.New("invalid long extended attribute fragment")
+		}
+		a.RawValue = append(a.RawValue, b[hdrLen:length]...)
+		n += length
+		more := isLong && b[3]&longExtendedMore != 0
+		b = b[length:]
+		if !more {
+			return
+		}
+	}
+}
+
+// isEVS returns true for the rfc6929 Extended-Vendor-Specific attributes
+func (a *AVP) isEVS() bool {
+	return isExtendedNumber(a.Number) && a.ExtendedType == VendorSpecificNumber
+}
+
+// isVSA returns true if the value of the AVP is a VSA
+func (a *AVP) isVSA() bool {
+	return a.Number == VendorSpecificNumber || a.isEVS()
+}
+
+// dictAttribute returns the dictionary data based on the AVP number
+func (a *AVP) dictAttribute(dict *Dictionary) *DictionaryAttribute {
+	if isExtendedNumber(a.Number) {
+		return dict.AttributeWithExtendedNumber(a.Number, a.ExtendedType, NoVendor)
+	}
+	return dict.AttributeWithNumber(a.Number, NoVendor)
+}
+
+// tag returns the rfc2868 tag from either AVP or VSA
+func (a *AVP) tag() uint8 {
+	if vsa, cast := a.Value.(*VSA); cast {
+		return vsa.Tag
+	}
+	return a.Tag
+}
+
 // StringValue returns the string value from either AVP of VSA
 func (a *AVP) GetStringValue() (strVal string) {
-	if a.Number != VendorSpecificNumber {
+	if !a.isVSA() {
 		strVal = a.StringValue
 	} else if vsa, cast := a.Value.(*VSA); cast { // for VSA, return string value of it
 		strVal = vsa.StringValue
@@ -43,8 +187,11 @@ func (a *AVP) SetValue(dict *Dictionary, cdr Coder) (err error) {
 	if a.Value != nil { // already set
 		return
 	}
-	if a.Number == VendorSpecificNumber { // Special handling of VSA values
-		vsa, _ := NewVSAFromAVP(a)
+	if a.isVSA() { // Special handling of VSA values
+		vsa, err := NewVSAFromAVP(a)
+		if err != nil {
+			return err
+		}
 		if err := vsa.SetValue(dict, cdr); err != nil {
 			return err
 		}
@@ -53,11 +200,15 @@ func (a *AVP) SetValue(dict *Dictionary, cdr Coder) (err error) {
 		a.Value = vsa
 		return nil
 	}
-	da := dict.AttributeWithNumber(a.Number, NoVendor)
+	da := a.dictAttribute(dict)
 	if da == nil {
 		return fmt.Errorf("no dictionary data for avp: %+v", a)
 	}
-	val, strVal, err := cdr.Decode(da.AttributeType, a.RawValue)
+	rawVal := a.RawValue
+	if da.HasTag {
+		a.Tag, rawVal = da.decodeTag(rawVal)
+	}
+	val, strVal, err := cdr.Decode(da.AttributeType, rawVal)
 	if err != nil {
 		if err != ErrUnsupportedAttributeType {
 			return err
@@ -91,7 +242,7 @@ func (a *AVP) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 		if a.Name != "" {
 			da = dict.AttributeWithName(a.Name, "")
 		} else if a.Number != 0 {
-			da = dict.AttributeWithNumber(a.Number, 0)
+			da = a.dictAttribute(dict)
 		}
 		if da == nil {
 			return fmt.Errorf("%+v, missing dictionary data", a)
@@ -99,8 +250,11 @@ func (a *AVP) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 		a.Name = da.AttributeName
 		a.Type = da.AttributeType
 		a.Number = da.AttributeNumber
+		if da.ExtendedNumber != 0 {
+			a.Number, a.ExtendedType = da.ExtendedNumber, da.AttributeNumber
+		}
 	}
-	if a.Number == VendorSpecificNumber { // handle VSA differently
+	if a.isVSA() { // handle VSA differently
 		vsa, ok := a.Value.(*VSA)
 		if !ok {
 			return fmt.Errorf("%+v, cannot cast to VSA", a)
@@ -127,18 +281,37 @@ func (a *AVP) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 			return err
 		}
 	}
+	if da := a.dictAttribute(dict); da != nil && da.HasTag {
+		if rawVal, err = da.encodeTag(a.Tag, rawVal); err != nil {
+			return err
+		}
+	}
 	a.RawValue = rawVal
 	return nil
 }
 
 func NewVSAFromAVP(avp *AVP) (*VSA, error) {
+	if avp.isEVS() { // vendor id (4) + vendor type (1), no vendor length, rfc6929 2.4
+		if len(avp.RawValue) < 5 {
+			return nil, errors.New("invalid extended VSA length")
+		}
+		vsa := &VSA{Vendor: binary.BigEndian.Uint32(avp.RawValue[0:4]),
+			Number: avp.RawValue[4], ExtendedNumber: avp.Number,
+			RawValue: make([]byte, len(avp.RawValue)-5)}
+		copy(vsa.RawValue, avp.RawValue[5:])
+		return vsa, nil
+	}
 	if avp.Number != VendorSpecificNumber {
 		return nil, errors.New("not VSA type")
 	}
 	vsa := new(VSA)
 	vsa.Vendor = binary.BigEndian.Uint32(avp.RawValue[0:4])
 	vsa.Number = uint8(avp.RawValue[4])
-	vsa.RawValue = make([]byte, avp.RawValue[5]-2) // length field will include vendor type and vendor length, so deduct it here
+	vsaLen := int(avp.RawValue[5]) - 2 // length field will include vendor type and vendor length, so deduct it here
+	if len(avp.RawValue) > 253 {       // concatenated out of more VSAs, length field not relevant
+		vsaLen = len(avp.RawValue) - 6
+	}
+	vsa.RawValue = make([]byte, vsaLen)
 	copy(vsa.RawValue, avp.RawValue[6:])
 	return vsa, nil
 }
@@ -146,18 +319,35 @@ func NewVSAFromAVP(avp *AVP) (*VSA, error) {
 // Vendor specific Attribute/Val
 // originally ported from github.com/bronze1man/radius/avp_vendor.go
 type VSA struct {
-	Vendor      uint32
-	Number      uint8       // attribute number
-	VendorName  string      // populated by dictionary
-	Name        string      // attribute name
-	Type        string      // type of the value helping us to convert to concrete
-	Value       interface{} // holds the concrete value defined in dictionary, extracted back with type (eg: avp.Value.(string))
-	RawValue    []byte      // value as received over network
-	StringValue string      // stores the string value
+	Vendor         uint32
+	Number         uint8       // attribute number
+	ExtendedNumber uint8       // parent attribute number (241-246) for the rfc6929 extended VSAs
+	VendorName     string      // populated by dictionary
+	Name           string      // attribute name
+	Type           string      // type of the value helping us to convert to concrete
+	Value          interface{} // holds the concrete value defined in dictionary, extracted back with type (eg: avp.Value.(string))
+	RawValue       []byte      // value as received over network
+	StringValue    string      // stores the string value
+	Tag            uint8       // rfc2868 tag, considered for attributes with has_tag flag
+}
+
+// dictAttribute returns the dictionary data based on the VSA number
+func (vsa *VSA) dictAttribute(dict *Dictionary) *DictionaryAttribute {
+	if vsa.ExtendedNumber != 0 {
+		return dict.AttributeWithExtendedNumber(vsa.ExtendedNumber, vsa.Number, vsa.Vendor)
+	}
+	return dict.AttributeWithNumber(vsa.Number, vsa.Vendor)
 }
 
 // AVP encodes VSA back into AVP
 func (vsa *VSA) AVP() *AVP {
+	if vsa.ExtendedNumber != 0 { // rfc6929 2.4
+		evsValue := make([]byte, len(vsa.RawValue)+5)
+		binary.BigEndian.PutUint32(evsValue[0:4], vsa.Vendor)
+		evsValue[4] = vsa.Number
+		copy(evsValue[5:], vsa.RawValue)
+		return &AVP{Number: vsa.ExtendedNumber, ExtendedType: VendorSpecificNumber, RawValue: evsValue}
+	}
 	vsa_len := len(vsa.RawValue)
 	// vendor id (4) + attr type (1) + attr len (1)
 	vsa_value := make([]byte, vsa_len+6)
@@ -173,7 +363,7 @@ func (vsa *VSA) SetValue(dict *Dictionary, cdr Coder) (err error) {
 	if vsa.Value != nil { // already set, maybe in application
 		return
 	}
-	da := dict.AttributeWithNumber(vsa.Number, vsa.Vendor)
+	da := vsa.dictAttribute(dict)
 	if da == nil {
 		errStr := fmt.Sprintf("DICTIONARY_NOT_FOUND, attribute: <%d>", vsa.Number)
 		if vsa.Vendor != 0 {
@@ -181,7 +371,11 @@ func (vsa *VSA) SetValue(dict *Dictionary, cdr Coder) (err error) {
 		}
 		return errors.New(errStr)
 	}
-	val, strVal, err := cdr.Decode(da.AttributeType, vsa.RawValue)
+	rawVal := vsa.RawValue
+	if da.HasTag {
+		vsa.Tag, rawVal = da.decodeTag(rawVal)
+	}
+	val, strVal, err := cdr.Decode(da.AttributeType, rawVal)
 	if err != nil {
 		if err != ErrUnsupportedAttributeType {
 			return err
@@ -213,7 +407,7 @@ func (vsa *VSA) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 	if vsa.Type == "" {
 		var da *DictionaryAttribute
 		if vsa.Number != 0 && vsa.Vendor != NoVendor {
-			da = dict.AttributeWithNumber(vsa.Number, vsa.Vendor)
+			da = vsa.dictAttribute(dict)
 		} else if vsa.Name != "" {
 			if vsa.VendorName == "" {
 				if vndr := dict.VendorWithCode(vsa.Vendor); vndr == nil {
@@ -230,6 +424,7 @@ func (vsa *VSA) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 		vsa.Name = da.AttributeName
 		vsa.Type = da.AttributeType
 		vsa.Number = da.AttributeNumber
+		vsa.ExtendedNumber = da.ExtendedNumber
 	}
 	var rawVal []byte
 	if vsa.Value != nil {
@@ -247,6 +442,61 @@ func (vsa *VSA) SetRawValue(dict *Dictionary, cdr Coder) (err error) {
 			return err
 		}
 	}
+	if da := vsa.dictAttribute(dict); da != nil && da.HasTag {
+		if rawVal, err = da.encodeTag(vsa.Tag, rawVal); err != nil {
+			return err
+		}
+	}
 	vsa.RawValue = rawVal
 	return
 }
+
+// parseTaggedName splits the tag out of attribute names like "Tunnel-Type:1"
+func parseTaggedName(attrName string) (name string, tag uint8, tagged bool, err error) {
+	idx := strings.LastIndexByte(attrName, ':')
+	if idx == -1 {
+		return attrName, 0, false, nil
+	}
+	tagNr, err := strconv.ParseUint(attrName[idx+1:], 10, 8)
+	if err != nil || tagNr > maxTag {
+		return "", 0, false, fmt.Errorf("invalid tag for attribute: <%s>", attrName)
+	}
+	return attrName[:idx], uint8(tagNr), true, nil
+}
+
+// encodeTag inserts the tag into the raw value, rfc2868 3.1
+// integer values are carrying the tag in the first byte, string values are prefixed by it
+func (da *DictionaryAttribute) encodeTag(tag uint8, rawVal []byte) ([]byte, error) {
+	if tag > maxTag {
+		return nil, fmt.Errorf("invalid tag: <%d>", tag)
+	}
+	if da.AttributeType == IntegerValue {
+		if len(rawVal) != 4 || rawVal[0] != 0 {
+			return nil, errors.New("value too big for tagged attribute")
+		}
+		rawVal[0] = tag
+		return rawVal, nil
+	}
+	if tag == 0 && da.Encrypt != TunnelPasswordEncrypt && // tag always present in front of salt
+		(len(rawVal) == 0 || rawVal[0] > maxTag) { // no tag needed to disambiguate
+		return rawVal, nil
+	}
+	return append([]byte{tag}, rawVal...), nil
+}
+
+// decodeTag splits the tag out of the raw value, rfc2868 3.1
+func (da *DictionaryAttribute) decodeTag(rawVal []byte) (tag uint8, val []byte) {
+	if len(rawVal) == 0 {
+		return 0, rawVal
+	}
+	if da.AttributeType == IntegerValue {
+		if len(rawVal) != 4 {
+			return 0, rawVal
+		}
+		return rawVal[0], []byte{0, rawVal[1], rawVal[2], rawVal[3]}
+	}
+	if rawVal[0] > maxTag && da.Encrypt != TunnelPasswordEncrypt { // first byte of the value
+		return 0, rawVal
+	}
+	return rawVal[0], rawVal[1:]
+}
@@ -1,6 +1,7 @@
 package radigo
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"reflect"
@@ -776,3 +777,104 @@ func TestAVPVSASetRawValueUnsupportedAttribute2(t *testing.T) {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
 	}
 }
+
+func TestAVPEncodeExtended(t *testing.T) {
+	avp := &AVP{Number: 241, ExtendedType: 1, RawValue: []byte{0x00, 0x00, 0x00, 0x01}}
+	var b [10]byte
+	n, err := avp.Encode(b[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []byte{0xf1, 0x07, 0x01, 0x00, 0x00, 0x00, 0x01}
+	if !reflect.DeepEqual(exp, b[:n]) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", exp, b[:n])
+	}
+	avp.RawValue = make([]byte, 253)
+	if _, err := avp.Encode(make([]byte, 300)); err == nil || err.Error() != "value too big for attribute" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "value too big for attribute", err)
+	}
+}
+
+func TestAVPLongExtendedFragmentation(t *testing.T) {
+	val := make([]byte, 600)
+	for i := range val {
+		val[i] = byte(i)
+	}
+	avp := &AVP{Number: 245, ExtendedType: 1, RawValue: val}
+	b := make([]byte, 4096)
+	n, err := avp.Encode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 600+3*4 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 612, n)
+	}
+	for i, exp := range [][]byte{{0xf5, 0xff, 0x01, 0x80}, {0xf5, 0xff, 0x01, 0x80}, {0xf5, 0x66, 0x01, 0x00}} {
+		if rcv := b[i*255 : i*255+4]; !reflect.DeepEqual(exp, rcv) {
+			t.Errorf("fragment %d, \nExpected: <% x>, \nReceived: <% x>", i, exp, rcv)
+		}
+	}
+	if _, err := avp.Encode(b[:300]); err == nil {
+		t.Error("expecting error for small buffer")
+	}
+	rcvAVP := new(AVP)
+	if consumed, err := rcvAVP.decodeExtended(b[:n]); err != nil {
+		t.Fatal(err)
+	} else if consumed != n {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", n, consumed)
+	}
+	if !reflect.DeepEqual(avp, rcvAVP) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", avp, rcvAVP)
+	}
+	// last fragment with M flag set
+	b[2*255+3] = longExtendedMore
+	experr := "invalid long extended attribute fragment"
+	if _, err := new(AVP).decodeExtended(b[:n]); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestAVPExtendedVSA(t *testing.T) {
+	vsa := &VSA{Vendor: 94, Number: 1, ExtendedNumber: 241, RawValue: []byte("CGR")}
+	eAVP := &AVP{
+		Number:       241,
+		ExtendedType: VendorSpecificNumber,
+		RawValue:     []byte{0x00, 0x00, 0x00, 0x5e, 0x01, 0x43, 0x47, 0x52},
+	}
+	avp := vsa.AVP()
+	if !reflect.DeepEqual(eAVP, avp) {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", eAVP, avp)
+	}
+	if rcv, err := NewVSAFromAVP(avp); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(vsa, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", vsa, rcv)
+	}
+	experr := "invalid extended VSA length"
+	if _, err := NewVSAFromAVP(&AVP{Number: 241, ExtendedType: VendorSpecificNumber}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestAVPTagEncodeDecode(t *testing.T) {
+	da := &DictionaryAttribute{AttributeType: IntegerValue, HasTag: true}
+	if _, err := da.encodeTag(1, []byte{1, 0, 0, 0}); err == nil {
+		t.Error("expecting error for integer value too big")
+	}
+	if tag, val := da.decodeTag([]byte{3, 0, 0, 13}); tag != 3 || !bytes.Equal(val, []byte{0, 0, 0, 13}) {
+		t.Errorf("unexpected tag: %d, value: %+v", tag, val)
+	}
+	da = &DictionaryAttribute{AttributeType: StringValue, HasTag: true}
+	// value starting with a byte which could be mistaken for tag
+	if raw, err := da.encodeTag(0, []byte{0x05, 'a'}); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(raw, []byte{0, 0x05, 'a'}) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", []byte{0, 0x05, 'a'}, raw)
+	}
+	if tag, val := da.decodeTag([]byte{0, 0x05, 'a'}); tag != 0 || !bytes.Equal(val, []byte{0x05, 'a'}) {
+		t.Errorf("unexpected tag: %d, value: %+v", tag, val)
+	}
+	if _, err := da.encodeTag(32, []byte("a")); err == nil {
+		t.Error("expecting error for invalid tag")
+	}
+}
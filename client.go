@@ -1,13 +1,15 @@
 package radigo
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
-	"reflect"
 	"sync"
 	"time"
 
@@ -23,160 +25,491 @@ func fib() func() int {
 	}
 }
 
+const DefaultClientMaxSockets = 16 // up to 4096 requests in flight
+
+var ErrNoIdentifier = errors.New("no Identifier available")
+
 // packetReplyHandler caches the original packet and handler for it
 type packetReplyHandler struct {
-	pkt    *Packet      // original request here
-	rplChn chan *Packet // publish replies here
+	pkt           *Packet      // original request here
+	rplChn        chan *Packet // publish replies here
+	authenticator [16]byte     // of the request as sent, checking the replies
+	sent          bool         // authenticator is set, replies are expected
+	rplyErr       error        // last reply discarded
 }
 
 // NewClient creates a new client and connects it to the address
 func NewClient(net, address string, secret string, dict *Dictionary,
 	connAttempts int, avpCoders map[string]codecs.AVPCoder, l logger) (*Client, error) {
-	clnt := &Client{net: net, address: address, secret: secret, dict: dict,
-		connAttempts: connAttempts, activeReqs: make(map[uint8]*packetReplyHandler),
-		coder: NewCoder(), l: l}
-	if l == nil || (reflect.ValueOf(l).Kind() == reflect.Ptr && reflect.ValueOf(l).IsNil()) {
-		l = nopLogger{}
+	return newClient(context.Background(), net, address, secret, nil, dict, connAttempts, avpCoders, l)
+}
+
+// NewClientContext creates a new client and connects it to the address
+// ctx cancels the connection attempts
+func NewClientContext(ctx context.Context, net, address string, secret string, dict *Dictionary,
+	connAttempts int, avpCoders map[string]codecs.AVPCoder, l logger) (*Client, error) {
+	return newClient(ctx, net, address, secret, nil, dict, connAttempts, avpCoders, l)
+}
+
+// NewTLSClient creates a new client over a secure transport (tls, dtls) and connects it to the address
+// the secret is fixed to RadSecSecret for tls and DTLSSecret for dtls
+func NewTLSClient(net, address string, tlsCfg *tls.Config, dict *Dictionary,
+	connAttempts int, avpCoders map[string]codecs.AVPCoder, l logger) (*Client, error) {
+	return NewTLSClientContext(context.Background(), net, address, tlsCfg, dict, connAttempts, avpCoders, l)
+}
+
+// NewTLSClientContext is the NewTLSClient with ctx cancelling the connection attempts
+func NewTLSClientContext(ctx context.Context, net, address string, tlsCfg *tls.Config, dict *Dictionary,
+	connAttempts int, avpCoders map[string]codecs.AVPCoder, l logger) (*Client, error) {
+	secret := RadSecSecret
+	if net == "dtls" {
+		secret = DTLSSecret
 	}
+	return newClient(ctx, net, address, secret, tlsCfg, dict, connAttempts, avpCoders, l)
+}
+
+func newClient(ctx context.Context, net, address string, secret string, tlsCfg *tls.Config, dict *Dictionary,
+	connAttempts int, avpCoders map[string]codecs.AVPCoder, l logger) (*Client, error) {
+	l = orNopLogger(l)
+	clnt := &Client{net: net, address: address, secret: secret, tlsCfg: tlsCfg, dict: dict,
+		connAttempts: connAttempts, maxSocks: DefaultClientMaxSockets, retryPolicy: DefaultRetryPolicy,
+		stateChn: make(chan ClientState, clientStateQueue), coder: NewCoder(), l: l}
+	clnt.ctx, clnt.cancel = context.WithCancel(context.Background())
 	for k, v := range avpCoders { // add the extra coders
 		clnt.coder[k] = v
 	}
 	if connAttempts == 0 {
 		connAttempts = 1 // at least one connection
 	}
-	if err := clnt.connect(connAttempts); err != nil {
+	if err := clnt.connect(ctx, connAttempts); err != nil {
+		clnt.cancel()
 		return nil, err
 	}
 	return clnt, nil
 }
 
 // Client is a thread-safe RADIUS client
+// the Identifiers are allocated by the client, extra connections are opened once all the Identifiers are in use
+// lost connections are reopened in the background
 type Client struct {
-	conn         net.Conn
-	stopReading  chan struct{} // signals stop reading of events
-	net          string        // udp/tcp
-	address      string
-	secret       string
-	dict         *Dictionary
-	coder        Coder
-	connAttempts int
-	activeReqs   map[uint8]*packetReplyHandler // keep record of sent packets for matching with repliesa
-	aReqsMux     sync.Mutex                    // protects activeRequests
-	l            logger
-}
-
-func (c *Client) connect(connAttempts int) (err error) {
+	socks             []*clientSocket // opened connections
+	maxSocks          int             // limit of the opened connections, 0 for unlimited
+	dialDone          chan struct{}   // closed once the connection being dialed is opened, nil if none
+	net               string          // udp/tcp/tls/dtls
+	address           string
+	secret            string
+	tlsCfg            *tls.Config // used by the secure transports
+	dict              *Dictionary
+	coder             Coder
+	connAttempts      int
+	retryPolicy       RetryPolicy
+	state             ClientState
+	stateChn          chan ClientState // publishes the state changes
+	stateChg          chan struct{}    // closed on state change, waking up the waiters
+	queueDisconnected bool             // MetaQueue disconnect policy
+	ctx               context.Context  // cancelled on Close
+	cancel            context.CancelFunc
+	aReqsMux          sync.Mutex // protects socks, their active requests, dialDone, retryPolicy and state
+	l                 logger
+}
+
+// clientSocket is one connection of the Client, matching the replies of up to 256 requests in flight
+type clientSocket struct {
+	conn        net.Conn
+	stopReading chan struct{}                 // signals stop reading of events
+	activeReqs  map[uint8]*packetReplyHandler // keep record of sent packets for matching with replies
+	nextID      uint8                         // next Identifier to allocate, rotating to delay their reuse
+	closed      bool                          // removed out of the Client sockets
+}
+
+// register allocates the next free Identifier of the socket to the request
+// the caller ensures there is one free
+func (sock *clientSocket) register(req *Packet, rplyChn chan *Packet) {
+	for {
+		id := sock.nextID
+		sock.nextID++
+		if _, has := sock.activeReqs[id]; !has {
+			req.Identifier = id
+			sock.activeReqs[id] = &packetReplyHandler{pkt: req, rplChn: rplyChn}
+			return
+		}
+	}
+}
+
+// SetMaxSockets limits the connections opened by the client, 0 for unlimited
+// each connection carries up to 256 requests in flight
+func (c *Client) SetMaxSockets(maxSocks int) {
+	c.aReqsMux.Lock()
+	c.maxSocks = maxSocks
+	c.aReqsMux.Unlock()
+}
+
+// connect opens the first connection, retrying on Fibonacci backoff until connAttempts or ctx is done
+func (c *Client) connect(ctx context.Context, connAttempts int) (err error) {
 	if connAttempts == 0 {
 		return
 	}
-	if c.conn != nil {
-		c.disconnect()
-	}
+	c.disconnect()
 	connDelay := fib()
 	var i int
 	for {
 		i++
 		var conn net.Conn
-		if conn, err = net.Dial(c.net, c.address); err == nil {
-			c.conn = conn
-			c.stopReading = make(chan struct{})
-			go c.readReplies(c.stopReading)
+		if conn, err = c.dial(ctx); err == nil {
+			c.aReqsMux.Lock()
+			c.addSocket(conn)
+			c.aReqsMux.Unlock()
 			break
 		}
 		if connAttempts != -1 && i >= connAttempts { // Maximum reconnects reached, -1 for infinite reconnects
 			break
 		}
-		time.Sleep(time.Duration(connDelay()) * time.Second) // sleep before new attempt
+		tmr := time.NewTimer(time.Duration(connDelay()) * time.Second) // sleep before new attempt
+		select {
+		case <-ctx.Done():
+			tmr.Stop()
+			return ctx.Err()
+		case <-tmr.C:
+		}
 	}
 	return
 }
 
-// disconnect empties the connection and informs all handlers waiting for an answer
+// dial opens a new connection based on the client network
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	switch c.net {
+	case "tls":
+		return (&tls.Dialer{Config: c.tlsCfg}).DialContext(ctx, "tcp", c.address)
+	case "dtls":
+		return dialDTLS(ctx, c.address, c.tlsCfg)
+	default:
+		return (&net.Dialer{}).DialContext(ctx, c.net, c.address)
+	}
+}
+
+// addSocket starts reading the replies on the connection, called with aReqsMux locked
+func (c *Client) addSocket(conn net.Conn) *clientSocket {
+	sock := &clientSocket{conn: conn, stopReading: make(chan struct{}),
+		activeReqs: make(map[uint8]*packetReplyHandler)}
+	c.socks = append(c.socks, sock)
+	go c.readReplies(sock)
+	return sock
+}
+
+// disconnect closes all the connections and informs all handlers waiting for an answer
 func (c *Client) disconnect() {
-	if c.conn != nil {
-		c.conn = nil
+	c.aReqsMux.Lock()
+	socks := c.socks
+	c.socks = nil
+	c.aReqsMux.Unlock()
+	for _, sock := range socks {
+		c.disconnectSocket(sock)
+	}
+}
+
+// disconnectSocket closes the connection and informs the handlers waiting for an answer on it
+func (c *Client) disconnectSocket(sock *clientSocket) {
+	c.aReqsMux.Lock()
+	c.closeSocket(sock)
+	c.aReqsMux.Unlock()
+}
+
+// closeSocket removes the socket, returning false if already closed
+// the handlers waiting for an answer receive nil, called with aReqsMux locked
+func (c *Client) closeSocket(sock *clientSocket) bool {
+	if sock.closed {
+		return false
+	}
+	sock.closed = true
+	for i, s := range c.socks {
+		if s == sock {
+			c.socks = append(c.socks[:i:i], c.socks[i+1:]...)
+			break
+		}
+	}
+	if sock.stopReading != nil {
+		close(sock.stopReading)
+	}
+	if sock.conn != nil {
+		sock.conn.Close()
 	}
-	if c.stopReading != nil {
-		close(c.stopReading)
-		c.stopReading = nil
+	for key, pHndlr := range sock.activeReqs { // close all active requests with error
+		delete(sock.activeReqs, key)
+		pHndlr.rplChn <- nil
 	}
+	return true
+}
+
+// allocateID registers the request with a free Identifier for matching it's reply
+// a new connection is opened when the Identifiers of the existing ones are all in use
+func (c *Client) allocateID(ctx context.Context, req *Packet, rplyChn chan *Packet) (*clientSocket, error) {
+	for {
+		c.aReqsMux.Lock()
+		sock, dialDone, err := c.freeSocket()
+		if sock != nil {
+			sock.register(req, rplyChn)
+		}
+		if sock != nil || err != nil {
+			c.aReqsMux.Unlock()
+			return sock, err
+		}
+		if dialDone != nil { // connection opened by another request, wait for it's Identifiers
+			c.aReqsMux.Unlock()
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-dialDone:
+			}
+			continue
+		}
+		c.dialDone = make(chan struct{}) // reserve the dialing, done without lock
+		c.aReqsMux.Unlock()
+		conn, err := c.dial(ctx)
+		c.aReqsMux.Lock()
+		close(c.dialDone)
+		c.dialDone = nil
+		if err == nil && c.state == ClientClosed {
+			conn.Close()
+			err = ErrClientClosed
+		}
+		if err != nil {
+			c.aReqsMux.Unlock()
+			return nil, err
+		}
+		sock = c.addSocket(conn)
+		sock.register(req, rplyChn)
+		c.aReqsMux.Unlock()
+		return sock, nil
+	}
+}
+
+// freeSocket returns the socket with a free Identifier or the channel of the connection being dialed
+// both nil if a new connection should be dialed, called with aReqsMux locked
+func (c *Client) freeSocket() (sock *clientSocket, dialDone chan struct{}, err error) {
+	for _, sock = range c.socks {
+		if len(sock.activeReqs) <= math.MaxUint8 {
+			return
+		}
+	}
+	sock = nil
+	if c.dialDone != nil {
+		return nil, c.dialDone, nil
+	}
+	if len(c.socks) == 0 {
+		switch c.state {
+		case ClientClosed:
+			return nil, nil, ErrClientClosed
+		case ClientDisconnected:
+			c.startReconnect()
+			return nil, nil, ErrNotConnected
+		case ClientReconnecting:
+			return nil, nil, ErrNotConnected
+		}
+	}
+	if c.maxSocks != 0 && len(c.socks) >= c.maxSocks {
+		return nil, nil, ErrNoIdentifier
+	}
+	return
+}
+
+// releaseID frees the Identifier of the request if not answered already
+// returns the error of the last reply discarded
+func (c *Client) releaseID(sock *clientSocket, req *Packet) (rplyErr error) {
 	c.aReqsMux.Lock()
-	for key, pHndlr := range c.activeReqs { // close all active requests with error
-		delete(c.activeReqs, key)
-		pHndlr.rplChn <- pHndlr.pkt.NegativeReply("connection lost")
+	if pHndlr, has := sock.activeReqs[req.Identifier]; has && pHndlr.pkt == req {
+		delete(sock.activeReqs, req.Identifier)
+		rplyErr = pHndlr.rplyErr
 	}
 	c.aReqsMux.Unlock()
+	return
 }
 
-func (c *Client) readReplies(stopReading chan struct{}) {
+// transmit allocates an Identifier to the request and sends it
+// returns the socket used and the bytes sent, for retransmissions
+func (c *Client) transmit(ctx context.Context, req *Packet,
+	rplyChn chan *Packet) (sock *clientSocket, b []byte, err error) {
+	if sock, err = c.allocateID(ctx, req, rplyChn); err != nil {
+		return
+	}
+	var buf [4096]byte
+	var n int
+	if n, err = req.Encode(buf[:]); err == nil {
+		c.aReqsMux.Lock()
+		if pHndlr, has := sock.activeReqs[req.Identifier]; has && pHndlr.pkt == req {
+			pHndlr.authenticator, pHndlr.sent = req.Authenticator, true
+		}
+		c.aReqsMux.Unlock()
+		b = buf[:n]
+		_, err = sock.conn.Write(b)
+	}
+	if err != nil {
+		c.releaseID(sock, req)
+		return nil, nil, err
+	}
+	return
+}
+
+// checkReply verifies the reply against the authenticator of the request, decrypting it's AVPs
+func (c *Client) checkReply(b []byte, rply *Packet, reqAuthenticator [16]byte) error {
+	if checkMessageAuthenticator(b, c.secret, reqAuthenticator, false) != nil ||
+		!isAuthentic(b, c.secret, reqAuthenticator) {
+		return ErrReplyNotAuthentic
+	}
+	return rply.decryptAVPs(reqAuthenticator)
+}
+
+// isStream returns true for the transports needing stream framing
+func (c *Client) isStream() bool {
+	return c.net == "tcp" || c.net == "tls"
+}
+
+// readPacket reads the next packet from the connection
+// over stream transports psr is used to reassemble the packets
+func (c *Client) readPacket(conn net.Conn, psr *packetStreamReader) (b []byte, err error) {
+	if psr != nil {
+		return psr.readPacket()
+	}
+	var buf [4096]byte
+	var n int
+	if n, err = conn.Read(buf[:]); err != nil {
+		return
+	} else if uint16(n) != binary.BigEndian.Uint16(buf[2:4]) {
+		return nil, errFramingViolation
+	}
+	return buf[:n], nil
+}
+
+func (c *Client) readReplies(sock *clientSocket) {
+	var psr *packetStreamReader
+	if c.isStream() {
+		psr = newPacketStreamReader(sock.conn)
+	}
 	for {
 		select {
-		case <-stopReading:
+		case <-sock.stopReading:
 			return
 		default: // Unlock waiting here
 		}
-		var b [4096]byte
-		n, err := c.conn.Read(b[:])
-		if err != nil {
-			c.l.Debug(fmt.Sprintf("error <%s> when reading connection", err.Error()))
-			c.disconnect()
-			break
-		} else if uint16(n) != binary.BigEndian.Uint16(b[2:4]) {
+		b, err := c.readPacket(sock.conn, psr)
+		if err == errFramingViolation {
 			log.Println("error <unexpected packet length received>")
-			c.disconnect()
+			c.connLost(sock)
+			break
+		} else if err != nil {
+			c.l.Debug(fmt.Sprintf("error <%s> when reading connection", err.Error()))
+			c.connLost(sock)
 			break
 		}
 		rply := &Packet{secret: c.secret, dict: c.dict, coder: c.coder}
-		if err = rply.Decode(b[:n]); err != nil {
+		if err = rply.Decode(b); err != nil {
 			log.Printf("error <%s> when decoding packet", err.Error())
 			continue
 		}
 		c.aReqsMux.Lock()
-		pktHndlr, has := c.activeReqs[rply.Identifier]
-		delete(c.activeReqs, rply.Identifier)
+		pktHndlr, has := sock.activeReqs[rply.Identifier]
+		var reqAuthenticator [16]byte
+		if has {
+			has, reqAuthenticator = pktHndlr.sent, pktHndlr.authenticator
+		}
 		c.aReqsMux.Unlock()
 		if !has {
 			log.Printf("error <no handler for packet with code: %d>", rply.Code)
 			continue
 		}
-		if !isAuthentic(b[:n], c.secret, pktHndlr.pkt.Authenticator) {
-			rply = nil
+		if err = c.checkReply(b, rply, reqAuthenticator); err != nil { // discard, the valid reply may follow
+			log.Printf("error <%s> when checking reply", err.Error())
+			c.aReqsMux.Lock()
+			pktHndlr.rplyErr = err
+			c.aReqsMux.Unlock()
+			continue
+		}
+		c.aReqsMux.Lock()
+		if has = sock.activeReqs[rply.Identifier] == pktHndlr; has {
+			delete(sock.activeReqs, rply.Identifier)
+		}
+		c.aReqsMux.Unlock()
+		if has { // not released in the meantime
+			pktHndlr.rplChn <- rply
 		}
-		pktHndlr.rplChn <- rply
 	}
 }
 
 // SendRequest dispatches a request and returns it's reply or error
-func (c *Client) SendRequest(req *Packet) (rpl *Packet, err error) {
-	rplyChn := make(chan *Packet) // will receive reply here
-	var buf [4096]byte
-	var n int
+// the Identifier of the request is allocated by the client, retransmissions follow the RetryPolicy
+// retransmissions updating the Acct-Delay-Time get a new Identifier, rfc5080 2.2.1
+func (c *Client) SendRequest(req *Packet) (*Packet, error) {
+	return c.SendRequestContext(context.Background(), req)
+}
+
+// SendRequestContext is the SendRequest stopping on ctx, releasing the Identifier of the request
+// the waiting ends on the earliest of ctx deadline and the RetryPolicy limits
+func (c *Client) SendRequestContext(ctx context.Context, req *Packet) (rpl *Packet, err error) {
+	rplyChn := make(chan *Packet, 1) // will receive reply here, buffered for the replies arriving after timeout
 	req.secret = c.secret
 	req.dict = c.dict
-	n, err = req.Encode(buf[:])
-	if err != nil {
-		return
-	}
 	c.aReqsMux.Lock()
-	c.activeReqs[req.Identifier] = &packetReplyHandler{req, rplyChn}
+	rp := c.retryPolicy
 	c.aReqsMux.Unlock()
-	_, err = c.conn.Write(buf[:n])
-	if err != nil {
+	if rp.IRT <= 0 {
+		rp = DefaultRetryPolicy
+	}
+	started := time.Now()
+	var sock *clientSocket
+	var b []byte
+	if sock, b, err = c.transmitConnected(ctx, req, rplyChn); err != nil {
 		return
 	}
-	select {
-	case rpl = <-rplyChn:
-	case <-time.After(1 * time.Second):
-		rpl = nil
+	var delay uint32 // original Acct-Delay-Time
+	delayAVP := acctDelayTime(req)
+	if delayAVP != nil {
+		delay = binary.BigEndian.Uint32(delayAVP.RawValue)
 	}
-
-	if rpl == nil {
-		return nil, errors.New("invalid packet")
+	rt := rp.initialRT()
+	tmr := time.NewTimer(rt)
+	defer tmr.Stop()
+	for retrans := 0; ; retrans++ {
+		select {
+		case rpl = <-rplyChn:
+			if rpl != nil {
+				return
+			}
+			if sock, b, err = c.resend(ctx, req, rplyChn); err != nil { // connection lost
+				return
+			}
+			continue
+		case <-ctx.Done():
+			c.releaseID(sock, req)
+			return nil, ctx.Err()
+		case <-tmr.C:
+		}
+		elapsed := time.Since(started)
+		if rp.exhausted(retrans, elapsed) {
+			if err = c.releaseID(sock, req); err == nil {
+				err = &TimeoutError{Retransmissions: retrans, Elapsed: elapsed}
+			}
+			return nil, err
+		}
+		if !c.isStream() { // streams are reliable, rfc6613 2.6.1
+			if delayAVP != nil && setAcctDelayTime(delayAVP, delay+uint32(elapsed/time.Second)) {
+				c.releaseID(sock, req)
+				sock, b, err = c.transmit(ctx, req, rplyChn)
+			} else {
+				_, err = sock.conn.Write(b)
+			}
+			if err != nil {
+				if sock != nil {
+					c.releaseID(sock, req)
+				}
+				return
+			}
+		}
+		rt = rp.nextRT(rt, elapsed)
+		tmr.Reset(rt)
 	}
-	return
 }
 
 // NewRequest produces new client request with an random Authenticator
+// the Identifier is replaced on SendRequest with one allocated by the client, id is kept for compatibility
 func (c *Client) NewRequest(code PacketCode, id uint8) (req *Packet) {
 	var buff [16]byte
 	rand.Read(buff[:])
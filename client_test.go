@@ -2,6 +2,8 @@ package radigo
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -10,7 +12,9 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cgrates/radigo/codecs"
 )
@@ -111,7 +115,7 @@ func TestClientconnectZeroAttempts(t *testing.T) {
 	c := &Client{}
 	connAttempts := 0
 
-	err := c.connect(connAttempts)
+	err := c.connect(context.Background(), connAttempts)
 
 	if err != nil {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, err)
@@ -122,12 +126,12 @@ func TestClientconnectSleepAndDC(t *testing.T) {
 	c := &Client{
 		net:     "invalid",
 		address: "127.0.0.11:1234",
-		conn:    &net.UDPConn{},
+		socks:   []*clientSocket{{conn: &net.UDPConn{}}},
 	}
 	connAttempts := 2
 
 	experr := fmt.Sprintf("dial %s: unknown network %s", c.net, c.net)
-	err := c.connect(connAttempts)
+	err := c.connect(context.Background(), connAttempts)
 
 	if err == nil || err.Error() != experr {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, err)
@@ -139,7 +143,7 @@ func TestClientreadReplies(t *testing.T) {
 	c := &Client{}
 
 	close(stopRead)
-	c.readReplies(stopRead)
+	c.readReplies(&clientSocket{stopReading: stopRead})
 
 	if len(stopRead) != 0 {
 		t.Errorf("\nexpected 0,\nreceived: <%+v>", len(stopRead))
@@ -150,11 +154,10 @@ func TestClientreadRepliesInvalidReadArgument(t *testing.T) {
 	stopRead := make(chan struct{})
 	l := &loggerMock{}
 	c := &Client{
-		conn: &net.UDPConn{},
-		l:    l,
+		l: l,
 	}
 
-	c.readReplies(stopRead)
+	c.readReplies(&clientSocket{conn: &net.UDPConn{}, stopReading: stopRead})
 
 	explog := "error <invalid argument> when reading connection"
 	if l.msgType != "debug" {
@@ -171,13 +174,14 @@ func TestClientreadRepliesUnexpectedLen(t *testing.T) {
 	}()
 
 	stopRead := make(chan struct{})
-	c := &Client{
+	c := &Client{}
+
+	c.readReplies(&clientSocket{
 		conn: &connMock{
 			testcase: "unexpectedLen",
 		},
-	}
-
-	c.readReplies(stopRead)
+		stopReading: stopRead,
+	})
 
 	explog := "error <unexpected packet length received>\n"
 	rcvlog := buf.String()[20:]
@@ -208,18 +212,19 @@ func TestClientreadRepliesDecodeFail(t *testing.T) {
 		secret: "testSecret",
 		dict:   &Dictionary{},
 		coder:  Coder{},
-		conn:   c1,
+		l:      nopLogger{},
+	}
+
+	c.readReplies(&clientSocket{
+		conn: c1,
 		activeReqs: map[uint8]*packetReplyHandler{
 			1: {
 				rplChn: make(chan *Packet, 1),
 				pkt:    &Packet{},
 			},
 		},
-		l: nopLogger{},
-	}
-
-	c.readReplies(stopRead)
-	close(stopRead)
+		stopReading: stopRead,
+	})
 	explog := fmt.Sprintf("error <%s> when decoding packet", "invalid length")
 	rcvlog := buf.String()[20 : 20+len(explog)]
 
@@ -249,18 +254,19 @@ func TestClientreadReplies1(t *testing.T) {
 		secret: "testSecret",
 		dict:   &Dictionary{},
 		coder:  Coder{},
-		conn:   c1,
+		l:      nopLogger{},
+	}
+
+	c.readReplies(&clientSocket{
+		conn: c1,
 		activeReqs: map[uint8]*packetReplyHandler{
 			2: {
 				rplChn: make(chan *Packet, 1),
 				pkt:    &Packet{},
 			},
 		},
-		l: nopLogger{},
-	}
-
-	c.readReplies(stopRead)
-	close(stopRead)
+		stopReading: stopRead,
+	})
 	explog := fmt.Sprintf("error <no handler for packet with code: %d>", 1)
 	rcvlog := buf.String()[20 : 20+len(explog)]
 
@@ -278,6 +284,7 @@ func TestClientSendRequestEncodeFail(t *testing.T) {
 	c := &Client{
 		secret: "testSecret",
 		dict:   &Dictionary{},
+		socks:  []*clientSocket{{activeReqs: make(map[uint8]*packetReplyHandler)}},
 	}
 
 	experr := fmt.Sprintf("avp: %+v, no value", req.AVPs[0])
@@ -297,12 +304,14 @@ func TestClientSendRequestWriteFail(t *testing.T) {
 		Identifier: 1,
 	}
 	c := &Client{
-		secret:     "testSecret",
-		dict:       &Dictionary{},
-		activeReqs: make(map[uint8]*packetReplyHandler),
-		conn: &connMock{
-			testcase: "writeError",
-		},
+		secret: "testSecret",
+		dict:   &Dictionary{},
+		socks: []*clientSocket{{
+			activeReqs: make(map[uint8]*packetReplyHandler),
+			conn: &connMock{
+				testcase: "writeError",
+			},
+		}},
 	}
 
 	experr := "write mock error"
@@ -318,13 +327,186 @@ func TestClientSendRequestWriteFail(t *testing.T) {
 }
 
 func TestClientdisconnect(t *testing.T) {
-	c := &Client{
+	sock := &clientSocket{
 		stopReading: make(chan struct{}),
 	}
+	c := &Client{
+		socks: []*clientSocket{sock},
+	}
 
 	c.disconnect()
 
-	if len(c.stopReading) != 0 {
-		t.Errorf("\nexpected 0,\nreceived: <%+v>", len(c.stopReading))
+	if len(sock.stopReading) != 0 {
+		t.Errorf("\nexpected 0,\nreceived: <%+v>", len(sock.stopReading))
+	} else if !sock.closed || len(c.socks) != 0 {
+		t.Errorf("\nexpected closed socket,\nreceived: <%+v>", c.socks)
+	}
+}
+
+func TestClientallocateID(t *testing.T) {
+	c := &Client{
+		socks:    []*clientSocket{{activeReqs: make(map[uint8]*packetReplyHandler)}},
+		maxSocks: 1,
+	}
+	rplyChn := make(chan *Packet, 1)
+	ids := make(map[uint8]bool)
+	for i := 0; i < 256; i++ {
+		req := &Packet{}
+		if sock, err := c.allocateID(context.Background(), req, rplyChn); err != nil {
+			t.Fatal(err)
+		} else if sock != c.socks[0] {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", c.socks[0], sock)
+		}
+		ids[req.Identifier] = true
+	}
+	if len(ids) != 256 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 256, len(ids))
+	}
+	if _, err := c.allocateID(context.Background(), &Packet{}, rplyChn); err != ErrNoIdentifier {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNoIdentifier, err)
+	}
+	req := c.socks[0].activeReqs[7].pkt
+	c.releaseID(c.socks[0], req)
+	if _, err := c.allocateID(context.Background(), req, rplyChn); err != nil {
+		t.Error(err)
+	} else if req.Identifier != 7 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 7, req.Identifier)
+	}
+}
+
+func TestClientallocateIDDialUnlocked(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0") // accepts without completing the TLS handshake
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sock := &clientSocket{activeReqs: make(map[uint8]*packetReplyHandler)}
+	rplyChn := make(chan *Packet, 1)
+	for i := 0; i < 256; i++ {
+		sock.register(&Packet{}, rplyChn)
+	}
+	c := &Client{net: "tls", address: ln.Addr().String(), tlsCfg: &tls.Config{InsecureSkipVerify: true},
+		socks: []*clientSocket{sock}, l: nopLogger{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	errChn := make(chan error, 2)
+	for i := 0; i < 2; i++ { // second one waits for the dial of the first
+		go func() {
+			_, err := c.allocateID(ctx, &Packet{}, rplyChn)
+			errChn <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		c.releaseID(sock, sock.activeReqs[7].pkt)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("lock held while dialing")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errChn; err == nil {
+			t.Error("expecting dial error")
+		}
+	}
+	c.aReqsMux.Lock()
+	defer c.aReqsMux.Unlock()
+	if c.dialDone != nil || len(c.socks) != 1 {
+		t.Errorf("dialing not released: %+v", c.socks)
+	}
+}
+
+func TestClientSendRequestConcurrent(t *testing.T) {
+	dict := RFC2865Dictionary()
+	srv := NewServer("tcp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: dict}),
+		map[PacketCode]func(*Packet) (*Packet, error){
+			AccessRequest: func(req *Packet) (*Packet, error) {
+				time.Sleep(50 * time.Millisecond) // keep the requests in flight
+				rpl := req.Reply()
+				rpl.Code = AccessAccept
+				rpl.AVPs = append(rpl.AVPs, req.AVPs...)
+				return rpl, nil
+			},
+		}, nil, nil)
+	ln, err := net.Listen("tcp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan struct{})
+	defer func() {
+		close(stopChan)
+		ln.Close()
+	}()
+	go srv.serveTCP(stopChan, ln)
+	clnt, err := NewClient("tcp", ln.Addr().String(), "CGRateS.org", dict, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 600; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := clnt.NewRequest(AccessRequest, 1)
+			userName := fmt.Sprintf("user%d", i)
+			req.AVPs = append(req.AVPs, &AVP{Number: 1, RawValue: []byte(userName)})
+			if rpl, err := clnt.SendRequest(req); err != nil {
+				t.Error(err)
+			} else if rpl.Code != AccessAccept {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AccessAccept, rpl.Code)
+			} else if rcv := string(rpl.rawAttribute(1)); rcv != userName {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", userName, rcv)
+			}
+		}(i)
+	}
+	wg.Wait()
+	clnt.aReqsMux.Lock()
+	defer clnt.aReqsMux.Unlock()
+	if len(clnt.socks) < 3 {
+		t.Errorf("\nExpected at least 3 sockets, \nReceived: <%+v>", len(clnt.socks))
+	}
+	for _, sock := range clnt.socks {
+		if len(sock.activeReqs) != 0 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, len(sock.activeReqs))
+		}
+	}
+}
+
+func TestClientNewClientContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := NewClientContext(ctx, "invalid", "127.0.0.1:1812", "CGRateS.org",
+		RFC2865Dictionary(), -1, nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("connect not cancelled, elapsed: %s", elapsed)
+	}
+}
+
+func TestClientSendRequestContext(t *testing.T) {
+	var mux sync.Mutex
+	addr := testRetryServer(t, &mux, func(*Packet, []byte) *Packet { return nil })
+	clnt, err := NewClient("udp", addr, "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.SetRetryPolicy(RFC5080RetryPolicy); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = clnt.SendRequestContext(ctx, clnt.NewRequest(AccessRequest, 1)); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	clnt.aReqsMux.Lock()
+	defer clnt.aReqsMux.Unlock()
+	if nrReqs := len(clnt.socks[0].activeReqs); nrReqs != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, nrReqs)
 	}
 }
@@ -20,6 +20,14 @@ const (
 	BeginVendorKeyword = "BEGIN-VENDOR"
 	EndVendorKeyword   = "END-VENDOR"
 	IncludeFileKeyword = "$INCLUDE"
+	// attribute flags
+	ConcatFlag  = "concat"
+	HasTagFlag  = "has_tag"
+	EncryptFlag = "encrypt"
+	// encryption methods for the encrypt flag
+	UserPasswordEncrypt   = 1 // rfc2865 5.2
+	TunnelPasswordEncrypt = 2 // rfc2868 3.5
+	AscendSecretEncrypt   = 3 // Ascend-Send-Secret
 	// rfc2865 value Formats
 	TextValue    = "text"
 	StringValue  = "string"
@@ -99,29 +107,82 @@ ATTRIBUTE	Port-Limit		62	integer
 ATTRIBUTE	Login-LAT-Port		63	integer
 `
 
-// input: ATTRIBUTE attribute-name number type
+// parseAttributeNumber parses the number of an attribute
+// supports the rfc6929 dotted notation for the extended attributes (ie: 241.1)
+func parseAttributeNumber(nrStr string) (attrNr, extNr uint8, err error) {
+	nrs := strings.Split(nrStr, ".")
+	if len(nrs) > 2 {
+		return 0, 0, fmt.Errorf("unsupported attribute number: <%s>", nrStr)
+	}
+	parsedNrs := make([]uint8, len(nrs))
+	for i, nr := range nrs {
+		var n int
+		if n, err = strconv.Atoi(nr); err != nil {
+			return
+		} else if n > 255 {
+			return 0, 0, fmt.Errorf("attribute type <%d> must be lower than 255", n)
+		}
+		parsedNrs[i] = uint8(n)
+	}
+	if len(parsedNrs) == 1 {
+		return parsedNrs[0], 0, nil
+	}
+	if !isExtendedNumber(parsedNrs[0]) {
+		return 0, 0, fmt.Errorf("attribute type <%d> is not extended", parsedNrs[0])
+	}
+	return parsedNrs[1], parsedNrs[0], nil
+}
+
+// input: ATTRIBUTE attribute-name number type [flags]
 // input: one line from the reader
 func parseDictionaryAttribute(input []string) (*DictionaryAttribute, error) {
 	if len(input) < 4 {
 		return nil, fmt.Errorf("invalid attribute definition: %v", input)
 	}
-	attrNr, err := strconv.Atoi(input[2])
+	attrNr, extNr, err := parseAttributeNumber(input[2])
 	if err != nil {
 		return nil, err
-	} else if attrNr > 255 {
-		return nil,
-			fmt.Errorf("attribute type <%d> must be lower than 255", attrNr)
 	}
 	attrType := strings.Split(input[3], "[")[0] // remove [8] from octet[8]
-	return &DictionaryAttribute{AttributeName: input[1],
-		AttributeNumber: uint8(attrNr), AttributeType: attrType}, nil
+	dAttr := &DictionaryAttribute{AttributeName: input[1],
+		AttributeNumber: attrNr, AttributeType: attrType, ExtendedNumber: extNr}
+	if len(input) > 4 && !strings.HasPrefix(input[4], "#") {
+		if err := dAttr.parseFlags(input[4]); err != nil {
+			return nil, err
+		}
+	}
+	return dAttr, nil
 }
 
 // dictionaryAttribute defines a dictionary mapping and type for an attribute.
 type DictionaryAttribute struct {
 	AttributeName   string
-	AttributeNumber uint8
+	AttributeNumber uint8 // Extended-Type for the extended attributes
 	AttributeType   string
+	ExtendedNumber  uint8 // parent attribute number (241-246) for the rfc6929 extended attributes
+	Concat          bool  // values longer than one attribute are split over consecutive instances
+	HasTag          bool  // value is prefixed by a tag, rfc2868
+	Encrypt         uint8 // method used to hide the value on the wire, 0 for none
+}
+
+// parseFlags populates the attribute out of the comma separated flags
+// unsupported flags are ignored
+func (da *DictionaryAttribute) parseFlags(flags string) error {
+	for _, flag := range strings.Split(flags, ",") {
+		switch {
+		case flag == ConcatFlag:
+			da.Concat = true
+		case flag == HasTagFlag:
+			da.HasTag = true
+		case strings.HasPrefix(flag, EncryptFlag+"="):
+			method, err := strconv.ParseUint(flag[len(EncryptFlag)+1:], 10, 8)
+			if err != nil || method > AscendSecretEncrypt {
+				return fmt.Errorf("unsupported encrypt flag: <%s>", flag)
+			}
+			da.Encrypt = uint8(method)
+		}
+	}
+	return nil
 }
 
 // input: VALUE attribute-name value-name number
@@ -201,14 +262,16 @@ func NewDictionaryFromFoldersWithRFC2865(dirPath []string) (*Dictionary, error)
 // Dictionary translates between types and human readable attributes
 // provides per-client inFormation
 type Dictionary struct {
-	sync.RWMutex                                                   // locks the Dictionary so we can update it on run-time
-	ac           map[uint32]map[uint8]*DictionaryAttribute         // attach inFormation on vendor/attribute number
-	an           map[string]map[string]*DictionaryAttribute        // attach inFormation on vendor/attribute name
-	valName      map[string]map[string]map[string]*DictionaryValue // index value names
-	valNr        map[uint32]map[string]map[uint8]*DictionaryValue  // index value numbers
-	vc           map[uint32]*DictionaryVendor                      // index on vendor number
-	vn           map[string]*DictionaryVendor                      // index on vendor name
-	vndr         *DictionaryVendor                                 // active vendor number
+	sync.RWMutex                                                     // locks the Dictionary so we can update it on run-time
+	ac           map[uint32]map[uint8]*DictionaryAttribute           // attach inFormation on vendor/attribute number
+	an           map[string]map[string]*DictionaryAttribute          // attach inFormation on vendor/attribute name
+	valName      map[string]map[string]map[string]*DictionaryValue   // index value names
+	valNr        map[uint32]map[string]map[uint8]*DictionaryValue    // index value numbers
+	vc           map[uint32]*DictionaryVendor                        // index on vendor number
+	vn           map[string]*DictionaryVendor                        // index on vendor name
+	vndr         *DictionaryVendor                                   // active vendor number
+	ae           map[uint32]map[uint8]map[uint8]*DictionaryAttribute // extended attributes on vendor/parent/attribute number
+	vndrExt      uint8                                               // parent number of the active Extended-Vendor-Specific block
 }
 
 // parseFromReader loops through the lines in the reader, adding info to the Dictionary
@@ -241,10 +304,17 @@ func (dict *Dictionary) ParseFromReader(rdr io.Reader) (err error) {
 				continue
 			}
 			dict.Lock()
-			if _, hasIt := dict.ac[dict.vndr.VendorNumber]; !hasIt {
-				dict.ac[dict.vndr.VendorNumber] = make(map[uint8]*DictionaryAttribute)
+			if dAttr.ExtendedNumber == 0 {
+				dAttr.ExtendedNumber = dict.vndrExt
+			}
+			if dAttr.ExtendedNumber != 0 {
+				dict.indexExtended(dAttr)
+			} else {
+				if _, hasIt := dict.ac[dict.vndr.VendorNumber]; !hasIt {
+					dict.ac[dict.vndr.VendorNumber] = make(map[uint8]*DictionaryAttribute)
+				}
+				dict.ac[dict.vndr.VendorNumber][dAttr.AttributeNumber] = dAttr
 			}
-			dict.ac[dict.vndr.VendorNumber][dAttr.AttributeNumber] = dAttr
 			if _, hasIt := dict.an[dict.vndr.VendorName]; !hasIt {
 				dict.an[dict.vndr.VendorName] = make(map[string]*DictionaryAttribute)
 			}
@@ -298,6 +368,13 @@ func (dict *Dictionary) ParseFromReader(rdr io.Reader) (err error) {
 				continue
 			}
 			dict.vndr = dVndr // activate a new vendor for indexing
+			if len(flds) > 2 {
+				if extNr, err := parseVendorFormat(flds[2]); err != nil {
+					log.Printf("dictionary line: %d, <%s>", lnNr, err.Error())
+				} else {
+					dict.vndrExt = extNr
+				}
+			}
 
 		case EndVendorKeyword:
 			if len(flds) < 2 {
@@ -316,6 +393,7 @@ func (dict *Dictionary) ParseFromReader(rdr io.Reader) (err error) {
 				continue
 			}
 			dict.vndr = new(DictionaryVendor)
+			dict.vndrExt = 0
 
 		case IncludeFileKeyword: // ToDo
 		default:
@@ -326,6 +404,37 @@ func (dict *Dictionary) ParseFromReader(rdr io.Reader) (err error) {
 	return
 }
 
+// indexExtended indexes an extended attribute for the active vendor
+// dict should be locked by the caller
+func (dict *Dictionary) indexExtended(dAttr *DictionaryAttribute) {
+	if dict.ae == nil {
+		dict.ae = make(map[uint32]map[uint8]map[uint8]*DictionaryAttribute)
+	}
+	if _, hasIt := dict.ae[dict.vndr.VendorNumber]; !hasIt {
+		dict.ae[dict.vndr.VendorNumber] = make(map[uint8]map[uint8]*DictionaryAttribute)
+	}
+	if _, hasIt := dict.ae[dict.vndr.VendorNumber][dAttr.ExtendedNumber]; !hasIt {
+		dict.ae[dict.vndr.VendorNumber][dAttr.ExtendedNumber] = make(map[uint8]*DictionaryAttribute)
+	}
+	dict.ae[dict.vndr.VendorNumber][dAttr.ExtendedNumber][dAttr.AttributeNumber] = dAttr
+}
+
+// parseVendorFormat parses the format of a BEGIN-VENDOR block
+// input: format=Extended-Vendor-Specific-1 for VSAs nested in 241.26, rfc6929 2.4
+func parseVendorFormat(format string) (extNr uint8, err error) {
+	const evsPrefix = "format=Extended-Vendor-Specific-"
+	if !strings.HasPrefix(format, evsPrefix) {
+		return 0, fmt.Errorf("unsupported vendor format: %s", format)
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(format, evsPrefix))
+	if err != nil {
+		return 0, err
+	} else if n < 1 || n > 6 {
+		return 0, fmt.Errorf("unsupported vendor format: %s", format)
+	}
+	return uint8(240 + n), nil
+}
+
 // parseFromFolder walks through the folder/subfolders and loads all dictionary.* files it finds
 func (dict *Dictionary) ParseFromFolder(dirPath string) (err error) {
 	fi, err := os.Stat(dirPath)
@@ -371,6 +480,13 @@ func (dict *Dictionary) AttributeWithNumber(attrNr uint8, vendorCode uint32) *Di
 	return dict.ac[vendorCode][attrNr]
 }
 
+// AttributeWithExtendedNumber queries Dictionary for the extended Attribute nested into extNr
+func (dict *Dictionary) AttributeWithExtendedNumber(extNr, attrNr uint8, vendorCode uint32) *DictionaryAttribute {
+	dict.RLock()
+	defer dict.RUnlock()
+	return dict.ae[vendorCode][extNr][attrNr]
+}
+
 // DictionaryAttribute queries Dictionary for Attribute with specific name
 func (dict *Dictionary) AttributeWithName(attrName, VendorName string) *DictionaryAttribute {
 	dict.RLock()
@@ -444,3 +560,11 @@ func (dts *Dictionaries) GetInstance(instanceID string) (dict *Dictionary) {
 	dts.RUnlock()
 	return
 }
+
+// hasInstance returns true if there is a Dictionary configured for instanceID
+func (dts *Dictionaries) hasInstance(instanceID string) (has bool) {
+	dts.RLock()
+	_, has = dts.dicts[instanceID]
+	dts.RUnlock()
+	return
+}
@@ -869,3 +869,137 @@ func TestDictionaryGetInstance(t *testing.T) {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, rcv)
 	}
 }
+
+func TestDictionaryparseAttributeNumber(t *testing.T) {
+	if attrNr, extNr, err := parseAttributeNumber("26"); err != nil {
+		t.Error(err)
+	} else if attrNr != 26 || extNr != 0 {
+		t.Errorf("unexpected attrNr: %d, extNr: %d", attrNr, extNr)
+	}
+	if attrNr, extNr, err := parseAttributeNumber("245.3"); err != nil {
+		t.Error(err)
+	} else if attrNr != 3 || extNr != 245 {
+		t.Errorf("unexpected attrNr: %d, extNr: %d", attrNr, extNr)
+	}
+	experr := "attribute type <26> is not extended"
+	if _, _, err := parseAttributeNumber("26.1"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	experr = "attribute type <256> must be lower than 255"
+	if _, _, err := parseAttributeNumber("241.256"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	experr = "unsupported attribute number: <241.1.2>"
+	if _, _, err := parseAttributeNumber("241.1.2"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestDictionaryParseFromReaderExtended(t *testing.T) {
+	dictStr := `
+ATTRIBUTE	Extended-Attribute-1	241	extended
+ATTRIBUTE	Frag-Status		241.1	integer
+ATTRIBUTE	Extended-Attribute-5	245	long-extended
+ATTRIBUTE	Long-Blob		245.1	octets
+
+VENDOR		Nokia		94
+BEGIN-VENDOR	Nokia	format=Extended-Vendor-Specific-1
+ATTRIBUTE	Nokia-Extended-Data	1	string
+END-VENDOR	Nokia
+
+BEGIN-VENDOR	Nokia	format=Unknown
+ATTRIBUTE	Nokia-Data	1	string
+END-VENDOR	Nokia
+`
+	dict := NewEmptyDictionary()
+	if err := dict.ParseFromReader(strings.NewReader(dictStr)); err != nil {
+		t.Fatal(err)
+	}
+	eDA := &DictionaryAttribute{
+		AttributeName:   "Frag-Status",
+		AttributeNumber: 1,
+		AttributeType:   IntegerValue,
+		ExtendedNumber:  241,
+	}
+	if da := dict.AttributeWithExtendedNumber(241, 1, NoVendor); !reflect.DeepEqual(eDA, da) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eDA, da)
+	}
+	if da := dict.AttributeWithName("Frag-Status", ""); !reflect.DeepEqual(eDA, da) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eDA, da)
+	}
+	if da := dict.AttributeWithNumber(241, NoVendor); da == nil || da.AttributeType != "extended" {
+		t.Errorf("unexpected container attribute: %+v", da)
+	}
+	eDA = &DictionaryAttribute{
+		AttributeName:   "Nokia-Extended-Data",
+		AttributeNumber: 1,
+		AttributeType:   StringValue,
+		ExtendedNumber:  241,
+	}
+	if da := dict.AttributeWithExtendedNumber(241, 1, 94); !reflect.DeepEqual(eDA, da) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eDA, da)
+	}
+	eDA = &DictionaryAttribute{
+		AttributeName:   "Nokia-Data",
+		AttributeNumber: 1,
+		AttributeType:   StringValue,
+	}
+	if da := dict.AttributeWithNumber(1, 94); !reflect.DeepEqual(eDA, da) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eDA, da)
+	}
+	if dict.vndrExt != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, dict.vndrExt)
+	}
+}
+
+func TestDictionaryparseVendorFormat(t *testing.T) {
+	if extNr, err := parseVendorFormat("format=Extended-Vendor-Specific-5"); err != nil {
+		t.Error(err)
+	} else if extNr != 245 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 245, extNr)
+	}
+	experr := "unsupported vendor format: format=Extended-Vendor-Specific-7"
+	if _, err := parseVendorFormat("format=Extended-Vendor-Specific-7"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestDictionaryparseDictionaryAttributeFlags(t *testing.T) {
+	eAttr := &DictionaryAttribute{AttributeName: "EAP-Message",
+		AttributeNumber: 79, AttributeType: "octets", Concat: true}
+	if attr, err := parseDictionaryAttribute([]string{"ATTRIBUTE", "EAP-Message", "79", "octets", "unsupported,concat"}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eAttr, attr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eAttr, attr)
+	}
+	eAttr.Concat = false
+	if attr, err := parseDictionaryAttribute([]string{"ATTRIBUTE", "EAP-Message", "79", "octets", "#concat"}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eAttr, attr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eAttr, attr)
+	}
+}
+
+func TestDictionaryparseDictionaryAttributeHasTag(t *testing.T) {
+	eAttr := &DictionaryAttribute{AttributeName: "Tunnel-Type",
+		AttributeNumber: 64, AttributeType: "integer", HasTag: true}
+	if attr, err := parseDictionaryAttribute([]string{"ATTRIBUTE", "Tunnel-Type", "64", "integer", "has_tag"}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eAttr, attr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eAttr, attr)
+	}
+}
+
+func TestDictionaryparseDictionaryAttributeEncrypt(t *testing.T) {
+	eAttr := &DictionaryAttribute{AttributeName: "Tunnel-Password",
+		AttributeNumber: 69, AttributeType: "string", HasTag: true, Encrypt: TunnelPasswordEncrypt}
+	if attr, err := parseDictionaryAttribute([]string{"ATTRIBUTE", "Tunnel-Password", "69", "string", "has_tag,encrypt=2"}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eAttr, attr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eAttr, attr)
+	}
+	experr := "unsupported encrypt flag: <encrypt=4>"
+	if _, err := parseDictionaryAttribute([]string{"ATTRIBUTE", "Tunnel-Password", "69", "string", "encrypt=4"}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
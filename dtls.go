@@ -0,0 +1,310 @@
+package radigo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+const (
+	DTLSSecret         = "radius/dtls"   // fixed shared secret used over DTLS, rfc7360 2.1
+	DTLSSessionTimeout = 5 * time.Minute // idle DTLS sessions are closed after this interval, rfc7360 5.1.1
+	DTLSMaxSessions    = 4096            // sessions per listener, the pending handshakes are evicted once reached
+	dtlsSessionQueue   = 64              // datagrams buffered for a session before dropping
+)
+
+// isDTLSRecord checks if the datagram starts with a DTLS record header, rfc7360 5.1
+// DTLS content types (20-25) do not overlap with the RADIUS packet codes
+func isDTLSRecord(b []byte) bool {
+	return len(b) >= 13 && b[0] >= 20 && b[0] <= 25 && b[1] == 0xfe
+}
+
+// dtlsConfig converts the tls.Config into it's DTLS equivalent
+func dtlsConfig(cfg *tls.Config) *dtls.Config {
+	return &dtls.Config{
+		Certificates:         cfg.Certificates,
+		RootCAs:              cfg.RootCAs,
+		ClientCAs:            cfg.ClientCAs,
+		ClientAuth:           dtls.ClientAuthType(cfg.ClientAuth),
+		InsecureSkipVerify:   cfg.InsecureSkipVerify,
+		ServerName:           cfg.ServerName,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), TLSHandshakeTimeout)
+		},
+	}
+}
+
+// parseCertificates parses the raw certificates received over DTLS
+func parseCertificates(rawCerts [][]byte) (certs []*x509.Certificate) {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	return
+}
+
+// newDTLSSessions instantiates dtlsSessions
+func newDTLSSessions(pc net.PacketConn, maxSess int) *dtlsSessions {
+	return &dtlsSessions{pc: pc, maxSess: maxSess, sess: make(map[string]*dtlsSession)}
+}
+
+// dtlsSessions demultiplexes the datagrams received on one socket into per client address sessions
+type dtlsSessions struct {
+	sync.RWMutex
+	pc      net.PacketConn
+	maxSess int                     // limit of sessions, 0 for none
+	sess    map[string]*dtlsSession // indexed on remote address
+}
+
+// session returns the session for addr, creating it if not already there
+// returns nil once maxSess is reached and all the sessions are established
+func (ds *dtlsSessions) session(addr net.Addr) (sess *dtlsSession, isNew bool) {
+	ds.Lock()
+	defer ds.Unlock()
+	if sess = ds.sess[addr.String()]; sess != nil {
+		return
+	}
+	if ds.maxSess > 0 && len(ds.sess) >= ds.maxSess {
+		evicted := ds.idlestPending()
+		if evicted == nil {
+			return nil, false
+		}
+		delete(ds.sess, evicted.addr.String())
+		go evicted.Close() // onClose needs the lock
+	}
+	sess = &dtlsSession{pc: ds.pc, addr: addr,
+		rcvChn: make(chan []byte, dtlsSessionQueue), done: make(chan struct{})}
+	sess.onClose = func() {
+		ds.Lock()
+		if ds.sess[addr.String()] == sess {
+			delete(ds.sess, addr.String())
+		}
+		ds.Unlock()
+	}
+	sess.lastRcv.Store(time.Now().UnixNano())
+	ds.sess[addr.String()] = sess
+	return sess, true
+}
+
+// idlestPending returns the session without handshake receiving the oldest datagram, called with the lock held
+// established sessions are never evicted so spoofed sources cannot push out the authenticated clients
+func (ds *dtlsSessions) idlestPending() (idlest *dtlsSession) {
+	for _, sess := range ds.sess {
+		if sess.established.Load() {
+			continue
+		}
+		if idlest == nil || sess.lastRcv.Load() < idlest.lastRcv.Load() {
+			idlest = sess
+		}
+	}
+	return
+}
+
+// hasClient returns true if there is an active session for the client with connID
+func (ds *dtlsSessions) hasClient(connID string) bool {
+	ds.RLock()
+	defer ds.RUnlock()
+	for addr := range ds.sess {
+		if connIDFromAddr(addr) == connID {
+			return true
+		}
+	}
+	return false
+}
+
+// closeAll closes the active sessions
+func (ds *dtlsSessions) closeAll() {
+	ds.RLock()
+	sess := make([]*dtlsSession, 0, len(ds.sess))
+	for _, s := range ds.sess {
+		sess = append(sess, s)
+	}
+	ds.RUnlock()
+	for _, s := range sess {
+		s.Close()
+	}
+}
+
+// dtlsSession is the net.Conn of one client address over a shared net.PacketConn
+type dtlsSession struct {
+	pc          net.PacketConn
+	addr        net.Addr
+	rcvChn      chan []byte // datagrams received from addr
+	done        chan struct{}
+	closeOnce   sync.Once
+	onClose     func()
+	established atomic.Bool  // handshake completed
+	lastRcv     atomic.Int64 // unix nanoseconds of the last datagram received
+}
+
+// push queues a datagram for reading, dropping it if the queue is full
+func (sess *dtlsSession) push(b []byte) {
+	sess.lastRcv.Store(time.Now().UnixNano())
+	select {
+	case sess.rcvChn <- b:
+	case <-sess.done:
+	default:
+	}
+}
+
+func (sess *dtlsSession) Read(b []byte) (n int, err error) {
+	select {
+	case d := <-sess.rcvChn:
+		return copy(b, d), nil
+	case <-sess.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (sess *dtlsSession) Write(b []byte) (n int, err error) {
+	return sess.pc.WriteTo(b, sess.addr)
+}
+
+func (sess *dtlsSession) Close() error {
+	sess.closeOnce.Do(func() {
+		close(sess.done)
+		if sess.onClose != nil {
+			sess.onClose()
+		}
+	})
+	return nil
+}
+
+func (sess *dtlsSession) LocalAddr() net.Addr {
+	return sess.pc.LocalAddr()
+}
+
+func (sess *dtlsSession) RemoteAddr() net.Addr {
+	return sess.addr
+}
+
+func (sess *dtlsSession) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (sess *dtlsSession) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (sess *dtlsSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// handleDTLSSession establishes the DTLS session and listens on it for packets
+// keeps the datagram semantics, one read returning one packet
+func (s *Server) handleDTLSSession(sess *dtlsSession) {
+	conn, err := dtls.Server(sess, dtlsConfig(s.tlsCfg))
+	if err != nil {
+		s.l.Debug(fmt.Sprintf("error: <%s> on DTLS handshake with <%s>", err.Error(), sess.addr))
+		sess.Close()
+		return
+	}
+	defer conn.Close()
+	sess.established.Store(true)
+	synConn := &syncedTCPConn{conn: conn, network: "dtls"}
+	peerCerts := parseCertificates(conn.ConnectionState().PeerCertificates)
+	if len(peerCerts) != 0 {
+		synConn.peerCert = peerCerts[0]
+	}
+	synConn.connID, synConn.secret = s.peerClientID(peerCerts, connIDFromAddr(sess.addr.String()), DTLSSecret)
+	for {
+		var b [MaxPacketLen]byte
+		conn.SetReadDeadline(time.Now().Add(DTLSSessionTimeout))
+		n, err := conn.Read(b[:])
+		if err != nil {
+			s.l.Debug(fmt.Sprintf("error: <%s> when reading packets over DTLS, closing session...", err.Error()))
+			return
+		}
+		if n < 20 || uint16(n) < binary.BigEndian.Uint16(b[2:4]) {
+			log.Printf("error: unexpected packet length received over DTLS: <%d>", n)
+			continue
+		}
+		s.handleRcvedBytes(b[:n], synConn)
+	}
+}
+
+func (s *Server) listenAndServeDTLS(stopChan <-chan struct{}) error {
+	if s.tlsCfg == nil {
+		return errNoTLSConfig
+	}
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stopChan
+		pc.Close()
+	}()
+	return s.serveDTLS(stopChan, pc)
+}
+
+// serveDTLS reads the datagrams on pc, dispatching the DTLS records to the per address sessions
+// plain RADIUS/UDP is accepted only from clients not requiring DTLS and without an active session, rfc7360 5.1
+func (s *Server) serveDTLS(stopChan <-chan struct{}, pc net.PacketConn) error {
+	sessions := newDTLSSessions(pc, DTLSMaxSessions)
+	defer sessions.closeAll()
+	for {
+		select {
+		case <-stopChan:
+			return nil
+		default:
+		}
+		b := make([]byte, MaxPacketLen)
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("error: <%s> when reading packets over udp", err.Error())
+			continue
+		}
+		if isDTLSRecord(b[:n]) {
+			sess, isNew := sessions.session(addr)
+			if sess == nil {
+				s.l.Debug(fmt.Sprintf("dropping DTLS record from <%s>, too many sessions", addr))
+				continue
+			}
+			if isNew {
+				go s.handleDTLSSession(sess)
+			}
+			sess.push(b[:n])
+			continue
+		}
+		connID := connIDFromAddr(addr.String())
+		if s.secrets.RequireDTLS(connID) || sessions.hasClient(connID) {
+			s.l.Debug(fmt.Sprintf("dropping plain RADIUS/UDP packet from DTLS client <%s>", addr))
+			continue
+		}
+		if n < 20 || uint16(n) < binary.BigEndian.Uint16(b[2:4]) {
+			log.Printf("error: unexpected packet length received over UDP: <%d>", n)
+			continue
+		}
+		s.handleRcvedBytes(b[:n], &syncedUDPConn{connID: connID, addr: addr, laddr: pc.LocalAddr(), pc: pc})
+	}
+}
+
+// dialDTLS establishes a client DTLS session with the address
+func dialDTLS(ctx context.Context, address string, tlsCfg *tls.Config) (net.Conn, error) {
+	if tlsCfg == nil {
+		return nil, errNoTLSConfig
+	}
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return dtls.DialWithContext(ctx, "udp", raddr, dtlsConfig(tlsCfg))
+}
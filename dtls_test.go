@@ -0,0 +1,170 @@
+package radigo
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDTLSisDTLSRecord(t *testing.T) {
+	hello := []byte{0x16, 0xfe, 0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10}
+	if !isDTLSRecord(hello) {
+		t.Errorf("expecting DTLS record: % x", hello)
+	}
+	radPkt := []byte{
+		0x01, 0x03, 0x00, 0x16, 0x03, 0x03, 0x03, 0x04, 0x04, 0x04, 0x04,
+		0x05, 0x05, 0x05, 0x05, 0x05, 0x06, 0x06, 0x06, 0x06, 0x06, 0x06,
+	}
+	if isDTLSRecord(radPkt) {
+		t.Errorf("not expecting DTLS record: % x", radPkt)
+	}
+	if isDTLSRecord(hello[:12]) {
+		t.Errorf("not expecting DTLS record: % x", hello[:12])
+	}
+}
+
+func TestDTLSSessions(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ds := newDTLSSessions(pc, 0)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1812}
+	sess, isNew := ds.session(addr)
+	if !isNew {
+		t.Error("expecting new session")
+	}
+	if sess2, isNew := ds.session(addr); isNew || sess2 != sess {
+		t.Error("expecting existing session")
+	}
+	if !ds.hasClient("127.0.0.2") {
+		t.Error("expecting client session")
+	}
+	sess.push([]byte{0x01})
+	var b [10]byte
+	if n, err := sess.Read(b[:]); err != nil || n != 1 {
+		t.Errorf("unexpected read: %d, err: %v", n, err)
+	}
+	ds.closeAll()
+	if ds.hasClient("127.0.0.2") {
+		t.Error("not expecting client session")
+	}
+	if _, err := sess.Read(b[:]); err != net.ErrClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", net.ErrClosed, err)
+	}
+}
+
+func TestDTLSSessionsLimit(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ds := newDTLSSessions(pc, 2)
+	defer ds.closeAll()
+	addr1 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1812}
+	addr2 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1812}
+	addr3 := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 4), Port: 1812}
+	sess1, _ := ds.session(addr1)
+	sess2, _ := ds.session(addr2)
+	sess1.established.Store(true)
+	sess3, isNew := ds.session(addr3) // evicts the pending one
+	if !isNew || sess3 == nil {
+		t.Fatal("expecting new session")
+	}
+	select {
+	case <-sess2.done:
+	case <-time.After(time.Second):
+		t.Error("pending session not closed")
+	}
+	if ds.hasClient("127.0.0.3") || !ds.hasClient("127.0.0.2") || !ds.hasClient("127.0.0.4") {
+		t.Errorf("unexpected sessions: %+v", ds.sess)
+	}
+	sess3.established.Store(true)
+	if sess, isNew := ds.session(addr2); sess != nil || isNew { // all established
+		t.Errorf("unexpected session: %+v", sess)
+	}
+	if sess, _ := ds.session(addr1); sess != sess1 { // existing ones still served
+		t.Error("expecting existing session")
+	}
+}
+
+func TestDTLSClientServer(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	dict := RFC2865Dictionary()
+	srv := NewTLSServer("dtls", "127.0.0.1:0", srvCfg,
+		NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: dict}),
+		map[PacketCode]func(*Packet) (*Packet, error){
+			AccessRequest: func(req *Packet) (*Packet, error) {
+				rpl := req.Reply()
+				rpl.Code = AccessAccept
+				return rpl, nil
+			},
+		}, nil, nil)
+	pc, err := net.ListenPacket("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan struct{})
+	defer func() {
+		close(stopChan)
+		pc.Close()
+	}()
+	go srv.serveDTLS(stopChan, pc)
+
+	// plain RADIUS/UDP is accepted while there is no DTLS session
+	udpClnt, err := NewClient("udp", pc.LocalAddr().String(), "CGRateS.org", dict, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpl, err := udpClnt.SendRequest(udpClnt.NewRequest(AccessRequest, 1)); err != nil {
+		t.Error(err)
+	} else if rpl.Code != AccessAccept {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AccessAccept, rpl.Code)
+	}
+
+	clnt, err := NewTLSClient("dtls", pc.LocalAddr().String(), clntCfg, dict, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clnt.secret != DTLSSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", DTLSSecret, clnt.secret)
+	}
+	if rpl, err := clnt.SendRequest(clnt.NewRequest(AccessRequest, 2)); err != nil {
+		t.Error(err)
+	} else if rpl.Code != AccessAccept {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AccessAccept, rpl.Code)
+	}
+
+	// plain RADIUS/UDP is refused once the client has a DTLS session
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var buf [4096]byte
+	req := udpClnt.NewRequest(AccessRequest, 3)
+	req.secret = "CGRateS.org"
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := conn.Read(buf[:]); err == nil {
+		t.Errorf("unexpected reply: % x", buf[:n])
+	}
+}
+
+func TestDTLSListenAndServeMissingConfig(t *testing.T) {
+	srv := &Server{
+		net: "dtls",
+	}
+	if err := srv.ListenAndServe(make(chan struct{})); err != errNoTLSConfig {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", errNoTLSConfig, err)
+	}
+}
@@ -0,0 +1,427 @@
+package radigo
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	StateNumber      = 24 // State AVP number, rfc2865 5.24
+	EAPMessageNumber = 79 // EAP-Message AVP number, rfc3579 3.1
+	// EAP codes, rfc3748 4
+	EAPRequest  = 1
+	EAPResponse = 2
+	EAPSuccess  = 3
+	EAPFailure  = 4
+	// EAP method types, rfc3748 5
+	EAPTypeIdentity     = 1
+	EAPTypeNotification = 2
+	EAPTypeNak          = 3
+	EAPTypeMD5          = 4
+	EAPTypeGTC          = 6
+	// EAPSessionTimeout is the default lifetime of an unfinished EAP conversation
+	EAPSessionTimeout = 30 * time.Second
+)
+
+var (
+	ErrEAPMessageMissing = errors.New("missing EAP-Message")
+	ErrEAPSessionMissing = errors.New("no EAP session for State")
+)
+
+// EAPPacket is the EAP packet carried in EAP-Message attributes, rfc3748 4
+type EAPPacket struct {
+	Code       uint8
+	Identifier uint8
+	Type       uint8  // only for Request and Response
+	Data       []byte // Type-Data
+}
+
+// DecodeEAPPacket parses the EAP packet out of wire data
+func DecodeEAPPacket(b []byte) (*EAPPacket, error) {
+	if len(b) < 4 {
+		return nil, errors.New("EAP packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return nil, fmt.Errorf("invalid EAP packet length: %d", length)
+	}
+	eap := &EAPPacket{Code: b[0], Identifier: b[1]}
+	switch eap.Code {
+	case EAPRequest, EAPResponse:
+		if length < 5 {
+			return nil, fmt.Errorf("invalid EAP packet length: %d", length)
+		}
+		eap.Type = b[4]
+		eap.Data = append([]byte{}, b[5:length]...)
+	case EAPSuccess, EAPFailure:
+	default:
+		return nil, fmt.Errorf("unsupported EAP code: %d", eap.Code)
+	}
+	return eap, nil
+}
+
+// Encode returns the wire data of the EAP packet
+func (eap *EAPPacket) Encode() []byte {
+	if eap.Code == EAPSuccess || eap.Code == EAPFailure {
+		return []byte{eap.Code, eap.Identifier, 0, 4}
+	}
+	b := make([]byte, 5+len(eap.Data))
+	b[0], b[1], b[4] = eap.Code, eap.Identifier, eap.Type
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	copy(b[5:], eap.Data)
+	return b
+}
+
+// EAPMessage returns the EAP packet out of the EAP-Message attributes, joined in order
+func (p *Packet) EAPMessage() (*EAPPacket, error) {
+	p.RLock()
+	defer p.RUnlock()
+	var b []byte
+	for _, avp := range p.AVPs {
+		if avp.Number == EAPMessageNumber {
+			b = append(b, avp.RawValue...)
+		}
+	}
+	if b == nil {
+		return nil, ErrEAPMessageMissing
+	}
+	return DecodeEAPPacket(b)
+}
+
+// SetEAPMessage replaces the EAP-Message attributes with the ones of the EAP packet
+// split over consecutive attributes when longer than 253 bytes
+func (p *Packet) SetEAPMessage(eap *EAPPacket) {
+	p.Lock()
+	defer p.Unlock()
+	avps := p.AVPs[:0]
+	for _, avp := range p.AVPs {
+		if avp.Number != EAPMessageNumber {
+			avps = append(avps, avp)
+		}
+	}
+	for b := eap.Encode(); len(b) != 0; {
+		frag := b
+		if len(frag) > 253 {
+			frag = b[:253]
+		}
+		avps = append(avps, &AVP{Number: EAPMessageNumber, RawValue: frag})
+		b = b[len(frag):]
+	}
+	p.AVPs = avps
+}
+
+// EAPStatus is the outcome of processing an EAP response by a method
+type EAPStatus uint8
+
+const (
+	EAPContinue EAPStatus = iota // a new request should be sent to the peer
+	EAPSucceeded
+	EAPFailed
+)
+
+// EAPMethod is implemented by the EAP authentication methods registered to EAPServer
+type EAPMethod interface {
+	Type() uint8
+	// Start returns the Type-Data of the first request, once the identity of the peer is known
+	Start(sess *EAPSession) ([]byte, error)
+	// Process handles the Type-Data of a peer response
+	// returning the Type-Data of the next request when status is EAPContinue
+	Process(sess *EAPSession, data []byte) ([]byte, EAPStatus, error)
+}
+
+// EAPSession holds the data of one EAP conversation, carried over Access-Challenges via State
+type EAPSession struct {
+	Identity string      // out of EAP-Response/Identity
+	Method   uint8       // type of the method in use
+	ID       uint8       // Identifier of the last EAP request sent to the peer
+	Request  *Packet     // Access-Request currently processed
+	Data     interface{} // method specific data, closed at the end of conversation if io.Closer
+	MSK      []byte      // Master Session Key exported by the method on success, rfc5247
+	expires  time.Time
+}
+
+// NewEAPServer instantiates the EAPServer
+// sessionTimeout limits the lifetime of the unfinished conversations, EAPSessionTimeout if 0
+func NewEAPServer(sessionTimeout time.Duration) *EAPServer {
+	if sessionTimeout == 0 {
+		sessionTimeout = EAPSessionTimeout
+	}
+	return &EAPServer{methods: make(map[uint8]EAPMethod),
+		sessions: make(map[string]*EAPSession), sessionTimeout: sessionTimeout}
+}
+
+// EAPServer authenticates Access-Requests carrying EAP, using the registered methods
+type EAPServer struct {
+	sync.RWMutex
+	methods        map[uint8]EAPMethod
+	mthdOrder      []uint8 // preference when proposing methods
+	sessions       map[string]*EAPSession
+	sessionTimeout time.Duration
+	lastSweep      time.Time
+}
+
+// RegisterMethod adds a new method, the first registered one is proposed to the peers
+func (es *EAPServer) RegisterMethod(m EAPMethod) {
+	es.Lock()
+	defer es.Unlock()
+	if _, has := es.methods[m.Type()]; !has {
+		es.mthdOrder = append(es.mthdOrder, m.Type())
+	}
+	es.methods[m.Type()] = m
+}
+
+func (es *EAPServer) method(typ uint8) EAPMethod {
+	es.RLock()
+	defer es.RUnlock()
+	return es.methods[typ]
+}
+
+// storeSession saves the session under a new State, returned for the Access-Challenge
+func (es *EAPServer) storeSession(sess *EAPSession) []byte {
+	state := make([]byte, 16)
+	rand.Read(state)
+	now := time.Now()
+	sess.expires = now.Add(es.sessionTimeout)
+	es.Lock()
+	if now.Sub(es.lastSweep) > es.sessionTimeout { // remove abandoned conversations
+		for k, s := range es.sessions {
+			if now.After(s.expires) {
+				delete(es.sessions, k)
+				closeSession(s)
+			}
+		}
+		es.lastSweep = now
+	}
+	es.sessions[string(state)] = sess
+	es.Unlock()
+	return state
+}
+
+// popSession returns the session stored under State, removing it
+func (es *EAPServer) popSession(state []byte) *EAPSession {
+	es.Lock()
+	defer es.Unlock()
+	sess, has := es.sessions[string(state)]
+	if !has {
+		return nil
+	}
+	delete(es.sessions, string(state))
+	if time.Now().After(sess.expires) {
+		closeSession(sess)
+		return nil
+	}
+	return sess
+}
+
+// closeSession releases the resources held by the method data
+func closeSession(sess *EAPSession) {
+	if c, canClose := sess.Data.(io.Closer); canClose {
+		c.Close()
+	}
+}
+
+// HandleRequest processes the EAP conversation out of the Access-Request and returns the reply
+// can be registered directly as the AccessRequest handler of the Server
+func (es *EAPServer) HandleRequest(req *Packet) (*Packet, error) {
+	eap, err := req.EAPMessage()
+	if err != nil {
+		return nil, err
+	}
+	if !req.Has(MessageAuthenticatorNumber) { // silently discarded, rfc3579 3.2
+		return nil, nil
+	}
+	if eap.Code != EAPResponse {
+		return es.failure(req, eap.Identifier), nil
+	}
+	var sess *EAPSession
+	req.RLock()
+	state := req.rawAttribute(StateNumber)
+	req.RUnlock()
+	if state != nil {
+		if sess = es.popSession(state); sess == nil {
+			return nil, ErrEAPSessionMissing
+		}
+		if eap.Identifier != sess.ID { // not answering our last request
+			closeSession(sess)
+			return es.failure(req, eap.Identifier), nil
+		}
+	} else if eap.Type != EAPTypeIdentity {
+		return es.failure(req, eap.Identifier), nil
+	}
+	if sess == nil { // new conversation
+		sess = &EAPSession{Identity: string(eap.Data), ID: eap.Identifier}
+		es.RLock()
+		if len(es.mthdOrder) != 0 {
+			sess.Method = es.mthdOrder[0]
+		}
+		es.RUnlock()
+		return es.start(req, sess)
+	}
+	sess.Request = req
+	if eap.Type == EAPTypeNak { // peer proposes other methods
+		prevMethod := sess.Method
+		sess.Method = 0
+		for _, typ := range eap.Data {
+			if typ != prevMethod && es.method(typ) != nil {
+				sess.Method = typ
+				break
+			}
+		}
+		return es.start(req, sess)
+	}
+	m := es.method(sess.Method)
+	if m == nil || eap.Type != sess.Method {
+		closeSession(sess)
+		return es.failure(req, sess.ID), nil
+	}
+	data, status, err := m.Process(sess, eap.Data)
+	if err != nil {
+		log.Printf("error: <%s> processing EAP method: %d", err.Error(), sess.Method)
+		closeSession(sess)
+		return es.failure(req, sess.ID), nil
+	}
+	switch status {
+	case EAPSucceeded:
+		closeSession(sess)
+		return es.success(req, sess), nil
+	case EAPFailed:
+		closeSession(sess)
+		return es.failure(req, sess.ID), nil
+	}
+	sess.ID++
+	return es.challenge(req, sess, data), nil
+}
+
+// start sends the first request of the session method
+func (es *EAPServer) start(req *Packet, sess *EAPSession) (*Packet, error) {
+	m := es.method(sess.Method)
+	if m == nil {
+		return es.failure(req, sess.ID), nil
+	}
+	sess.Request = req
+	closeSession(sess)
+	sess.Data = nil
+	sess.ID++
+	data, err := m.Start(sess)
+	if err != nil {
+		log.Printf("error: <%s> starting EAP method: %d", err.Error(), sess.Method)
+		closeSession(sess)
+		return es.failure(req, sess.ID), nil
+	}
+	return es.challenge(req, sess, data), nil
+}
+
+// challenge builds the Access-Challenge carrying the EAP request with sess.ID
+func (es *EAPServer) challenge(req *Packet, sess *EAPSession, data []byte) *Packet {
+	sess.Request = nil // do not keep the packet over the round trip
+	rply := eapReply(req, AccessChallenge,
+		&EAPPacket{Code: EAPRequest, Identifier: sess.ID, Type: sess.Method, Data: data})
+	rply.AVPs = append(rply.AVPs, &AVP{Number: StateNumber, RawValue: es.storeSession(sess)})
+	return rply
+}
+
+// success builds the Access-Accept with EAP-Success, attaching the MPPE keys out of MSK
+func (es *EAPServer) success(req *Packet, sess *EAPSession) *Packet {
+	rply := eapReply(req, AccessAccept, &EAPPacket{Code: EAPSuccess, Identifier: sess.ID})
+	if len(sess.MSK) >= 64 { // rfc5216 2.3
+		rply.AddMPPEKeys(sess.MSK[32:64], sess.MSK[:32])
+	}
+	return rply
+}
+
+// failure builds the Access-Reject with EAP-Failure
+func (es *EAPServer) failure(req *Packet, id uint8) *Packet {
+	return eapReply(req, AccessReject, &EAPPacket{Code: EAPFailure, Identifier: id})
+}
+
+// eapReply builds the reply to req, carrying the EAP packet and Message-Authenticator
+func eapReply(req *Packet, code PacketCode, eap *EAPPacket) *Packet {
+	rply := req.Reply()
+	rply.Code = code
+	rply.SetEAPMessage(eap)
+	rply.AddMessageAuthenticator()
+	return rply
+}
+
+// NewEAPMD5 instantiates the EAP-MD5 method, rfc3748 5.4
+// password returns the cleartext password of the identity
+func NewEAPMD5(password func(identity string) (string, error)) *EAPMD5 {
+	return &EAPMD5{password: password}
+}
+
+// EAPMD5 implements the EAP-MD5 method
+type EAPMD5 struct {
+	password func(identity string) (string, error)
+}
+
+func (*EAPMD5) Type() uint8 {
+	return EAPTypeMD5
+}
+
+// Start sends the MD5-Challenge: Value-Size(1) + Value
+func (*EAPMD5) Start(sess *EAPSession) ([]byte, error) {
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+	sess.Data = challenge
+	return append([]byte{16}, challenge...), nil
+}
+
+// Process checks the response: MD5(Identifier + password + challenge)
+func (m *EAPMD5) Process(sess *EAPSession, data []byte) ([]byte, EAPStatus, error) {
+	challenge, canCast := sess.Data.([]byte)
+	if !canCast {
+		return nil, EAPFailed, errors.New("missing EAP-MD5 challenge")
+	}
+	if len(data) < 17 || data[0] != 16 {
+		return nil, EAPFailed, nil
+	}
+	password, err := m.password(sess.Identity)
+	if err != nil {
+		return nil, EAPFailed, err
+	}
+	h := md5.New()
+	h.Write([]byte{sess.ID})
+	h.Write([]byte(password))
+	h.Write(challenge)
+	if subtle.ConstantTimeCompare(h.Sum(nil), data[1:17]) != 1 {
+		return nil, EAPFailed, nil
+	}
+	return nil, EAPSucceeded, nil
+}
+
+// NewEAPGTC instantiates the EAP-GTC method, rfc3748 5.6
+// authenticate validates the response (password or token) of the identity
+func NewEAPGTC(prompt string, authenticate func(identity string, response []byte) bool) *EAPGTC {
+	return &EAPGTC{prompt: prompt, authenticate: authenticate}
+}
+
+// EAPGTC implements the EAP-GTC method
+type EAPGTC struct {
+	prompt       string
+	authenticate func(identity string, response []byte) bool
+}
+
+func (*EAPGTC) Type() uint8 {
+	return EAPTypeGTC
+}
+
+// Start sends the prompt message
+func (m *EAPGTC) Start(sess *EAPSession) ([]byte, error) {
+	return []byte(m.prompt), nil
+}
+
+// Process validates the response of the peer
+func (m *EAPGTC) Process(sess *EAPSession, data []byte) ([]byte, EAPStatus, error) {
+	if !m.authenticate(sess.Identity, data) {
+		return nil, EAPFailed, nil
+	}
+	return nil, EAPSucceeded, nil
+}
@@ -0,0 +1,243 @@
+package radigo
+
+import (
+	"crypto/md5"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEAPPacketEncodeDecode(t *testing.T) {
+	eap := &EAPPacket{Code: EAPResponse, Identifier: 3, Type: EAPTypeIdentity, Data: []byte("cgrates")}
+	b := eap.Encode()
+	if len(b) != 12 || b[3] != 12 {
+		t.Errorf("unexpected encoded packet: %+v", b)
+	}
+	if rcv, err := DecodeEAPPacket(b); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eap, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eap, rcv)
+	}
+	eap = &EAPPacket{Code: EAPSuccess, Identifier: 4}
+	if rcv, err := DecodeEAPPacket(eap.Encode()); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eap, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eap, rcv)
+	}
+	experr := "invalid EAP packet length: 13"
+	if _, err := DecodeEAPPacket(append(b[:3:3], 13)); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	experr = "unsupported EAP code: 5"
+	if _, err := DecodeEAPPacket([]byte{5, 1, 0, 4}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestEAPPacketEAPMessage(t *testing.T) {
+	pkt := NewPacket(AccessChallenge, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if _, err := pkt.EAPMessage(); err != ErrEAPMessageMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrEAPMessageMissing, err)
+	}
+	eap := &EAPPacket{Code: EAPRequest, Identifier: 1, Type: EAPTypeGTC,
+		Data: []byte(strings.Repeat("CGRateS.org", 50))}
+	pkt.SetEAPMessage(eap)
+	pkt.SetEAPMessage(eap) // replaces the previous one
+	if len(pkt.AVPs) != 3 {
+		t.Errorf("unexpected AVPs: %+v", pkt.AVPs)
+	}
+	var buf [4096]byte
+	n, err := pkt.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := &Packet{dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if rcvEAP, err := rcv.EAPMessage(); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(eap, rcvEAP) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eap, rcvEAP)
+	}
+}
+
+// testEAPPeerRequest builds the Access-Request carrying the EAP response of the peer
+func testEAPPeerRequest(eap *EAPPacket, challenge *Packet) *Packet {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.SetEAPMessage(eap)
+	req.AddMessageAuthenticator()
+	if challenge != nil {
+		for _, avp := range challenge.AVPs {
+			if avp.Number == StateNumber {
+				req.AVPs = append(req.AVPs, &AVP{Number: StateNumber, RawValue: avp.RawValue})
+			}
+		}
+	}
+	return req
+}
+
+func testEAPMD5Server() *EAPServer {
+	es := NewEAPServer(0)
+	es.RegisterMethod(NewEAPMD5(func(identity string) (string, error) {
+		return identity + "Password", nil
+	}))
+	es.RegisterMethod(NewEAPGTC("Password:", func(identity string, response []byte) bool {
+		return string(response) == identity+"Token"
+	}))
+	return es
+}
+
+func TestEAPServerMD5(t *testing.T) {
+	es := testEAPMD5Server()
+	for _, password := range []string{"cgratesPassword", "wrongPassword"} {
+		rply, err := es.HandleRequest(testEAPPeerRequest(
+			&EAPPacket{Code: EAPResponse, Identifier: 0, Type: EAPTypeIdentity, Data: []byte("cgrates")}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rply.Code != AccessChallenge || !rply.Has(StateNumber) || !rply.Has(MessageAuthenticatorNumber) {
+			t.Fatalf("unexpected reply: %+v", rply)
+		}
+		eapReq, err := rply.EAPMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if eapReq.Code != EAPRequest || eapReq.Identifier != 1 || eapReq.Type != EAPTypeMD5 ||
+			len(eapReq.Data) != 17 {
+			t.Fatalf("unexpected EAP request: %+v", eapReq)
+		}
+		h := md5.New()
+		h.Write([]byte{eapReq.Identifier})
+		h.Write([]byte(password))
+		h.Write(eapReq.Data[1:17])
+		rply, err = es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+			Identifier: eapReq.Identifier, Type: EAPTypeMD5, Data: append([]byte{16}, h.Sum(nil)...)}, rply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		eCode, eEAPCode := AccessAccept, uint8(EAPSuccess)
+		if password == "wrongPassword" {
+			eCode, eEAPCode = AccessReject, EAPFailure
+		}
+		if rply.Code != eCode {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eCode, rply.Code)
+		}
+		if eapRply, err := rply.EAPMessage(); err != nil {
+			t.Error(err)
+		} else if eapRply.Code != eEAPCode || eapRply.Identifier != eapReq.Identifier {
+			t.Errorf("unexpected EAP reply: %+v", eapRply)
+		}
+	}
+	if len(es.sessions) != 0 {
+		t.Errorf("unexpected sessions: %+v", es.sessions)
+	}
+}
+
+func TestEAPServerNakGTC(t *testing.T) {
+	es := testEAPMD5Server()
+	rply, err := es.HandleRequest(testEAPPeerRequest(
+		&EAPPacket{Code: EAPResponse, Identifier: 5, Type: EAPTypeIdentity, Data: []byte("cgrates")}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// refuse MD5, asking for GTC
+	rply, err = es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: 6, Type: EAPTypeNak, Data: []byte{EAPTypeGTC}}, rply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapReq, err := rply.EAPMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eapReq.Identifier != 7 || eapReq.Type != EAPTypeGTC || string(eapReq.Data) != "Password:" {
+		t.Fatalf("unexpected EAP request: %+v", eapReq)
+	}
+	// wrong Identifier
+	if wrongRply, err := es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: 6, Type: EAPTypeGTC, Data: []byte("cgratesToken")}, rply)); err != nil {
+		t.Error(err)
+	} else if wrongRply.Code != AccessReject {
+		t.Errorf("unexpected reply: %+v", wrongRply)
+	}
+	// session consumed by the previous request
+	if _, err := es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: 7, Type: EAPTypeGTC, Data: []byte("cgratesToken")}, rply)); err != ErrEAPSessionMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrEAPSessionMissing, err)
+	}
+}
+
+func TestEAPServerGTC(t *testing.T) {
+	es := NewEAPServer(0)
+	es.RegisterMethod(NewEAPGTC("Password:", func(identity string, response []byte) bool {
+		return string(response) == identity+"Token"
+	}))
+	rply, err := es.HandleRequest(testEAPPeerRequest(
+		&EAPPacket{Code: EAPResponse, Identifier: 0, Type: EAPTypeIdentity, Data: []byte("cgrates")}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply, err = es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: 1, Type: EAPTypeGTC, Data: []byte("cgratesToken")}, rply)); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("unexpected reply: %+v", rply)
+	}
+}
+
+func TestEAPServerHandleRequestErrors(t *testing.T) {
+	es := testEAPMD5Server()
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if _, err := es.HandleRequest(req); err != ErrEAPMessageMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrEAPMessageMissing, err)
+	}
+	req.SetEAPMessage(&EAPPacket{Code: EAPResponse, Identifier: 0, Type: EAPTypeIdentity, Data: []byte("cgrates")})
+	if rply, err := es.HandleRequest(req); err != nil || rply != nil { // silently discarded
+		t.Errorf("unexpected reply: %+v, error: %v", rply, err)
+	}
+	// conversation not starting with identity
+	if rply, err := es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: 1, Type: EAPTypeGTC, Data: []byte("cgratesToken")}, nil)); err != nil {
+		t.Error(err)
+	} else if rply.Code != AccessReject {
+		t.Errorf("unexpected reply: %+v", rply)
+	}
+}
+
+func TestEAPServerHandleRequestMethodError(t *testing.T) {
+	es := NewEAPServer(0)
+	es.RegisterMethod(NewEAPMD5(func(identity string) (string, error) {
+		return "", errors.New("unknown identity")
+	}))
+	rply, err := es.HandleRequest(testEAPPeerRequest(
+		&EAPPacket{Code: EAPResponse, Identifier: 0, Type: EAPTypeIdentity, Data: []byte("cgrates")}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapReq, err := rply.EAPMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply, err = es.HandleRequest(testEAPPeerRequest(&EAPPacket{Code: EAPResponse,
+		Identifier: eapReq.Identifier, Type: EAPTypeMD5, Data: make([]byte, 17)}, rply)); err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessReject || !rply.Has(MessageAuthenticatorNumber) {
+		t.Errorf("unexpected reply: %+v", rply)
+	}
+	if eapRply, err := rply.EAPMessage(); err != nil {
+		t.Error(err)
+	} else if eapRply.Code != EAPFailure {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", EAPFailure, eapRply.Code)
+	}
+}
+
+func TestEAPServerSessionTimeout(t *testing.T) {
+	es := NewEAPServer(-1)
+	state := es.storeSession(&EAPSession{Identity: "cgrates"})
+	if sess := es.popSession(state); sess != nil {
+		t.Errorf("unexpected session: %+v", sess)
+	}
+}
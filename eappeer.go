@@ -0,0 +1,402 @@
+package radigo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// eapPeerMaxRounds limits the Access-Challenge round trips of one authentication
+const eapPeerMaxRounds = 256
+
+var ErrEAPRejected = errors.New("EAP authentication rejected")
+
+// EAPTransport delivers the Access-Requests of the EAPPeer, implemented by Client
+type EAPTransport interface {
+	NewRequest(code PacketCode, id uint8) *Packet
+	SendRequest(req *Packet) (*Packet, error)
+}
+
+// EAPPeer authenticates over EAP, used mostly for testing the EAPServer
+type EAPPeer struct {
+	Method        uint8  // EAP method type to authenticate with, other ones are Nak-ed
+	Identity      string // outer identity
+	InnerIdentity string // identity inside the TLS tunnel, defaults to Identity
+	Password      string
+	TLSConfig     *tls.Config // for the TLS based methods
+	FragmentSize  int         // maximum of TLS data sent in one EAP packet, defaults to EAPTLSFragmentSize
+	SIMCard       EAPSIMCard  // for EAP-SIM, EAP-AKA and EAP-AKA'
+}
+
+// Authenticate runs the EAP conversation over the transport
+// returns the final reply and the MSK exported by the TLS based methods
+func (ep *EAPPeer) Authenticate(tr EAPTransport) (rply *Packet, msk []byte, err error) {
+	eapRply := &EAPPacket{Code: EAPResponse, Type: EAPTypeIdentity, Data: []byte(ep.Identity)}
+	var state []byte
+	st := &eapPeerState{}
+	defer st.close()
+	for i := 0; i < eapPeerMaxRounds; i++ {
+		req := tr.NewRequest(AccessRequest, uint8(i))
+		req.AVPs = append(req.AVPs, &AVP{Number: 1, RawValue: []byte(ep.Identity)}) // User-Name
+		if state != nil {
+			req.AVPs = append(req.AVPs, &AVP{Number: StateNumber, RawValue: state})
+		}
+		req.SetEAPMessage(eapRply)
+		req.AddMessageAuthenticator()
+		if rply, err = tr.SendRequest(req); err != nil {
+			return nil, nil, err
+		}
+		switch rply.Code {
+		case AccessAccept:
+			return rply, st.msk, nil
+		case AccessReject:
+			return rply, nil, ErrEAPRejected
+		case AccessChallenge:
+		default:
+			return rply, nil, fmt.Errorf("unexpected reply code: %s", rply.Code)
+		}
+		eapReq, err := rply.EAPMessage()
+		if err != nil {
+			return rply, nil, err
+		}
+		if eapReq.Code != EAPRequest {
+			return rply, nil, fmt.Errorf("unexpected EAP code: %d", eapReq.Code)
+		}
+		rply.RLock()
+		state = rply.rawAttribute(StateNumber)
+		rply.RUnlock()
+		eapRply = &EAPPacket{Code: EAPResponse, Identifier: eapReq.Identifier, Type: eapReq.Type}
+		switch eapReq.Type {
+		case EAPTypeIdentity:
+			eapRply.Data = []byte(ep.Identity)
+		case EAPTypeNotification:
+		case ep.Method:
+			if eapRply.Data, err = ep.process(st, eapReq); err != nil {
+				return rply, nil, err
+			}
+		default:
+			eapRply.Type, eapRply.Data = EAPTypeNak, []byte{ep.Method}
+		}
+	}
+	return rply, nil, errors.New("too many EAP rounds")
+}
+
+// eapPeerState is the progress of the EAPPeer inside the method
+type eapPeerState struct {
+	eng      *eapTLSEngine
+	frags    *eapTLSFragments
+	msk      []byte
+	sentAVPs bool   // EAP-TTLS credentials sent
+	authResp string // expected MS-CHAPv2 Authenticator Response
+	nonceMT  []byte // EAP-SIM
+	versions []byte // EAP-SIM Version List
+}
+
+func (st *eapPeerState) close() {
+	if st.eng != nil {
+		st.eng.Close()
+	}
+}
+
+// innerIdentity returns the identity used inside the TLS tunnel
+func (ep *EAPPeer) innerIdentity() string {
+	if ep.InnerIdentity != "" {
+		return ep.InnerIdentity
+	}
+	return ep.Identity
+}
+
+// process returns the Type-Data answering the request of the method
+func (ep *EAPPeer) process(st *eapPeerState, eapReq *EAPPacket) ([]byte, error) {
+	switch ep.Method {
+	case EAPTypeMD5: // Value-Size(1) + Value + Name
+		if len(eapReq.Data) < 1 || len(eapReq.Data) < 1+int(eapReq.Data[0]) {
+			return nil, errors.New("invalid EAP-MD5 challenge")
+		}
+		h := md5.New()
+		h.Write([]byte{eapReq.Identifier})
+		h.Write([]byte(ep.Password))
+		h.Write(eapReq.Data[1 : 1+eapReq.Data[0]])
+		return append([]byte{16}, h.Sum(nil)...), nil
+	case EAPTypeGTC:
+		return []byte(ep.Password), nil
+	case EAPTypeTLS, EAPTypePEAP, EAPTypeTTLS:
+		return ep.processTLS(st, eapReq.Data)
+	case EAPTypeSIM, EAPTypeAKA, EAPTypeAKAPrime:
+		return ep.processSIM(st, eapReq)
+	}
+	return nil, fmt.Errorf("unsupported EAP method: %d", ep.Method)
+}
+
+// processSIM answers the EAP-SIM, EAP-AKA and EAP-AKA' requests
+func (ep *EAPPeer) processSIM(st *eapPeerState, eapReq *EAPPacket) ([]byte, error) {
+	if ep.SIMCard == nil {
+		return nil, errors.New("missing SIM card")
+	}
+	subtype, attrs, err := parseEAPSIMData(eapReq.Data)
+	if err != nil {
+		return nil, err
+	}
+	var keys *eapSIMKeys
+	var extra []byte // signed after the response
+	rply := &EAPPacket{Code: EAPResponse, Identifier: eapReq.Identifier, Type: eapReq.Type}
+	switch subtype {
+	case simStart:
+		versions := eapSIMValue(attrs[atVersionList])
+		for i := 0; i+1 < len(versions); i += 2 {
+			if binary.BigEndian.Uint16(versions[i:]) == eapSIMVersion {
+				st.nonceMT, st.versions = randomNonce(), versions
+				return eapSIMData(simStart, eapSIMAttr{atNonceMT, withReserved(st.nonceMT)},
+					eapSIMAttr{atSelectedVersion, []byte{0, eapSIMVersion}}), nil
+			}
+		}
+		return eapSIMData(simClientError, eapSIMAttr{atClientErrorCode, []byte{0, 2}}), nil // unsupported version
+	case simChallenge:
+		rands := attrs[atRAND]
+		if st.nonceMT == nil || len(rands) < 34 || (len(rands)-2)%16 != 0 {
+			return nil, errors.New("invalid EAP-SIM challenge")
+		}
+		var kcs [][]byte
+		for rands = rands[2:]; len(rands) != 0; rands = rands[16:] {
+			sres, kc, err := ep.SIMCard.RunGSM([16]byte(rands[:16]))
+			if err != nil {
+				return eapSIMData(simClientError, eapSIMAttr{atClientErrorCode, []byte{0, 0}}), nil
+			}
+			extra = append(extra, sres[:]...)
+			kcs = append(kcs, kc[:])
+		}
+		keys = newEAPSIMKeys(simMasterKey(ep.Identity, kcs, st.nonceMT, st.versions, eapSIMVersion))
+		if !keys.verify(eapReq, st.nonceMT) {
+			return nil, errors.New("invalid AT_MAC")
+		}
+		rply.Data = eapSIMData(simChallenge, eapSIMAttr{atMAC, withReserved(make([]byte, 16))})
+	case akaChallenge:
+		rand, autn := attrs[atRAND], attrs[atAUTN]
+		if len(rand) != 18 || len(autn) != 18 {
+			return nil, errors.New("invalid EAP-AKA challenge")
+		}
+		res, ck, ik, err := ep.SIMCard.RunAKA([16]byte(rand[2:]), [16]byte(autn[2:]))
+		if err != nil {
+			return eapSIMData(akaAuthenticationReject), nil
+		}
+		if eapReq.Type == EAPTypeAKAPrime {
+			if kdf := attrs[atKDF]; len(kdf) != 2 || binary.BigEndian.Uint16(kdf) != akaPrimeKDF {
+				return nil, errors.New("unsupported EAP-AKA' KDF")
+			}
+			ckPrime, ikPrime := akaPrimeCKIK(ck[:], ik[:], autn[2:], string(eapSIMValue(attrs[atKDFInput])))
+			keys = newAKAPrimeKeys(ep.Identity, ckPrime, ikPrime)
+		} else {
+			keys = newEAPSIMKeys(akaMasterKey(ep.Identity, ck[:], ik[:]))
+		}
+		if !keys.verify(eapReq, nil) {
+			return nil, errors.New("invalid AT_MAC")
+		}
+		rply.Data = eapSIMData(akaChallenge,
+			eapSIMAttr{atRES, append(binary.BigEndian.AppendUint16(nil, uint16(len(res)*8)), res...)},
+			eapSIMAttr{atMAC, withReserved(make([]byte, 16))})
+	default:
+		return nil, fmt.Errorf("unsupported EAP-SIM subtype: %d", subtype)
+	}
+	if err = keys.sign(rply, extra); err != nil {
+		return nil, err
+	}
+	st.msk = keys.msk
+	return rply.Data, nil
+}
+
+// processTLS handles the TLS data of the server, reassembling and fragmenting it
+func (ep *EAPPeer) processTLS(st *eapPeerState, data []byte) ([]byte, error) {
+	if len(data) != 0 && data[0]&eapTLSStart != 0 {
+		st.close()
+		fragSize := ep.FragmentSize
+		if fragSize == 0 {
+			fragSize = EAPTLSFragmentSize
+		}
+		eng, out, err := newEAPTLSEngine(ep.TLSConfig, false)
+		if err != nil {
+			return nil, err
+		}
+		st.eng, st.frags = eng, &eapTLSFragments{fragSize: fragSize}
+		st.frags.queue(out)
+		return st.frags.next(), nil
+	}
+	if st.eng == nil {
+		return nil, errors.New("EAP-TLS data before Start")
+	}
+	more, err := st.frags.receive(data)
+	if err != nil {
+		return nil, err
+	}
+	if more {
+		return []byte{0}, nil
+	}
+	records := st.frags.records()
+	if len(records) == 0 {
+		if len(st.frags.out) == 0 {
+			return nil, errors.New("unexpected EAP-TLS acknowledgement")
+		}
+		return st.frags.next(), nil
+	}
+	out, appData, err := st.eng.feed(records)
+	if err != nil {
+		return nil, err
+	}
+	st.frags.queue(out)
+	if st.eng.hsDone {
+		if st.msk == nil {
+			if st.msk, err = st.eng.msk(ep.Method); err != nil {
+				return nil, err
+			}
+		}
+		if err = ep.tunnel(st, appData); err != nil {
+			return nil, err
+		}
+	}
+	if len(st.frags.out) == 0 {
+		return []byte{0}, nil // acknowledge the final TLS data
+	}
+	return st.frags.next(), nil
+}
+
+// tunnel answers the inner method of PEAP or EAP-TTLS
+func (ep *EAPPeer) tunnel(st *eapPeerState, appData []byte) error {
+	switch ep.Method {
+	case EAPTypeTTLS:
+		if st.sentAVPs {
+			return nil
+		}
+		st.sentAVPs = true
+		return ep.send(st, append(encodeDiameterAVP(1, []byte(ep.innerIdentity())),
+			encodeDiameterAVP(UserPasswordNumber, []byte(ep.Password))...))
+	case EAPTypePEAP:
+		if len(appData) == 0 {
+			return nil
+		}
+		if isTLV, success := isPEAPResultTLV(appData); isTLV {
+			return ep.send(st, peapResultTLV(EAPResponse, appData[1], success))
+		}
+		switch appData[0] {
+		case EAPTypeIdentity:
+			return ep.send(st, append([]byte{EAPTypeIdentity}, ep.innerIdentity()...))
+		case EAPTypeMSCHAPv2:
+			return ep.peapMSCHAPv2(st, appData)
+		}
+		return fmt.Errorf("unsupported PEAP inner type: %d", appData[0])
+	}
+	return nil
+}
+
+// peapMSCHAPv2 answers the EAP-MSCHAPv2 packet inside PEAP
+func (ep *EAPPeer) peapMSCHAPv2(st *eapPeerState, appData []byte) error {
+	if len(appData) < 5 {
+		return errors.New("invalid EAP-MSCHAPv2 packet")
+	}
+	opCode, msCHAPID := appData[1], appData[2]
+	switch opCode {
+	case msCHAPv2Challenge: // Value-Size(1) + Challenge(16) + Name
+		if len(appData) < 22 || appData[5] != 16 {
+			return errors.New("invalid EAP-MSCHAPv2 challenge")
+		}
+		chlng := appData[6:22]
+		passwordHash, err := NTPasswordHash(ep.Password)
+		if err != nil {
+			return err
+		}
+		peerChlng := make([]byte, 16)
+		rand.Read(peerChlng)
+		userName := ep.innerIdentity()
+		ntResponse := ChallengeResponse(ChallengeHash(peerChlng, chlng, userName), passwordHash)
+		st.authResp = generateAuthenticatorResponseWithHash(chlng, peerChlng, ntResponse, userName, passwordHash)
+		data := append([]byte{49}, peerChlng...)
+		data = append(data, make([]byte, 8)...) // Reserved
+		data = append(data, ntResponse...)
+		data = append(data, 0) // Flags
+		return ep.send(st, msCHAPv2Packet(msCHAPv2Response, msCHAPID, append(data, userName...)))
+	case msCHAPv2Success:
+		if !bytes.HasPrefix(appData[5:], []byte(st.authResp)) {
+			return errors.New("invalid MS-CHAPv2 Authenticator Response")
+		}
+		return ep.send(st, []byte{EAPTypeMSCHAPv2, msCHAPv2Success})
+	case msCHAPv2Failure:
+		return ep.send(st, []byte{EAPTypeMSCHAPv2, msCHAPv2Failure})
+	}
+	return fmt.Errorf("unsupported EAP-MSCHAPv2 OpCode: %d", opCode)
+}
+
+// send writes the application data through the tunnel
+func (ep *EAPPeer) send(st *eapPeerState, data []byte) error {
+	out, err := st.eng.write(data)
+	if err != nil {
+		return err
+	}
+	st.frags.queue(out)
+	return nil
+}
+
+// NewEAPLoopback returns the EAPTransport delivering the requests directly to the EAPServer
+// packets go through encoding and authentication as over the network
+func NewEAPLoopback(es *EAPServer, dict *Dictionary, secret string) EAPTransport {
+	return newLoopback(es.HandleRequest, dict, secret)
+}
+
+func newLoopback(hndlr func(*Packet) (*Packet, error), dict *Dictionary, secret string) *loopback {
+	return &loopback{hndlr: hndlr, dict: dict, coder: NewCoder(), secret: secret}
+}
+
+// loopback delivers the requests directly to a server handler
+type loopback struct {
+	hndlr  func(*Packet) (*Packet, error)
+	dict   *Dictionary
+	coder  Coder
+	secret string
+}
+
+// NewRequest produces new request with an random Authenticator
+func (l *loopback) NewRequest(code PacketCode, id uint8) *Packet {
+	req := NewPacket(code, id, l.dict, l.coder, l.secret)
+	rand.Read(req.Authenticator[:])
+	return req
+}
+
+// SendRequest passes the request to the handler and returns it's reply
+func (l *loopback) SendRequest(req *Packet) (*Packet, error) {
+	var buf [4096]byte
+	req.secret, req.dict = l.secret, l.dict
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMessageAuthenticator(buf[:n], l.secret, msgAuthAcator(buf[:n]), true); err != nil {
+		return nil, err
+	}
+	srvReq := &Packet{secret: l.secret, dict: l.dict, coder: l.coder}
+	if err = srvReq.Decode(buf[:n]); err != nil {
+		return nil, err
+	}
+	srvRply, err := l.hndlr(srvReq)
+	if err != nil {
+		srvRply = srvReq.NegativeReply(err.Error())
+	}
+	if srvRply == nil {
+		return nil, errors.New("empty reply received from handler")
+	}
+	if n, err = srvRply.Encode(buf[:]); err != nil {
+		return nil, err
+	}
+	rply := &Packet{secret: l.secret, dict: l.dict, coder: l.coder}
+	if err = rply.Decode(buf[:n]); err != nil {
+		return nil, err
+	}
+	if checkMessageAuthenticator(buf[:n], l.secret, req.Authenticator, false) != nil ||
+		!isAuthentic(buf[:n], l.secret, req.Authenticator) {
+		return nil, ErrReplyNotAuthentic
+	}
+	if err = rply.decryptAVPs(req.Authenticator); err != nil {
+		return nil, err
+	}
+	return rply, nil
+}
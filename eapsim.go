@@ -0,0 +1,606 @@
+package radigo
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// SIM based EAP method types
+	EAPTypeSIM      = 18 // rfc4186
+	EAPTypeAKA      = 23 // rfc4187
+	EAPTypeAKAPrime = 50 // rfc5448
+	// EAP-SIM and EAP-AKA Subtypes
+	akaChallenge            = 1
+	akaAuthenticationReject = 2
+	akaSynchronizationFail  = 4
+	simStart                = 10
+	simChallenge            = 11
+	simClientError          = 14
+	// EAP-SIM and EAP-AKA attributes, rfc4186 10
+	atRAND            = 1
+	atAUTN            = 2
+	atRES             = 3
+	atNonceMT         = 7
+	atMAC             = 11
+	atIdentity        = 14
+	atClientErrorCode = 22
+	atVersionList     = 15
+	atSelectedVersion = 16
+	atKDFInput        = 23
+	atKDF             = 24
+	// eapSIMVersion is the only EAP-SIM version defined
+	eapSIMVersion = 1
+	// akaPrimeKDF is the default key derivation function of EAP-AKA'
+	akaPrimeKDF = 1
+)
+
+// GSMTriplet is the authentication vector of EAP-SIM
+type GSMTriplet struct {
+	RAND [16]byte
+	SRES [4]byte
+	Kc   [8]byte
+}
+
+// AKAQuintuplet is the authentication vector of EAP-AKA and EAP-AKA'
+type AKAQuintuplet struct {
+	RAND [16]byte
+	AUTN [16]byte
+	XRES []byte // 4 to 16 bytes
+	CK   [16]byte
+	IK   [16]byte
+}
+
+// EAPVectorSource provides the authentication vectors of the identity, usually out of the HLR/HSS
+type EAPVectorSource interface {
+	GSMTriplets(identity string, n int) ([]*GSMTriplet, error)
+	AKAQuintuplet(identity string) (*AKAQuintuplet, error)
+}
+
+// EAPSIMCard computes the (U)SIM responses to the challenges, used by the EAPPeer
+type EAPSIMCard interface {
+	RunGSM(rand [16]byte) (sres [4]byte, kc [8]byte, err error)
+	RunAKA(rand, autn [16]byte) (res []byte, ck, ik [16]byte, err error)
+}
+
+// NewEAPStaticVectors returns an empty EAPStaticVectors
+func NewEAPStaticVectors() *EAPStaticVectors {
+	return &EAPStaticVectors{
+		triplets:    make(map[string][]*GSMTriplet),
+		quintuplets: make(map[string][]*AKAQuintuplet),
+		next:        make(map[string]int),
+	}
+}
+
+// NewEAPStaticVectorsFromFile loads the vectors out of the file at path
+func NewEAPStaticVectorsFromFile(path string) (*EAPStaticVectors, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sv := NewEAPStaticVectors()
+	if err = sv.ParseFromReader(f); err != nil {
+		return nil, err
+	}
+	return sv, nil
+}
+
+// EAPStaticVectors is an EAPVectorSource out of predefined vectors, rotated on each request
+// implements the EAPSIMCard as well, so both the server and the peer can use the same vectors in tests
+type EAPStaticVectors struct {
+	sync.Mutex
+	triplets    map[string][]*GSMTriplet
+	quintuplets map[string][]*AKAQuintuplet
+	next        map[string]int // index of the next vector for identity
+}
+
+// ParseFromReader loads the vectors in hex, one per line:
+// "identity RAND SRES Kc" for triplets and "identity RAND AUTN XRES CK IK" for quintuplets
+func (sv *EAPStaticVectors) ParseFromReader(rdr io.Reader) (err error) {
+	scanner := bufio.NewScanner(rdr)
+	for lnNr := 1; scanner.Scan(); lnNr++ {
+		flds := strings.Fields(scanner.Text())
+		if len(flds) == 0 || strings.HasPrefix(flds[0], "#") {
+			continue
+		}
+		vals := make([][]byte, len(flds)-1)
+		for i, fld := range flds[1:] {
+			if vals[i], err = hex.DecodeString(fld); err != nil {
+				return fmt.Errorf("vectors line: %d, <%s>", lnNr, err.Error())
+			}
+		}
+		switch {
+		case len(vals) == 3 && len(vals[0]) == 16 && len(vals[1]) == 4 && len(vals[2]) == 8:
+			t := new(GSMTriplet)
+			copy(t.RAND[:], vals[0])
+			copy(t.SRES[:], vals[1])
+			copy(t.Kc[:], vals[2])
+			sv.AddTriplet(flds[0], t)
+		case len(vals) == 5 && len(vals[0]) == 16 && len(vals[1]) == 16 &&
+			len(vals[2]) >= 4 && len(vals[2]) <= 16 && len(vals[3]) == 16 && len(vals[4]) == 16:
+			q := &AKAQuintuplet{XRES: vals[2]}
+			copy(q.RAND[:], vals[0])
+			copy(q.AUTN[:], vals[1])
+			copy(q.CK[:], vals[3])
+			copy(q.IK[:], vals[4])
+			sv.AddQuintuplet(flds[0], q)
+		default:
+			return fmt.Errorf("vectors line: %d, <invalid vector>", lnNr)
+		}
+	}
+	return scanner.Err()
+}
+
+// AddTriplet adds the GSM triplet of the identity
+func (sv *EAPStaticVectors) AddTriplet(identity string, t *GSMTriplet) {
+	sv.Lock()
+	sv.triplets[identity] = append(sv.triplets[identity], t)
+	sv.Unlock()
+}
+
+// AddQuintuplet adds the AKA quintuplet of the identity
+func (sv *EAPStaticVectors) AddQuintuplet(identity string, q *AKAQuintuplet) {
+	sv.Lock()
+	sv.quintuplets[identity] = append(sv.quintuplets[identity], q)
+	sv.Unlock()
+}
+
+// GSMTriplets implements EAPVectorSource
+func (sv *EAPStaticVectors) GSMTriplets(identity string, n int) ([]*GSMTriplet, error) {
+	sv.Lock()
+	defer sv.Unlock()
+	ts := sv.triplets[identity]
+	if len(ts) < n {
+		return nil, fmt.Errorf("not enough GSM triplets for identity: <%s>", identity)
+	}
+	idx := sv.next[identity]
+	rply := make([]*GSMTriplet, n)
+	for i := range rply {
+		rply[i] = ts[(idx+i)%len(ts)]
+	}
+	sv.next[identity] = (idx + n) % len(ts)
+	return rply, nil
+}
+
+// AKAQuintuplet implements EAPVectorSource
+func (sv *EAPStaticVectors) AKAQuintuplet(identity string) (*AKAQuintuplet, error) {
+	sv.Lock()
+	defer sv.Unlock()
+	qs := sv.quintuplets[identity]
+	if len(qs) == 0 {
+		return nil, fmt.Errorf("no AKA quintuplet for identity: <%s>", identity)
+	}
+	idx := sv.next[identity] % len(qs)
+	sv.next[identity] = idx + 1
+	return qs[idx], nil
+}
+
+// RunGSM implements EAPSIMCard, looking up the triplet with RAND
+func (sv *EAPStaticVectors) RunGSM(rand [16]byte) (sres [4]byte, kc [8]byte, err error) {
+	sv.Lock()
+	defer sv.Unlock()
+	for _, ts := range sv.triplets {
+		for _, t := range ts {
+			if t.RAND == rand {
+				return t.SRES, t.Kc, nil
+			}
+		}
+	}
+	return sres, kc, errors.New("unknown RAND")
+}
+
+// RunAKA implements EAPSIMCard, looking up the quintuplet with RAND and checking the AUTN
+func (sv *EAPStaticVectors) RunAKA(rand, autn [16]byte) (res []byte, ck, ik [16]byte, err error) {
+	sv.Lock()
+	defer sv.Unlock()
+	for _, qs := range sv.quintuplets {
+		for _, q := range qs {
+			if q.RAND != rand {
+				continue
+			}
+			if q.AUTN != autn {
+				return nil, ck, ik, errors.New("AUTN mismatch")
+			}
+			return q.XRES, q.CK, q.IK, nil
+		}
+	}
+	return nil, ck, ik, errors.New("unknown RAND")
+}
+
+// sha1Compress is the SHA-1 compression function over one zero padded block, without the message padding
+// used as the G function of the FIPS 186-2 PRF
+func sha1Compress(xval []byte) []byte {
+	var w [80]uint32
+	var block [64]byte
+	copy(block[:], xval)
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(block[i*4:])
+	}
+	for i := 16; i < 80; i++ {
+		w[i] = bits.RotateLeft32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+	}
+	h := [5]uint32{0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0}
+	a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+	for i := 0; i < 80; i++ {
+		var f, k uint32
+		switch {
+		case i < 20:
+			f, k = (b&c)|(^b&d), 0x5A827999
+		case i < 40:
+			f, k = b^c^d, 0x6ED9EBA1
+		case i < 60:
+			f, k = (b&c)|(b&d)|(c&d), 0x8F1BBCDC
+		default:
+			f, k = b^c^d, 0xCA62C1D6
+		}
+		a, b, c, d, e = bits.RotateLeft32(a, 5)+f+e+k+w[i], a, bits.RotateLeft32(b, 30), c, d
+	}
+	out := make([]byte, 20)
+	for i, v := range [5]uint32{h[0] + a, h[1] + b, h[2] + c, h[3] + d, h[4] + e} {
+		binary.BigEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+// fips186PRF expands the Master Key based on FIPS 186-2 change notice 1, without the mod q step, rfc4186 Appendix B
+func fips186PRF(mk []byte, length int) []byte {
+	xkey := make([]byte, 20)
+	copy(xkey, mk)
+	var out []byte
+	for len(out) < length {
+		w := sha1Compress(xkey) // XSEED is 0
+		out = append(out, w...)
+		carry := uint16(1) // XKEY = (1 + XKEY + w) mod 2^160
+		for i := 19; i >= 0; i-- {
+			carry += uint16(xkey[i]) + uint16(w[i])
+			xkey[i] = byte(carry)
+			carry >>= 8
+		}
+	}
+	return out[:length]
+}
+
+// akaPrimePRF is the PRF' of EAP-AKA' based on HMAC-SHA-256, rfc5448 3.4
+func akaPrimePRF(key, s []byte, length int) []byte {
+	var out, t []byte
+	for i := 1; len(out) < length; i++ {
+		h := hmac.New(sha256.New, key)
+		h.Write(t)
+		h.Write(s)
+		h.Write([]byte{byte(i)})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// akaPrimeCKIK derives CK' and IK' out of CK and IK, rfc5448 3.3
+// autn carries SQN xor AK in the first 6 bytes
+func akaPrimeCKIK(ck, ik, autn []byte, networkName string) (ckPrime, ikPrime []byte) {
+	s := []byte{0x20}
+	s = append(s, networkName...)
+	s = binary.BigEndian.AppendUint16(s, uint16(len(networkName)))
+	s = append(s, autn[:6]...)
+	s = append(s, 0x00, 0x06)
+	h := hmac.New(sha256.New, append(append([]byte{}, ck...), ik...))
+	h.Write(s)
+	k := h.Sum(nil)
+	return k[:16], k[16:]
+}
+
+// eapSIMKeys is the keying material of EAP-SIM, EAP-AKA and EAP-AKA'
+type eapSIMKeys struct {
+	kEncr []byte
+	kAut  []byte
+	msk   []byte
+	emsk  []byte
+	prime bool // AKA', MAC with HMAC-SHA-256
+}
+
+// newEAPSIMKeys derives the keys out of the Master Key with the FIPS 186-2 PRF, rfc4186 7
+func newEAPSIMKeys(mk []byte) *eapSIMKeys {
+	k := fips186PRF(mk, 160)
+	return &eapSIMKeys{kEncr: k[:16], kAut: k[16:32], msk: k[32:96], emsk: k[96:160]}
+}
+
+// simMasterKey computes the EAP-SIM Master Key, rfc4186 7
+// MK = SHA1(Identity|n*Kc| NONCE_MT| Version List| Selected Version)
+func simMasterKey(identity string, kcs [][]byte, nonceMT, versionList []byte, selectedVersion uint16) []byte {
+	h := sha1.New()
+	h.Write([]byte(identity))
+	for _, kc := range kcs {
+		h.Write(kc)
+	}
+	h.Write(nonceMT)
+	h.Write(versionList)
+	h.Write(binary.BigEndian.AppendUint16(nil, selectedVersion))
+	return h.Sum(nil)
+}
+
+// akaMasterKey computes the EAP-AKA Master Key, rfc4187 7
+// MK = SHA1(Identity|IK|CK)
+func akaMasterKey(identity string, ck, ik []byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(identity))
+	h.Write(ik)
+	h.Write(ck)
+	return h.Sum(nil)
+}
+
+// newAKAPrimeKeys derives the EAP-AKA' keys with PRF', rfc5448 3.3
+func newAKAPrimeKeys(identity string, ckPrime, ikPrime []byte) *eapSIMKeys {
+	k := akaPrimePRF(append(append([]byte{}, ikPrime...), ckPrime...),
+		append([]byte("EAP-AKA'"), identity...), 208)
+	return &eapSIMKeys{kEncr: k[:16], kAut: k[16:48], msk: k[80:144], emsk: k[144:208], prime: true}
+}
+
+// mac computes the AT_MAC value over the EAP packet followed by extra data
+func (k *eapSIMKeys) mac(eapPkt, extra []byte) []byte {
+	hashFunc := sha1.New
+	if k.prime {
+		hashFunc = sha256.New
+	}
+	h := hmac.New(hashFunc, k.kAut)
+	h.Write(eapPkt)
+	h.Write(extra)
+	return h.Sum(nil)[:16]
+}
+
+// sign fills the AT_MAC of the EAP packet, computed over the packet followed by extra data, rfc4186 10.14
+func (k *eapSIMKeys) sign(eap *EAPPacket, extra []byte) error {
+	_, attrs, err := parseEAPSIMData(eap.Data)
+	if err != nil {
+		return err
+	}
+	mac := attrs[atMAC]
+	if len(mac) != 18 {
+		return errors.New("missing AT_MAC")
+	}
+	copy(mac[2:], make([]byte, 16))
+	copy(mac[2:], k.mac(eap.Encode(), extra))
+	return nil
+}
+
+// verify checks the AT_MAC of the EAP packet
+func (k *eapSIMKeys) verify(eap *EAPPacket, extra []byte) bool {
+	signed := &EAPPacket{Code: eap.Code, Identifier: eap.Identifier, Type: eap.Type,
+		Data: append([]byte{}, eap.Data...)}
+	_, attrs, err := parseEAPSIMData(signed.Data)
+	if err != nil || len(attrs[atMAC]) != 18 {
+		return false
+	}
+	mac := append([]byte{}, attrs[atMAC][2:]...)
+	copy(attrs[atMAC][2:], make([]byte, 16))
+	return hmac.Equal(mac, k.mac(signed.Encode(), extra))
+}
+
+// eapSIMAttr is an attribute of EAP-SIM and EAP-AKA, val includes the reserved or length bytes
+type eapSIMAttr struct {
+	typ uint8
+	val []byte
+}
+
+// eapSIMData builds the Type-Data: Subtype(1) + Reserved(2) + Attributes padded to 4 bytes
+func eapSIMData(subtype uint8, attrs ...eapSIMAttr) []byte {
+	data := []byte{subtype, 0, 0}
+	for _, attr := range attrs {
+		length := (2 + len(attr.val) + 3) / 4
+		b := make([]byte, length*4)
+		b[0], b[1] = attr.typ, uint8(length)
+		copy(b[2:], attr.val)
+		data = append(data, b...)
+	}
+	return data
+}
+
+// parseEAPSIMData returns the Subtype and the attribute values, referencing data
+func parseEAPSIMData(data []byte) (subtype uint8, attrs map[uint8][]byte, err error) {
+	if len(data) < 3 {
+		return 0, nil, errors.New("EAP-SIM data too short")
+	}
+	subtype, attrs = data[0], make(map[uint8][]byte)
+	for b := data[3:]; len(b) != 0; {
+		if len(b) < 4 || b[1] == 0 || int(b[1])*4 > len(b) {
+			return 0, nil, errors.New("invalid EAP-SIM attribute length")
+		}
+		length := int(b[1]) * 4
+		attrs[b[0]] = b[2:length]
+		b = b[length:]
+	}
+	return
+}
+
+// eapSIMValue returns the value of the attributes carrying the actual length in the first 2 bytes
+func eapSIMValue(val []byte) []byte {
+	if len(val) < 2 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(val[:2]))
+	if length > len(val)-2 {
+		return nil
+	}
+	return val[2 : 2+length]
+}
+
+// akaRES returns the RES out of the AT_RES value, carrying it's length in bits, rfc4187 10.8
+func akaRES(val []byte) []byte {
+	if len(val) < 2 {
+		return nil
+	}
+	bitLen := int(binary.BigEndian.Uint16(val[:2]))
+	if bitLen%8 != 0 || bitLen/8 > len(val)-2 {
+		return nil
+	}
+	return val[2 : 2+bitLen/8]
+}
+
+// withLength prefixes the value with it's actual length
+func withLength(val []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(val))), val...)
+}
+
+// withReserved prefixes the value with the 2 reserved bytes
+func withReserved(val ...[]byte) []byte {
+	b := []byte{0, 0}
+	for _, v := range val {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// eapSIMSession is the EAPSession data of EAP-SIM, EAP-AKA and EAP-AKA'
+type eapSIMSession struct {
+	keys    *eapSIMKeys
+	nonceMT []byte
+	sres    []byte // n*SRES, signed by the peer in the EAP-SIM Challenge response
+	xres    []byte
+}
+
+// NewEAPSIM instantiates the EAP-SIM method, rfc4186
+func NewEAPSIM(vectors EAPVectorSource) *EAPSIMMethod {
+	return &EAPSIMMethod{typ: EAPTypeSIM, vectors: vectors}
+}
+
+// NewEAPAKA instantiates the EAP-AKA method, rfc4187
+func NewEAPAKA(vectors EAPVectorSource) *EAPSIMMethod {
+	return &EAPSIMMethod{typ: EAPTypeAKA, vectors: vectors}
+}
+
+// NewEAPAKAPrime instantiates the EAP-AKA' method, rfc5448
+// networkName is the access network identity sent in AT_KDF_INPUT (eg: "WLAN")
+func NewEAPAKAPrime(vectors EAPVectorSource, networkName string) *EAPSIMMethod {
+	return &EAPSIMMethod{typ: EAPTypeAKAPrime, vectors: vectors, networkName: networkName}
+}
+
+// EAPSIMMethod implements the full authentication of EAP-SIM, EAP-AKA and EAP-AKA'
+// the identity is the one out of EAP-Response/Identity, pseudonyms and fast re-authentication are not supported
+type EAPSIMMethod struct {
+	typ         uint8
+	vectors     EAPVectorSource
+	networkName string
+}
+
+func (m *EAPSIMMethod) Type() uint8 {
+	return m.typ
+}
+
+// Start sends the EAP-SIM/Start or the EAP-AKA/Challenge
+func (m *EAPSIMMethod) Start(sess *EAPSession) ([]byte, error) {
+	if m.typ == EAPTypeSIM {
+		sess.Data = new(eapSIMSession)
+		return eapSIMData(simStart,
+			eapSIMAttr{atVersionList, withLength([]byte{0, eapSIMVersion})}), nil
+	}
+	q, err := m.vectors.AKAQuintuplet(sess.Identity)
+	if err != nil {
+		return nil, err
+	}
+	st := &eapSIMSession{xres: q.XRES}
+	attrs := []eapSIMAttr{{atRAND, withReserved(q.RAND[:])}, {atAUTN, withReserved(q.AUTN[:])}}
+	if m.typ == EAPTypeAKAPrime {
+		ckPrime, ikPrime := akaPrimeCKIK(q.CK[:], q.IK[:], q.AUTN[:], m.networkName)
+		st.keys = newAKAPrimeKeys(sess.Identity, ckPrime, ikPrime)
+		attrs = append(attrs, eapSIMAttr{atKDFInput, withLength([]byte(m.networkName))},
+			eapSIMAttr{atKDF, []byte{0, akaPrimeKDF}})
+	} else {
+		st.keys = newEAPSIMKeys(akaMasterKey(sess.Identity, q.CK[:], q.IK[:]))
+	}
+	sess.Data = st
+	eap := &EAPPacket{Code: EAPRequest, Identifier: sess.ID, Type: m.typ,
+		Data: eapSIMData(akaChallenge, append(attrs, eapSIMAttr{atMAC, withReserved(make([]byte, 16))})...)}
+	if err = st.keys.sign(eap, nil); err != nil {
+		return nil, err
+	}
+	return eap.Data, nil
+}
+
+// Process handles the responses of the peer
+func (m *EAPSIMMethod) Process(sess *EAPSession, data []byte) ([]byte, EAPStatus, error) {
+	st, canCast := sess.Data.(*eapSIMSession)
+	if !canCast {
+		return nil, EAPFailed, errors.New("missing EAP-SIM session")
+	}
+	subtype, attrs, err := parseEAPSIMData(data)
+	if err != nil {
+		return nil, EAPFailed, err
+	}
+	eap := &EAPPacket{Code: EAPResponse, Identifier: sess.ID, Type: m.typ, Data: data}
+	switch {
+	case m.typ == EAPTypeSIM && subtype == simStart && st.keys == nil:
+		return m.simChallenge(sess, st, attrs)
+	case m.typ == EAPTypeSIM && subtype == simChallenge && st.keys != nil:
+		if !st.keys.verify(eap, st.sres) {
+			return nil, EAPFailed, nil
+		}
+	case m.typ != EAPTypeSIM && subtype == akaChallenge:
+		if !st.keys.verify(eap, nil) || subtle.ConstantTimeCompare(akaRES(attrs[atRES]), st.xres) != 1 {
+			return nil, EAPFailed, nil
+		}
+	default: // Client-Error, Authentication-Reject or Synchronization-Failure
+		return nil, EAPFailed, nil
+	}
+	sess.MSK = st.keys.msk
+	return nil, EAPSucceeded, nil
+}
+
+// simChallenge answers the EAP-SIM/Start with the EAP-SIM/Challenge out of 3 triplets
+func (m *EAPSIMMethod) simChallenge(sess *EAPSession, st *eapSIMSession,
+	attrs map[uint8][]byte) ([]byte, EAPStatus, error) {
+	if nonceMT := attrs[atNonceMT]; len(nonceMT) != 18 {
+		return nil, EAPFailed, nil
+	} else {
+		st.nonceMT = append([]byte{}, nonceMT[2:]...)
+	}
+	if version := attrs[atSelectedVersion]; len(version) != 2 ||
+		binary.BigEndian.Uint16(version) != eapSIMVersion {
+		return nil, EAPFailed, nil
+	}
+	if identity := eapSIMValue(attrs[atIdentity]); identity != nil {
+		sess.Identity = string(identity)
+	}
+	ts, err := m.vectors.GSMTriplets(sess.Identity, 3)
+	if err != nil {
+		return nil, EAPFailed, err
+	}
+	var rands, kcs [][]byte
+	for i, t := range ts {
+		for _, prev := range ts[:i] {
+			if prev.RAND == t.RAND { // rfc4186 10.9
+				return nil, EAPFailed, errors.New("duplicate RAND in GSM triplets")
+			}
+		}
+		rands = append(rands, t.RAND[:])
+		kcs = append(kcs, t.Kc[:])
+		st.sres = append(st.sres, t.SRES[:]...)
+	}
+	st.keys = newEAPSIMKeys(simMasterKey(sess.Identity, kcs, st.nonceMT,
+		[]byte{0, eapSIMVersion}, eapSIMVersion))
+	eap := &EAPPacket{Code: EAPRequest, Identifier: sess.ID + 1, Type: m.typ,
+		Data: eapSIMData(simChallenge, eapSIMAttr{atRAND, withReserved(rands...)},
+			eapSIMAttr{atMAC, withReserved(make([]byte, 16))})}
+	if err = st.keys.sign(eap, st.nonceMT); err != nil {
+		return nil, EAPFailed, err
+	}
+	return eap.Data, EAPContinue, nil
+}
+
+// randomNonce returns 16 random bytes
+func randomNonce() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
@@ -0,0 +1,205 @@
+package radigo
+
+import (
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testEAPSIMVectors = `# identity RAND SRES Kc
+1244070100000001@eapsim.foo 101112131415161718191a1b1c1d1e1f d1d2d3d4 a0a1a2a3a4a5a6a7
+1244070100000001@eapsim.foo 202122232425262728292a2b2c2d2e2f e1e2e3e4 b0b1b2b3b4b5b6b7
+1244070100000001@eapsim.foo 303132333435363738393a3b3c3d3e3f f1f2f3f4 c0c1c2c3c4c5c6c7
+
+# identity RAND AUTN XRES CK IK
+0555444333222111 81e92b6c0ee0e12ebceba8d92a99dfa5 bb52e91c747ac3ab2a5c23d15ee351d5 28d7b0f2a2ec3de5 5349fbe098649f948f5d2e973a81c00f 9744871ad32bf9bbd1dd5ce54e3e2e5a
+6555444333222111 81e92b6c0ee0e12ebceba8d92a99dfa5 bb52e91c747ac3ab2a5c23d15ee351d5 28d7b0f2a2ec3de5 5349fbe098649f948f5d2e973a81c00f 9744871ad32bf9bbd1dd5ce54e3e2e5a
+`
+
+func testHex(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+func testEAPSIMStaticVectors(t *testing.T) *EAPStaticVectors {
+	sv := NewEAPStaticVectors()
+	if err := sv.ParseFromReader(strings.NewReader(testEAPSIMVectors)); err != nil {
+		t.Fatal(err)
+	}
+	return sv
+}
+
+func TestEAPSIMKeys(t *testing.T) { // rfc4186 Appendix A
+	mk := simMasterKey("1244070100000001@eapsim.foo",
+		[][]byte{testHex("a0a1a2a3a4a5a6a7"), testHex("b0b1b2b3b4b5b6b7"), testHex("c0c1c2c3c4c5c6c7")},
+		testHex("0123456789abcdeffedcba9876543210"), []byte{0, 1}, 1)
+	if exp := testHex("e576d5ca332e9930018bf1baee2763c795b3c712"); !reflect.DeepEqual(exp, mk) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, mk)
+	}
+	keys := newEAPSIMKeys(mk)
+	if exp := testHex("536e5ebc4465582aa6a8ec9986ebb620"); !reflect.DeepEqual(exp, keys.kEncr) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, keys.kEncr)
+	}
+	if exp := testHex("25af1942efcbf4bc72b3943421f2a974"); !reflect.DeepEqual(exp, keys.kAut) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, keys.kAut)
+	}
+	if exp := testHex("39d45aeaf4e30601983e972b6cfd46d1c363773365690d09cd44976b525f47d3"); !reflect.DeepEqual(exp, keys.msk[:len(exp)]) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, keys.msk)
+	}
+}
+
+func TestEAPAKAPrimeKeys(t *testing.T) { // rfc5448 Appendix C, case 1
+	ckPrime, ikPrime := akaPrimeCKIK(testHex("5349fbe098649f948f5d2e973a81c00f"),
+		testHex("9744871ad32bf9bbd1dd5ce54e3e2e5a"), testHex("bb52e91c747ac3ab2a5c23d15ee351d5"), "WLAN")
+	if exp := testHex("0093962d0dd84aa5684b045c9edffa04"); !reflect.DeepEqual(exp, ckPrime) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, ckPrime)
+	}
+	if exp := testHex("ccfc230ca74fcc96c0a5d61164f5a76c"); !reflect.DeepEqual(exp, ikPrime) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, ikPrime)
+	}
+	keys := newAKAPrimeKeys("0555444333222111", ckPrime, ikPrime)
+	if exp := testHex("766fa0a6c317174b812d52fbcd11a179"); !reflect.DeepEqual(exp, keys.kEncr) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, keys.kEncr)
+	}
+	if exp := testHex("0842ea722ff6835bfa2032499fc3ec23c2f0e388b4f07543ffc677f1696d71ea"); !reflect.DeepEqual(exp, keys.kAut) {
+		t.Errorf("Expected: <%x>, \nReceived: <%x>", exp, keys.kAut)
+	}
+}
+
+func TestEAPStaticVectors(t *testing.T) {
+	sv := testEAPSIMStaticVectors(t)
+	ts, err := sv.GSMTriplets("1244070100000001@eapsim.foo", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := [4]byte{0xd1, 0xd2, 0xd3, 0xd4}; ts[0].SRES != exp {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, ts[0].SRES)
+	}
+	if ts, err = sv.GSMTriplets("1244070100000001@eapsim.foo", 2); err != nil { // rotated
+		t.Fatal(err)
+	} else if exp := [4]byte{0xf1, 0xf2, 0xf3, 0xf4}; ts[0].SRES != exp {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, ts[0].SRES)
+	}
+	if _, err = sv.GSMTriplets("1244070100000001@eapsim.foo", 4); err == nil {
+		t.Error("expecting error for not enough triplets")
+	}
+	q, err := sv.AKAQuintuplet("0555444333222111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := testHex("28d7b0f2a2ec3de5"); !reflect.DeepEqual(exp, q.XRES) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, q.XRES)
+	}
+	if _, err = sv.AKAQuintuplet("unknown"); err == nil {
+		t.Error("expecting error for unknown identity")
+	}
+	if res, _, _, err := sv.RunAKA(q.RAND, q.AUTN); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(q.XRES, res) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", q.XRES, res)
+	}
+	if _, _, _, err = sv.RunAKA(q.RAND, [16]byte{}); err == nil {
+		t.Error("expecting error for AUTN mismatch")
+	}
+	if err = NewEAPStaticVectors().ParseFromReader(strings.NewReader("flopsy 0102 0304\n")); err == nil {
+		t.Error("expecting error for invalid vector")
+	}
+	if err = NewEAPStaticVectors().ParseFromReader(strings.NewReader("flopsy zz\n")); err == nil {
+		t.Error("expecting error for invalid hex")
+	}
+}
+
+// testEAPSIMAuthenticate runs the peer against the method over the loopback
+func testEAPSIMAuthenticate(m EAPMethod, ep *EAPPeer) (*Packet, []byte, error) {
+	es := NewEAPServer(0)
+	es.RegisterMethod(m)
+	return ep.Authenticate(NewEAPLoopback(es, RFC2865Dictionary(), "CGRateS.org"))
+}
+
+func TestEAPSIM(t *testing.T) {
+	sv := testEAPSIMStaticVectors(t)
+	ep := &EAPPeer{Method: EAPTypeSIM, Identity: "1244070100000001@eapsim.foo", SIMCard: sv}
+	rply, msk, err := testEAPSIMAuthenticate(NewEAPSIM(sv), ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+	card := NewEAPStaticVectors() // SIM with different secret
+	card.AddTriplet("", &GSMTriplet{RAND: [16]byte(testHex("101112131415161718191a1b1c1d1e1f"))})
+	card.AddTriplet("", &GSMTriplet{RAND: [16]byte(testHex("202122232425262728292a2b2c2d2e2f"))})
+	card.AddTriplet("", &GSMTriplet{RAND: [16]byte(testHex("303132333435363738393a3b3c3d3e3f"))})
+	ep.SIMCard = card
+	if _, _, err = testEAPSIMAuthenticate(NewEAPSIM(sv), ep); err == nil { // server MAC fails on peer
+		t.Error("expecting error for invalid AT_MAC")
+	}
+	ep.Identity, ep.SIMCard = "unknown", sv
+	if _, _, err = testEAPSIMAuthenticate(NewEAPSIM(sv), ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+}
+
+func TestEAPAKA(t *testing.T) {
+	sv := testEAPSIMStaticVectors(t)
+	ep := &EAPPeer{Method: EAPTypeAKA, Identity: "0555444333222111", SIMCard: sv}
+	rply, msk, err := testEAPSIMAuthenticate(NewEAPAKA(sv), ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+	card := NewEAPStaticVectors() // USIM answering with a different RES
+	q, _ := sv.AKAQuintuplet("0555444333222111")
+	card.AddQuintuplet("", &AKAQuintuplet{RAND: q.RAND, AUTN: q.AUTN, XRES: []byte{1, 2, 3, 4}, CK: q.CK, IK: q.IK})
+	ep.SIMCard = card
+	if _, _, err = testEAPSIMAuthenticate(NewEAPAKA(sv), ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+	ep.SIMCard = NewEAPStaticVectors() // AUTN not accepted by the USIM
+	if _, _, err = testEAPSIMAuthenticate(NewEAPAKA(sv), ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+}
+
+func TestEAPAKAPrime(t *testing.T) {
+	sv := testEAPSIMStaticVectors(t)
+	ep := &EAPPeer{Method: EAPTypeAKAPrime, Identity: "6555444333222111", SIMCard: sv}
+	rply, msk, err := testEAPSIMAuthenticate(NewEAPAKAPrime(sv, "WLAN"), ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+}
+
+func TestEAPSIMData(t *testing.T) {
+	data := eapSIMData(akaChallenge, eapSIMAttr{atRES, []byte{0, 32, 1, 2, 3, 4}},
+		eapSIMAttr{atKDFInput, withLength([]byte("WLAN"))})
+	exp := []byte{akaChallenge, 0, 0, atRES, 2, 0, 32, 1, 2, 3, 4, atKDFInput, 2, 0, 4, 'W', 'L', 'A', 'N'}
+	if !reflect.DeepEqual(exp, data) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, data)
+	}
+	subtype, attrs, err := parseEAPSIMData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subtype != akaChallenge {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", akaChallenge, subtype)
+	}
+	if res := akaRES(attrs[atRES]); !reflect.DeepEqual([]byte{1, 2, 3, 4}, res) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", []byte{1, 2, 3, 4}, res)
+	}
+	if name := eapSIMValue(attrs[atKDFInput]); string(name) != "WLAN" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "WLAN", string(name))
+	}
+	if _, _, err = parseEAPSIMData(data[:len(data)-1]); err == nil {
+		t.Error("expecting error for invalid attribute length")
+	}
+}
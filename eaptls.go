@@ -0,0 +1,582 @@
+package radigo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TLS based EAP method types
+	EAPTypeTLS        = 13 // rfc5216
+	EAPTypeTTLS       = 21 // rfc5281
+	EAPTypePEAP       = 25 // draft-kamath-pppext-peapv0
+	EAPTypeMSCHAPv2   = 26 // draft-kamath-pppext-eap-mschapv2
+	EAPTypeExtensions = 33 // PEAP Result TLV
+	// EAPTLSFragmentSize is the default maximum of TLS data carried in one EAP packet
+	EAPTLSFragmentSize = 1024
+	// EAP-TLS flags, rfc5216 3.1
+	eapTLSLengthIncluded = 0x80
+	eapTLSMoreFragments  = 0x40
+	eapTLSStart          = 0x20
+	eapTLSMaxMessage     = 65536 // limit for the reassembled TLS messages
+	// MSCHAPv2 OpCodes inside PEAP
+	msCHAPv2Challenge = 1
+	msCHAPv2Response  = 2
+	msCHAPv2Success   = 3
+	msCHAPv2Failure   = 4
+)
+
+// eapTLSKeyLabel returns the label used to export the MSK out of TLS keying material
+func eapTLSKeyLabel(typ uint8) string {
+	if typ == EAPTypeTTLS {
+		return "ttls keying material" // rfc5281 8
+	}
+	return "client EAP encryption" // rfc5216 2.3
+}
+
+// eapTLSAddr is the address of the TLS connections carried over EAP
+type eapTLSAddr struct{}
+
+func (eapTLSAddr) Network() string { return "eap" }
+func (eapTLSAddr) String() string  { return "eap" }
+
+// eapTLSTransport is the net.Conn under the TLS connection carried over EAP
+// Read blocks until the records out of the next EAP message are fed
+type eapTLSTransport struct {
+	sync.Mutex
+	in        chan []byte   // records received from the peer
+	idle      chan struct{} // signals the TLS side waiting for records
+	closed    chan struct{}
+	closeOnce sync.Once
+	inBuf     []byte
+	out       []byte // records to be sent to the peer
+}
+
+func (t *eapTLSTransport) Read(b []byte) (int, error) {
+	if len(t.inBuf) == 0 {
+		select {
+		case t.idle <- struct{}{}:
+		case <-t.closed:
+			return 0, io.EOF
+		}
+		select {
+		case t.inBuf = <-t.in:
+		case <-t.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, t.inBuf)
+	t.inBuf = t.inBuf[n:]
+	return n, nil
+}
+
+func (t *eapTLSTransport) Write(b []byte) (int, error) {
+	t.Lock()
+	t.out = append(t.out, b...)
+	t.Unlock()
+	return len(b), nil
+}
+
+func (t *eapTLSTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closed) })
+	return nil
+}
+
+func (t *eapTLSTransport) LocalAddr() net.Addr              { return eapTLSAddr{} }
+func (t *eapTLSTransport) RemoteAddr() net.Addr             { return eapTLSAddr{} }
+func (t *eapTLSTransport) SetDeadline(time.Time) error      { return nil }
+func (t *eapTLSTransport) SetReadDeadline(time.Time) error  { return nil }
+func (t *eapTLSTransport) SetWriteDeadline(time.Time) error { return nil }
+func (t *eapTLSTransport) takeOut() (out []byte) {
+	t.Lock()
+	out, t.out = t.out, nil
+	t.Unlock()
+	return
+}
+
+// newEAPTLSEngine starts the TLS side of the EAP conversation
+// returns the first records to be sent (ClientHello for the peer)
+func newEAPTLSEngine(tlsCfg *tls.Config, isServer bool) (*eapTLSEngine, []byte, error) {
+	if tlsCfg == nil {
+		return nil, nil, errNoTLSConfig
+	}
+	cfg := tlsCfg.Clone()
+	cfg.MaxVersion = tls.VersionTLS12 // key derivation for TLS 1.3 (rfc9190) not supported
+	e := &eapTLSEngine{
+		tr: &eapTLSTransport{in: make(chan []byte), idle: make(chan struct{}),
+			closed: make(chan struct{})},
+		done: make(chan struct{}),
+	}
+	if isServer {
+		e.conn = tls.Server(e.tr, cfg)
+	} else {
+		e.conn = tls.Client(e.tr, cfg)
+	}
+	go e.run()
+	out, _, err := e.wait()
+	if err != nil {
+		e.Close()
+		return nil, nil, err
+	}
+	return e, out, nil
+}
+
+// eapTLSEngine drives the TLS connection carried over EAP
+type eapTLSEngine struct {
+	tr      *eapTLSTransport
+	conn    *tls.Conn
+	done    chan struct{} // closed when the TLS side exits
+	err     error         // reason of exiting
+	hsDone  bool          // handshake completed, set before the TLS side waits for records
+	state   tls.ConnectionState
+	appMux  sync.Mutex
+	appData []byte // application data received through the tunnel
+}
+
+func (e *eapTLSEngine) run() {
+	defer close(e.done)
+	if e.err = e.conn.Handshake(); e.err != nil {
+		return
+	}
+	e.state = e.conn.ConnectionState()
+	e.hsDone = true
+	buf := make([]byte, 16384)
+	for {
+		n, err := e.conn.Read(buf)
+		if n != 0 {
+			e.appMux.Lock()
+			e.appData = append(e.appData, buf[:n]...)
+			e.appMux.Unlock()
+		}
+		if err != nil {
+			e.err = err
+			return
+		}
+	}
+}
+
+// wait blocks until the TLS side needs more records
+// returning the records to be sent and the application data received
+func (e *eapTLSEngine) wait() (out, appData []byte, err error) {
+	select {
+	case <-e.tr.idle:
+	case <-e.done:
+		if err = e.err; err == nil {
+			err = io.EOF
+		}
+	}
+	e.appMux.Lock()
+	appData, e.appData = e.appData, nil
+	e.appMux.Unlock()
+	return e.tr.takeOut(), appData, err
+}
+
+// feed delivers the records received from the other side
+func (e *eapTLSEngine) feed(records []byte) (out, appData []byte, err error) {
+	select {
+	case e.tr.in <- records:
+	case <-e.done:
+		return nil, nil, e.err
+	}
+	return e.wait()
+}
+
+// write sends the application data through the tunnel, returning the records
+func (e *eapTLSEngine) write(data []byte) ([]byte, error) {
+	if _, err := e.conn.Write(data); err != nil {
+		return nil, err
+	}
+	return e.tr.takeOut(), nil
+}
+
+// msk exports the Master Session Key out of TLS keying material
+func (e *eapTLSEngine) msk(typ uint8) ([]byte, error) {
+	return e.state.ExportKeyingMaterial(eapTLSKeyLabel(typ), nil, 64)
+}
+
+// Close stops the TLS side
+func (e *eapTLSEngine) Close() error {
+	return e.tr.Close()
+}
+
+// eapTLSFragments reassembles and splits the TLS messages carried over EAP, rfc5216 2.1.5
+type eapTLSFragments struct {
+	fragSize int
+	in       []byte // fragments received
+	out      []byte // records pending to be sent
+	outStart bool   // next fragment is the first one out of the message
+}
+
+// queue adds records to be sent
+func (f *eapTLSFragments) queue(records []byte) {
+	if len(records) == 0 {
+		return
+	}
+	if len(f.out) == 0 {
+		f.outStart = true
+	}
+	f.out = append(f.out, records...)
+}
+
+// next returns the Type-Data with the next fragment of the pending records
+func (f *eapTLSFragments) next() []byte {
+	frag := f.out
+	var flags uint8
+	if len(frag) > f.fragSize {
+		frag, flags = f.out[:f.fragSize], eapTLSMoreFragments
+	}
+	data := []byte{flags}
+	if f.outStart && flags&eapTLSMoreFragments != 0 {
+		data[0] |= eapTLSLengthIncluded
+		data = binary.BigEndian.AppendUint32(data, uint32(len(f.out)))
+	}
+	f.outStart = false
+	f.out = f.out[len(frag):]
+	return append(data, frag...)
+}
+
+// receive adds the fragment out of the Type-Data, returning true if more fragments are expected
+func (f *eapTLSFragments) receive(data []byte) (more bool, err error) {
+	if len(data) == 0 {
+		return false, errors.New("missing EAP-TLS flags")
+	}
+	flags, payload := data[0], data[1:]
+	if flags&eapTLSLengthIncluded != 0 {
+		if len(payload) < 4 {
+			return false, errors.New("missing EAP-TLS message length")
+		}
+		payload = payload[4:]
+	}
+	if len(f.in)+len(payload) > eapTLSMaxMessage {
+		return false, errors.New("EAP-TLS message too long")
+	}
+	f.in = append(f.in, payload...)
+	return flags&eapTLSMoreFragments != 0, nil
+}
+
+// records returns the reassembled message, resetting the input
+func (f *eapTLSFragments) records() (r []byte) {
+	r, f.in = f.in, nil
+	return
+}
+
+// eapTLSTunnel handles the application data once the TLS handshake is complete
+// appData is nil when the peer did not send any
+type eapTLSTunnel func(sess *EAPSession, st *eapTLSSession, appData []byte) (EAPStatus, error)
+
+// eapTLSSession is the EAPSession data of the TLS based methods
+type eapTLSSession struct {
+	eng      *eapTLSEngine
+	frags    *eapTLSFragments
+	final    bool      // result known, reported once the pending records are acknowledged
+	result   EAPStatus // final status
+	phase    int       // progress of the tunneled method
+	identity string    // inner identity
+	msCHAPID uint8     // MS-CHAPv2-ID inside PEAP
+	chlng    []byte    // MS-CHAPv2 authenticator challenge
+}
+
+// send writes the application data through the tunnel
+func (st *eapTLSSession) send(data []byte) error {
+	out, err := st.eng.write(data)
+	if err != nil {
+		return err
+	}
+	st.frags.queue(out)
+	return nil
+}
+
+func (st *eapTLSSession) Close() error {
+	return st.eng.Close()
+}
+
+// newEAPTLSMethod instantiates a TLS based method
+// EAP-TLS authenticates the peer by its certificate so one is always required and verified
+func newEAPTLSMethod(typ uint8, tlsCfg *tls.Config, tunnel eapTLSTunnel) *EAPTLSMethod {
+	if typ == EAPTypeTLS && tlsCfg != nil {
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &EAPTLSMethod{typ: typ, tlsCfg: tlsCfg, tunnel: tunnel, fragSize: EAPTLSFragmentSize}
+}
+
+// NewEAPTLS instantiates the EAP-TLS method, rfc5216
+// the client certificates are verified against tlsCfg.ClientCAs
+func NewEAPTLS(tlsCfg *tls.Config) *EAPTLSMethod {
+	return newEAPTLSMethod(EAPTypeTLS, tlsCfg,
+		func(_ *EAPSession, st *eapTLSSession, _ []byte) (EAPStatus, error) {
+			if len(st.eng.state.VerifiedChains) == 0 {
+				return EAPFailed, nil
+			}
+			return EAPSucceeded, nil // authenticated by the handshake
+		})
+}
+
+// NewEAPPEAP instantiates the PEAPv0 method with EAP-MSCHAPv2 inside the tunnel
+// password returns the cleartext password of the inner identity
+func NewEAPPEAP(tlsCfg *tls.Config, password func(identity string) (string, error)) *EAPTLSMethod {
+	return newEAPTLSMethod(EAPTypePEAP, tlsCfg, peapTunnel(password))
+}
+
+// NewEAPTTLS instantiates the EAP-TTLS method with PAP inside the tunnel
+// password returns the cleartext password of the inner identity
+func NewEAPTTLS(tlsCfg *tls.Config, password func(identity string) (string, error)) *EAPTLSMethod {
+	return newEAPTLSMethod(EAPTypeTTLS, tlsCfg, ttlsTunnel(password))
+}
+
+// EAPTLSMethod implements the TLS based EAP methods: EAP-TLS, PEAP and EAP-TTLS
+type EAPTLSMethod struct {
+	typ      uint8
+	tlsCfg   *tls.Config
+	tunnel   eapTLSTunnel
+	fragSize int
+}
+
+// SetFragmentSize changes the maximum of TLS data sent in one EAP packet
+func (m *EAPTLSMethod) SetFragmentSize(size int) {
+	m.fragSize = size
+}
+
+func (m *EAPTLSMethod) Type() uint8 {
+	return m.typ
+}
+
+// Start initiates the TLS handshake with the Start flag
+func (m *EAPTLSMethod) Start(sess *EAPSession) ([]byte, error) {
+	eng, _, err := newEAPTLSEngine(m.tlsCfg, true)
+	if err != nil {
+		return nil, err
+	}
+	sess.Data = &eapTLSSession{eng: eng, frags: &eapTLSFragments{fragSize: m.fragSize}}
+	return []byte{eapTLSStart}, nil
+}
+
+// Process handles the TLS data of the peer, reassembling and fragmenting it
+func (m *EAPTLSMethod) Process(sess *EAPSession, data []byte) ([]byte, EAPStatus, error) {
+	st, canCast := sess.Data.(*eapTLSSession)
+	if !canCast {
+		return nil, EAPFailed, errors.New("missing EAP-TLS session")
+	}
+	more, err := st.frags.receive(data)
+	if err != nil {
+		return nil, EAPFailed, err
+	}
+	if more { // acknowledge the fragment
+		return []byte{0}, EAPContinue, nil
+	}
+	var appData []byte
+	if records := st.frags.records(); len(records) != 0 {
+		if len(st.frags.out) != 0 {
+			return nil, EAPFailed, errors.New("unexpected EAP-TLS data while sending fragments")
+		}
+		var out []byte
+		out, appData, err = st.eng.feed(records)
+		if err != nil {
+			return nil, EAPFailed, err
+		}
+		st.frags.queue(out)
+	} else if len(st.frags.out) != 0 { // acknowledgement of our fragment
+		return st.frags.next(), EAPContinue, nil
+	}
+	if !st.eng.hsDone {
+		if len(st.frags.out) == 0 {
+			return nil, EAPFailed, errors.New("unexpected EAP-TLS acknowledgement")
+		}
+		return st.frags.next(), EAPContinue, nil
+	}
+	if !st.final {
+		if sess.MSK == nil {
+			if sess.MSK, err = st.eng.msk(m.typ); err != nil {
+				return nil, EAPFailed, err
+			}
+		}
+		status, err := m.tunnel(sess, st, appData)
+		if err != nil {
+			return nil, EAPFailed, err
+		}
+		if status != EAPContinue {
+			st.final, st.result = true, status
+		}
+	}
+	if len(st.frags.out) != 0 {
+		return st.frags.next(), EAPContinue, nil
+	}
+	if st.final {
+		return nil, st.result, nil
+	}
+	return nil, EAPFailed, errors.New("no data for the EAP peer")
+}
+
+// msCHAPv2Packet builds the EAP-MSCHAPv2 packet inside PEAP, without EAP header
+// Type(1) + OpCode(1) + MS-CHAPv2-ID(1) + MS-Length(2) + Data
+func msCHAPv2Packet(opCode, msCHAPID uint8, data []byte) []byte {
+	b := []byte{EAPTypeMSCHAPv2, opCode, msCHAPID, 0, 0}
+	binary.BigEndian.PutUint16(b[3:5], uint16(4+len(data)))
+	return append(b, data...)
+}
+
+// peapResultTLV builds the Extensions packet carrying the Result TLV, with EAP header
+func peapResultTLV(code, id uint8, success bool) []byte {
+	result := uint8(2)
+	if success {
+		result = 1
+	}
+	return []byte{code, id, 0, 11, EAPTypeExtensions, 0x80, 0x03, 0x00, 0x02, 0x00, result}
+}
+
+// isPEAPResultTLV checks the Extensions packet, returning the result
+func isPEAPResultTLV(b []byte) (isTLV, success bool) {
+	if len(b) != 11 || b[4] != EAPTypeExtensions || binary.BigEndian.Uint16(b[2:4]) != 11 {
+		return false, false
+	}
+	return true, b[10] == 1
+}
+
+// phases of the PEAP tunnel on server side
+const (
+	peapStart = iota
+	peapIdentity
+	peapMSCHAPv2
+	peapSuccess
+	peapResult
+)
+
+// peapTunnel runs EAP-MSCHAPv2 inside PEAPv0, inner EAP headers are omitted besides the Extensions
+func peapTunnel(password func(identity string) (string, error)) eapTLSTunnel {
+	return func(sess *EAPSession, st *eapTLSSession, appData []byte) (EAPStatus, error) {
+		switch st.phase {
+		case peapStart:
+			st.phase = peapIdentity
+			return EAPContinue, st.send([]byte{EAPTypeIdentity})
+		case peapIdentity:
+			if len(appData) < 1 || appData[0] != EAPTypeIdentity {
+				return EAPFailed, nil
+			}
+			st.identity = string(appData[1:])
+			st.chlng = make([]byte, 16)
+			rand.Read(st.chlng)
+			st.msCHAPID = sess.ID
+			st.phase = peapMSCHAPv2
+			return EAPContinue, st.send(msCHAPv2Packet(msCHAPv2Challenge, st.msCHAPID,
+				append(append([]byte{16}, st.chlng...), "radigo"...)))
+		case peapMSCHAPv2:
+			// Type(1) + OpCode(1) + ID(1) + MS-Length(2) + Value-Size(1) + Peer-Challenge(16) + Reserved(8) + NT-Response(24) + Flags(1) + Name
+			if len(appData) < 55 || appData[0] != EAPTypeMSCHAPv2 ||
+				appData[1] != msCHAPv2Response || appData[5] != 49 {
+				return EAPFailed, nil
+			}
+			peerChlng, ntResponse := appData[6:22], appData[30:54]
+			userName := string(appData[55:])
+			if idx := strings.LastIndexByte(userName, '\\'); idx != -1 {
+				userName = userName[idx+1:]
+			}
+			pass, err := password(st.identity)
+			if err != nil {
+				return EAPFailed, err
+			}
+			passwordHash, err := NTPasswordHash(pass)
+			if err != nil {
+				return EAPFailed, err
+			}
+			if subtle.ConstantTimeCompare(ntResponse,
+				ChallengeResponse(ChallengeHash(peerChlng, st.chlng, userName), passwordHash)) != 1 {
+				return EAPFailed, st.send(msCHAPv2Packet(msCHAPv2Failure, st.msCHAPID,
+					msCHAPError(st.msCHAPID, 16, "V=3 M=Authentication failed")[1:]))
+			}
+			authResp := generateAuthenticatorResponseWithHash(st.chlng, peerChlng, ntResponse, userName, passwordHash)
+			st.phase = peapSuccess
+			return EAPContinue, st.send(msCHAPv2Packet(msCHAPv2Success, st.msCHAPID,
+				[]byte(authResp+" M=Authentication succeeded")))
+		case peapSuccess:
+			if len(appData) != 2 || appData[0] != EAPTypeMSCHAPv2 || appData[1] != msCHAPv2Success {
+				return EAPFailed, nil
+			}
+			st.phase = peapResult
+			return EAPContinue, st.send(peapResultTLV(EAPRequest, sess.ID+1, true))
+		case peapResult:
+			if isTLV, success := isPEAPResultTLV(appData); isTLV && success {
+				return EAPSucceeded, nil
+			}
+		}
+		return EAPFailed, nil
+	}
+}
+
+// ttlsTunnel verifies the PAP credentials sent as Diameter AVPs inside EAP-TTLS, rfc5281 11.2.5
+func ttlsTunnel(password func(identity string) (string, error)) eapTLSTunnel {
+	return func(sess *EAPSession, st *eapTLSSession, appData []byte) (EAPStatus, error) {
+		if appData == nil {
+			if st.phase == 0 { // handshake just completed, peer will send the AVPs
+				st.phase = 1
+				return EAPContinue, nil
+			}
+			return EAPFailed, nil
+		}
+		avps, err := parseDiameterAVPs(appData)
+		if err != nil {
+			return EAPFailed, err
+		}
+		userName, userPass := avps[1], avps[UserPasswordNumber]
+		if userName == nil || userPass == nil {
+			return EAPFailed, nil
+		}
+		st.identity = string(userName)
+		pass, err := password(st.identity)
+		if err != nil {
+			return EAPFailed, err
+		}
+		if subtle.ConstantTimeCompare(bytes.TrimRight(userPass, "\x00"), []byte(pass)) != 1 {
+			return EAPFailed, nil
+		}
+		return EAPSucceeded, nil
+	}
+}
+
+// encodeDiameterAVP builds the Diameter AVP carried inside EAP-TTLS, padded to 4 bytes, rfc5281 10
+// Code(4) + Flags(1) + Length(3) + Data
+func encodeDiameterAVP(code uint32, data []byte) []byte {
+	length := 8 + len(data)
+	b := make([]byte, (length+3)&^3)
+	binary.BigEndian.PutUint32(b[0:4], code)
+	binary.BigEndian.PutUint32(b[4:8], uint32(length))
+	b[4] = 0x40 // M flag
+	copy(b[8:], data)
+	return b
+}
+
+// parseDiameterAVPs returns the values of the non vendor Diameter AVPs carried inside EAP-TTLS
+func parseDiameterAVPs(b []byte) (map[uint32][]byte, error) {
+	avps := make(map[uint32][]byte)
+	for len(b) != 0 {
+		if len(b) < 8 {
+			return nil, errors.New("invalid Diameter AVP header")
+		}
+		code, flags := binary.BigEndian.Uint32(b[0:4]), b[4]
+		length := int(binary.BigEndian.Uint32(b[4:8]) & 0xffffff)
+		hdrLen := 8
+		if flags&0x80 != 0 { // Vendor-ID present
+			hdrLen = 12
+		}
+		if length < hdrLen || length > len(b) {
+			return nil, fmt.Errorf("invalid Diameter AVP length: %d", length)
+		}
+		if hdrLen == 8 {
+			avps[code] = b[hdrLen:length]
+		}
+		if length = (length + 3) &^ 3; length > len(b) {
+			length = len(b)
+		}
+		b = b[length:]
+	}
+	return avps, nil
+}
@@ -0,0 +1,196 @@
+package radigo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testEAPPassword(identity string) (string, error) {
+	if identity != "flopsy" {
+		return "", errors.New("unknown identity")
+	}
+	return "arctangent", nil
+}
+
+// testEAPTLSAuthenticate runs the peer against the server method over the loopback
+func testEAPTLSAuthenticate(t *testing.T, m *EAPTLSMethod, ep *EAPPeer) (*Packet, []byte, error) {
+	es := NewEAPServer(0)
+	es.RegisterMethod(NewEAPMD5(testEAPPassword)) // Nak-ed by the peer
+	es.RegisterMethod(m)
+	return ep.Authenticate(NewEAPLoopback(es, RFC2865Dictionary(), "CGRateS.org"))
+}
+
+func testEAPCheckMPPEKeys(t *testing.T, rply *Packet, msk []byte) {
+	if len(msk) != 64 {
+		t.Fatalf("Expected: <%+v>, \nReceived: <%+v>", 64, len(msk))
+	}
+	sendKey, recvKey := rply.MPPEKeys()
+	if !reflect.DeepEqual(msk[32:64], sendKey) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", msk[32:64], sendKey)
+	}
+	if !reflect.DeepEqual(msk[:32], recvKey) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", msk[:32], recvKey)
+	}
+}
+
+func TestEAPTLSFragments(t *testing.T) {
+	out := &eapTLSFragments{fragSize: 4}
+	out.queue([]byte("0123456789"))
+	in := &eapTLSFragments{}
+	exp := [][]byte{
+		{eapTLSLengthIncluded | eapTLSMoreFragments, 0, 0, 0, 10, '0', '1', '2', '3'},
+		{eapTLSMoreFragments, '4', '5', '6', '7'},
+		{0, '8', '9'},
+	}
+	for i, expFrag := range exp {
+		frag := out.next()
+		if !bytes.Equal(expFrag, frag) {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", expFrag, frag)
+		}
+		if more, err := in.receive(frag); err != nil {
+			t.Error(err)
+		} else if more != (i != 2) {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", i != 2, more)
+		}
+	}
+	if rcv := in.records(); string(rcv) != "0123456789" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "0123456789", string(rcv))
+	}
+	if _, err := in.receive(nil); err == nil {
+		t.Error("expecting error for missing flags")
+	}
+	if _, err := in.receive([]byte{eapTLSLengthIncluded, 0}); err == nil {
+		t.Error("expecting error for missing length")
+	}
+}
+
+func TestEAPTLS(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	m := NewEAPTLS(srvCfg)
+	m.SetFragmentSize(300)
+	rply, msk, err := testEAPTLSAuthenticate(t, m,
+		&EAPPeer{Method: EAPTypeTLS, Identity: "flopsy", TLSConfig: clntCfg, FragmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+}
+
+func TestEAPTLSNoClientCertificate(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	clntCfg.Certificates = nil
+	rply, _, err := testEAPTLSAuthenticate(t, NewEAPTLS(srvCfg),
+		&EAPPeer{Method: EAPTypeTLS, Identity: "flopsy", TLSConfig: clntCfg})
+	if err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+	if rply == nil || rply.Code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, rply)
+	}
+}
+
+func TestEAPTLSNoClientAuth(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	srvCfg.ClientAuth = tls.NoClientCert // enforced by the method
+	clntCfg.Certificates = nil
+	m := NewEAPTLS(srvCfg)
+	if m.tlsCfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", tls.RequireAndVerifyClientCert, m.tlsCfg.ClientAuth)
+	}
+	if srvCfg.ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", tls.NoClientCert, srvCfg.ClientAuth)
+	}
+	rply, _, err := testEAPTLSAuthenticate(t, m,
+		&EAPPeer{Method: EAPTypeTLS, Identity: "flopsy", TLSConfig: clntCfg})
+	if err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+	if rply == nil || rply.Code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, rply)
+	} else if sendKey, _ := rply.MPPEKeys(); sendKey != nil {
+		t.Errorf("unexpected MPPE keys: %+v", sendKey)
+	}
+	// handshake completed without verifying the peer
+	st := &eapTLSSession{eng: &eapTLSEngine{}}
+	if status, err := m.tunnel(&EAPSession{}, st, nil); err != nil {
+		t.Error(err)
+	} else if status != EAPFailed {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", EAPFailed, status)
+	}
+}
+
+func TestEAPPEAP(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	srvCfg.ClientAuth = 0 // only the server is authenticated by TLS
+	clntCfg.Certificates = nil
+	m := NewEAPPEAP(srvCfg, testEAPPassword)
+	m.SetFragmentSize(500)
+	ep := &EAPPeer{Method: EAPTypePEAP, Identity: "anonymous", InnerIdentity: "flopsy",
+		Password: "arctangent", TLSConfig: clntCfg}
+	rply, msk, err := testEAPTLSAuthenticate(t, m, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+	ep.Password = "wrong"
+	if rply, _, err = testEAPTLSAuthenticate(t, m, ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	} else if sendKey, _ := rply.MPPEKeys(); sendKey != nil {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", nil, sendKey)
+	}
+	ep.InnerIdentity = "unknown"
+	if _, _, err = testEAPTLSAuthenticate(t, m, ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+}
+
+func TestEAPTTLS(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	srvCfg.ClientAuth = 0
+	clntCfg.Certificates = nil
+	m := NewEAPTTLS(srvCfg, testEAPPassword)
+	ep := &EAPPeer{Method: EAPTypeTTLS, Identity: "anonymous", InnerIdentity: "flopsy",
+		Password: "arctangent", TLSConfig: clntCfg, FragmentSize: 100}
+	rply, msk, err := testEAPTLSAuthenticate(t, m, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	testEAPCheckMPPEKeys(t, rply, msk)
+	ep.Password = "wrong"
+	if _, _, err = testEAPTLSAuthenticate(t, m, ep); err != ErrEAPRejected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrEAPRejected, err)
+	}
+}
+
+func TestEAPTLSDiameterAVPs(t *testing.T) {
+	b := append(encodeDiameterAVP(1, []byte("flopsy")), encodeDiameterAVP(2, []byte("arctangent"))...)
+	if len(b) != 16+20 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 36, len(b))
+	}
+	avps, err := parseDiameterAVPs(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[uint32][]byte{1: []byte("flopsy"), 2: []byte("arctangent")}
+	if !reflect.DeepEqual(exp, avps) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, avps)
+	}
+	if _, err = parseDiameterAVPs(b[:5]); err == nil {
+		t.Error("expecting error for short header")
+	}
+	if _, err = parseDiameterAVPs(b[:12]); err == nil {
+		t.Error("expecting error for invalid length")
+	}
+}
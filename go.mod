@@ -3,6 +3,14 @@ module github.com/cgrates/radigo
 go 1.21
 
 require (
-	golang.org/x/crypto v0.0.0-20200320181102-891825fb96df
-	golang.org/x/text v0.3.2
+	github.com/pion/dtls/v2 v2.2.12
+	golang.org/x/crypto v0.18.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	github.com/pion/logging v0.2.2 // indirect
+	github.com/pion/transport/v2 v2.2.4 // indirect
+	golang.org/x/net v0.20.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
 )
@@ -0,0 +1,103 @@
+package radigo
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// HandlerFunc handles the requests of one PacketCode
+// ctx is cancelled on server shutdown or once the request timeout passes, carrying the RequestInfo
+type HandlerFunc func(ctx context.Context, req *Packet) (*Packet, error)
+
+// ContextHandler adapts the handlers without context, as used in reqHandlers, to HandlerFunc
+func ContextHandler(hndlr func(*Packet) (*Packet, error)) HandlerFunc {
+	return func(_ context.Context, req *Packet) (*Packet, error) {
+		return hndlr(req)
+	}
+}
+
+// RequestInfo is the metadata of a received request
+type RequestInfo struct {
+	LocalAddr       net.Addr          // listener address
+	RemoteAddr      net.Addr          // client address
+	Transport       string            // udp, tcp, tls or dtls
+	ClientID        string            // used to look up the secret and dictionary
+	PeerCertificate *x509.Certificate // presented by the client over tls and dtls, nil otherwise
+	Received        time.Time
+}
+
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the RequestInfo of the request handled with ctx
+func RequestInfoFromContext(ctx context.Context) (ri *RequestInfo, has bool) {
+	ri, has = ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return
+}
+
+// newRequestInfo returns the RequestInfo of a request received on synConn
+func newRequestInfo(synConn syncedConn, rcvd time.Time) *RequestInfo {
+	return &RequestInfo{LocalAddr: synConn.localAddr(), RemoteAddr: synConn.remoteAddr(),
+		Transport: synConn.transport(), ClientID: synConn.getConnID(),
+		PeerCertificate: synConn.peerCertificate(), Received: rcvd}
+}
+
+// RegisterHandlerContext registers a context aware handler, replacing the one registered for code
+func (s *Server) RegisterHandlerContext(code PacketCode, hndlr HandlerFunc) {
+	s.rhMux.Lock()
+	if s.ctxHandlers == nil {
+		s.ctxHandlers = make(map[PacketCode]HandlerFunc)
+	}
+	s.ctxHandlers[code] = hndlr
+	delete(s.reqHandlers, code)
+	s.rhMux.Unlock()
+}
+
+// SetRequestTimeout limits the processing of one request, 0 to disable
+// the handler context is cancelled once the timeout passes
+func (s *Server) SetRequestTimeout(timeout time.Duration) {
+	s.reqTimeout.Store(int64(timeout))
+}
+
+// handler returns the handler registered for code
+func (s *Server) handler(code PacketCode) (hndlr HandlerFunc, has bool) {
+	s.rhMux.RLock()
+	defer s.rhMux.RUnlock()
+	if hndlr, has = s.ctxHandlers[code]; has {
+		return
+	}
+	var reqHndlr func(*Packet) (*Packet, error)
+	if reqHndlr, has = s.reqHandlers[code]; has {
+		hndlr = ContextHandler(reqHndlr)
+	}
+	return
+}
+
+// serveContext starts the context of the handlers and the workers, stopped once stopChan is closed
+func (s *Server) serveContext(stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.rhMux.Lock()
+	s.ctx = ctx
+	s.rhMux.Unlock()
+	go func() {
+		<-stopChan
+		cancel()
+	}()
+	s.startWorkers(stopChan)
+}
+
+// requestContext returns the context for handling one request
+func (s *Server) requestContext(ri *RequestInfo) (ctx context.Context, cancel context.CancelFunc) {
+	s.rhMux.RLock()
+	ctx = s.ctx
+	s.rhMux.RUnlock()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, requestInfoKey{}, ri)
+	if timeout := time.Duration(s.reqTimeout.Load()); timeout > 0 {
+		return context.WithDeadline(ctx, ri.Received.Add(timeout))
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,117 @@
+package radigo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerHandlerContext(t *testing.T) {
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){}, nil, nil)
+	riChn := make(chan *RequestInfo, 1)
+	srv.RegisterHandlerContext(AccessRequest, func(ctx context.Context, req *Packet) (*Packet, error) {
+		ri, _ := RequestInfoFromContext(ctx)
+		riChn <- ri
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply, nil
+	})
+	pc, err := net.ListenPacket("udp", srv.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan struct{})
+	defer func() {
+		close(stopChan)
+		pc.Close()
+	}()
+	go srv.serveUDP(stopChan, pc)
+	clnt, err := NewClient("udp", pc.LocalAddr().String(), "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Close()
+	started := time.Now()
+	if rply, err := clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	ri := <-riChn
+	if ri == nil {
+		t.Fatal("missing RequestInfo")
+	}
+	if ri.Transport != "udp" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "udp", ri.Transport)
+	}
+	if ri.ClientID != "127.0.0.1" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "127.0.0.1", ri.ClientID)
+	}
+	if ri.LocalAddr.String() != pc.LocalAddr().String() {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", pc.LocalAddr(), ri.LocalAddr)
+	}
+	if ri.RemoteAddr == nil || ri.PeerCertificate != nil {
+		t.Errorf("Unexpected addresses or certificate: %+v", ri)
+	}
+	if ri.Received.Before(started) || ri.Received.After(time.Now()) {
+		t.Errorf("Unexpected receive time: %s", ri.Received)
+	}
+
+	srv.RegisterHandler(AccessRequest, func(req *Packet) (*Packet, error) { // replaces the context one
+		return nil, errors.New("legacy")
+	})
+	if rply, err := clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, rply.Code)
+	}
+}
+
+// testHandlerCtxErr returns the context error seen by a handler waiting for it's context to be done
+func testHandlerCtxErr(t *testing.T, srv *Server, stop func()) error {
+	errChn := make(chan error, 1)
+	srv.RegisterHandlerContext(AccessRequest, func(ctx context.Context, req *Packet) (*Packet, error) {
+		<-ctx.Done()
+		errChn <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	var buf [MaxPacketLen]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 1)}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	if stop != nil {
+		stop()
+	}
+	select {
+	case err = <-errChn:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not done")
+	}
+	if b := <-synConn.rplyChn; PacketCode(b[0]) != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, PacketCode(b[0]))
+	}
+	return err
+}
+
+func TestServerHandlerContextDone(t *testing.T) {
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}), nil, nil, nil)
+	srv.SetRequestTimeout(10 * time.Millisecond)
+	if err := testHandlerCtxErr(t, srv, nil); err != context.DeadlineExceeded {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	srv.SetRequestTimeout(0)
+	stopChan := make(chan struct{})
+	srv.serveContext(stopChan)
+	if err := testHandlerCtxErr(t, srv, func() { close(stopChan) }); err != context.Canceled {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+	}
+}
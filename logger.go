@@ -1,5 +1,7 @@
 package radigo
 
+import "reflect"
+
 type logger interface {
 	Alert(string) error
 	Close() error
@@ -23,3 +25,11 @@ func (nopLogger) Err(string) error     { return nil }
 func (nopLogger) Info(string) error    { return nil }
 func (nopLogger) Notice(string) error  { return nil }
 func (nopLogger) Warning(string) error { return nil }
+
+// orNopLogger returns nopLogger instead of a nil logger
+func orNopLogger(l logger) logger {
+	if l == nil || (reflect.ValueOf(l).Kind() == reflect.Ptr && reflect.ValueOf(l).IsNil()) {
+		return nopLogger{}
+	}
+	return l
+}
@@ -0,0 +1,101 @@
+package radigo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+var errHandlerPanic = errors.New("internal error")
+
+// Middleware wraps a handler, ie: for logging, metrics or policy checks
+type Middleware func(HandlerFunc) HandlerFunc
+
+// Use wraps the handlers of all the packet codes with mws, the first one being the outermost
+// global middlewares wrap the ones registered per packet code
+func (s *Server) Use(mws ...Middleware) {
+	s.rhMux.Lock()
+	s.mws = append(s.mws, mws...)
+	s.rhMux.Unlock()
+}
+
+// UseFor wraps the handler of code with mws, the first one being the outermost
+func (s *Server) UseFor(code PacketCode, mws ...Middleware) {
+	s.rhMux.Lock()
+	if s.codeMws == nil {
+		s.codeMws = make(map[PacketCode][]Middleware)
+	}
+	s.codeMws[code] = append(s.codeMws[code], mws...)
+	s.rhMux.Unlock()
+}
+
+// chain wraps the handler of code with it's middlewares
+func (s *Server) chain(code PacketCode, hndlr HandlerFunc) HandlerFunc {
+	s.rhMux.RLock()
+	mws := append(append([]Middleware{}, s.mws...), s.codeMws[code]...)
+	s.rhMux.RUnlock()
+	for i := len(mws) - 1; i >= 0; i-- {
+		hndlr = mws[i](hndlr)
+	}
+	return hndlr
+}
+
+// RecoveryMiddleware returns errHandlerPanic instead of crashing when the handler panics
+// the panic is logged with it's stack trace, the server answers negatively
+func RecoveryMiddleware(l logger) Middleware {
+	l = orNopLogger(l)
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Packet) (rply *Packet, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					l.Err(fmt.Sprintf("panic <%v> when handling packet with code: %d\n%s",
+						r, req.Code, debug.Stack()))
+					rply, err = nil, errHandlerPanic
+				}
+			}()
+			return next(ctx, req)
+		}
+	}
+}
+
+// TimingMiddleware reports the processing time of the handler to observe
+func TimingMiddleware(observe func(code PacketCode, elapsed time.Duration)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Packet) (*Packet, error) {
+			started := time.Now()
+			defer func() { observe(req.Code, time.Since(started)) }()
+			return next(ctx, req)
+		}
+	}
+}
+
+// LoggingMiddleware logs the requests with their replies or errors at debug level
+func LoggingMiddleware(l logger) Middleware {
+	l = orNopLogger(l)
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, req *Packet) (rply *Packet, err error) {
+			var client string
+			if ri, has := RequestInfoFromContext(ctx); has {
+				client = ri.ClientID
+			}
+			l.Debug(fmt.Sprintf("received packet with code: %d, identifier: %d from <%s>",
+				req.Code, req.Identifier, client))
+			started := time.Now()
+			rply, err = next(ctx, req)
+			switch {
+			case err != nil:
+				l.Debug(fmt.Sprintf("error: <%s> when handling packet with code: %d, identifier: %d from <%s>",
+					err.Error(), req.Code, req.Identifier, client))
+			case rply == nil:
+				l.Debug(fmt.Sprintf("no reply for packet with code: %d, identifier: %d from <%s>",
+					req.Code, req.Identifier, client))
+			default:
+				l.Debug(fmt.Sprintf("replied with code: %d to packet with identifier: %d from <%s> in %s",
+					rply.Code, req.Identifier, client, time.Since(started)))
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package radigo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger records the debug and error messages
+type testLogger struct {
+	nopLogger
+	msgs []string
+}
+
+func (tl *testLogger) Debug(msg string) error {
+	tl.msgs = append(tl.msgs, "debug: "+msg)
+	return nil
+}
+
+func (tl *testLogger) Err(msg string) error {
+	tl.msgs = append(tl.msgs, "err: "+msg)
+	return nil
+}
+
+// testServerReply handles a request with code on srv, returning the code of the reply
+func testServerReply(t *testing.T, srv *Server, code PacketCode) PacketCode {
+	req := NewPacket(code, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	var buf [MaxPacketLen]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 1)}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	select {
+	case b := <-synConn.rplyChn:
+		return PacketCode(b[0])
+	case <-time.After(time.Second):
+		t.Fatal("no reply")
+	}
+	return 0
+}
+
+func TestServerMiddlewares(t *testing.T) {
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){
+			AccessRequest: func(req *Packet) (*Packet, error) {
+				rply := req.Reply()
+				rply.Code = AccessAccept
+				return rply, nil
+			},
+			AccountingRequest: func(req *Packet) (*Packet, error) {
+				rply := req.Reply()
+				rply.Code = AccountingResponse
+				return rply, nil
+			},
+		}, nil, nil)
+	callsChn := make(chan string, 10)
+	testMw := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, req *Packet) (*Packet, error) {
+				callsChn <- name
+				return next(ctx, req)
+			}
+		}
+	}
+	srv.Use(testMw("global1"), testMw("global2"))
+	srv.UseFor(AccessRequest, testMw("auth"))
+	if code := testServerReply(t, srv, AccessRequest); code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, code)
+	}
+	var calls []string
+	for len(callsChn) != 0 {
+		calls = append(calls, <-callsChn)
+	}
+	if exp := []string{"global1", "global2", "auth"}; !reflect.DeepEqual(exp, calls) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, calls)
+	}
+	if code := testServerReply(t, srv, AccountingRequest); code != AccountingResponse {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccountingResponse, code)
+	}
+	calls = nil
+	for len(callsChn) != 0 {
+		calls = append(calls, <-callsChn)
+	}
+	if exp := []string{"global1", "global2"}; !reflect.DeepEqual(exp, calls) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, calls)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}), nil, nil, nil)
+	l := &testLogger{}
+	srv.Use(RecoveryMiddleware(l))
+	srv.RegisterHandlerContext(AccessRequest, func(ctx context.Context, req *Packet) (*Packet, error) {
+		panic("handler bug")
+	})
+	if code := testServerReply(t, srv, AccessRequest); code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, code)
+	}
+	if len(l.msgs) != 1 || !strings.HasPrefix(l.msgs[0], "err: panic <handler bug> when handling packet with code: 1") {
+		t.Errorf("Unexpected logs: %+v", l.msgs)
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	var observed time.Duration
+	hndlr := TimingMiddleware(func(code PacketCode, elapsed time.Duration) {
+		if code != AccessRequest {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessRequest, code)
+		}
+		observed = elapsed
+	})(func(ctx context.Context, req *Packet) (*Packet, error) {
+		time.Sleep(10 * time.Millisecond)
+		return req.Reply(), nil
+	})
+	if _, err := hndlr(context.Background(), NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "")); err != nil {
+		t.Fatal(err)
+	}
+	if observed < 10*time.Millisecond {
+		t.Errorf("Unexpected processing time: %s", observed)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	l := &testLogger{}
+	hndlr := LoggingMiddleware(l)(func(ctx context.Context, req *Packet) (*Packet, error) {
+		if req.Identifier == 2 {
+			return nil, errors.New("unknown user")
+		}
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply, nil
+	})
+	ctx := context.WithValue(context.Background(), requestInfoKey{}, &RequestInfo{ClientID: "127.0.0.1"})
+	hndlr(ctx, NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), ""))
+	hndlr(ctx, NewPacket(AccessRequest, 2, RFC2865Dictionary(), NewCoder(), ""))
+	if len(l.msgs) != 4 {
+		t.Fatalf("Unexpected logs: %+v", l.msgs)
+	}
+	if exp := "debug: received packet with code: 1, identifier: 1 from <127.0.0.1>"; l.msgs[0] != exp {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, l.msgs[0])
+	}
+	if exp := "debug: replied with code: 2 to packet with identifier: 1 from <127.0.0.1>"; !strings.HasPrefix(l.msgs[1], exp) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, l.msgs[1])
+	}
+	if exp := "debug: error: <unknown user> when handling packet with code: 1, identifier: 2 from <127.0.0.1>"; l.msgs[3] != exp {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, l.msgs[3])
+	}
+}
@@ -0,0 +1,155 @@
+package radigo
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Microsoft VSAs used by MS-CHAP, rfc2548
+const (
+	MSCHAPResponseNumber  = 1
+	MSCHAPErrorNumber     = 2
+	MSCHAPChallengeNumber = 11
+	MSCHAP2ResponseNumber = 25
+	MSCHAP2SuccessNumber  = 26
+	// MSCHAPAuthFailure is the error code sent in MS-CHAP-Error on authentication failure
+	MSCHAPAuthFailure = 691
+)
+
+var (
+	ErrMSCHAPChallengeMissing = errors.New("missing MS-CHAP-Challenge")
+	ErrMSCHAPResponseMissing  = errors.New("missing MS-CHAP-Response or MS-CHAP2-Response")
+)
+
+// MSCHAPResult is the outcome of the MS-CHAP verification
+type MSCHAPResult struct {
+	Version       int    // 1 for MS-CHAP, 2 for MS-CHAPv2
+	Authenticated bool   // true if the response matched the password
+	AVPs          []*AVP // MS-CHAP2-Success and MS-MPPE keys or MS-CHAP-Error, to be added to the reply
+	SendKey       []byte // MS-MPPE-Send-Key, populated on MS-CHAPv2 success
+	RecvKey       []byte // MS-MPPE-Recv-Key, populated on MS-CHAPv2 success
+}
+
+// NTPasswordHash returns the NT hash of the cleartext password, rfc2759 8.3
+func NTPasswordHash(password string) ([]byte, error) {
+	ucs2Password, err := ToUTF16(password)
+	if err != nil {
+		return nil, err
+	}
+	return HashPassword(ucs2Password), nil
+}
+
+// msVSAValue returns the raw value of the first Microsoft VSA with attrNr, without the need of dictionary
+func (p *Packet) msVSAValue(attrNr uint8) []byte {
+	for _, avp := range p.AVPs {
+		if avp.Number == VendorSpecificNumber && len(avp.RawValue) >= 6 &&
+			binary.BigEndian.Uint32(avp.RawValue[0:4]) == MicrosoftVendor &&
+			avp.RawValue[4] == attrNr {
+			return avp.RawValue[6:]
+		}
+	}
+	return nil
+}
+
+// msVSA builds the AVP of a Microsoft VSA out of it's raw value
+func msVSA(attrNr uint8, rawVal []byte) *AVP {
+	return (&VSA{Vendor: MicrosoftVendor, Number: attrNr, RawValue: rawVal}).AVP()
+}
+
+// VerifyMSCHAP authenticates the MS-CHAP or MS-CHAPv2 request against the cleartext password
+func (p *Packet) VerifyMSCHAP(password string) (*MSCHAPResult, error) {
+	passwordHash, err := NTPasswordHash(password)
+	if err != nil {
+		return nil, err
+	}
+	return p.VerifyMSCHAPWithHash(passwordHash)
+}
+
+// VerifyMSCHAPWithHash authenticates the MS-CHAP or MS-CHAPv2 request against the NT hash of the password
+// errors are returned only for malformed requests, failed authentication is reported in the result
+func (p *Packet) VerifyMSCHAPWithHash(passwordHash []byte) (*MSCHAPResult, error) {
+	p.RLock()
+	defer p.RUnlock()
+	challenge := p.msVSAValue(MSCHAPChallengeNumber)
+	if challenge == nil {
+		return nil, ErrMSCHAPChallengeMissing
+	}
+	if resp := p.msVSAValue(MSCHAP2ResponseNumber); resp != nil {
+		return p.verifyMSCHAPv2(challenge, resp, passwordHash)
+	}
+	if resp := p.msVSAValue(MSCHAPResponseNumber); resp != nil {
+		return verifyMSCHAPv1(challenge, resp, passwordHash)
+	}
+	return nil, ErrMSCHAPResponseMissing
+}
+
+// verifyMSCHAPv2 checks the MS-CHAP2-Response, rfc2548 2.3.2
+// Ident(1) + Flags(1) + Peer-Challenge(16) + Reserved(8) + Response(24)
+func (p *Packet) verifyMSCHAPv2(challenge, resp, passwordHash []byte) (*MSCHAPResult, error) {
+	if len(challenge) != 16 {
+		return nil, fmt.Errorf("invalid MS-CHAP-Challenge length: %d", len(challenge))
+	}
+	if len(resp) != 50 {
+		return nil, fmt.Errorf("invalid MS-CHAP2-Response length: %d", len(resp))
+	}
+	ident, peerChallenge, ntResponse := resp[0], resp[2:18], resp[26:50]
+	var userName string
+	for _, avp := range p.AVPs {
+		if avp.Number == 1 { // User-Name
+			userName = string(avp.RawValue)
+			break
+		}
+	}
+	if idx := strings.LastIndexByte(userName, '\\'); idx != -1 { // challenge is computed without the NT domain
+		userName = userName[idx+1:]
+	}
+	res := &MSCHAPResult{Version: 2}
+	expResp := ChallengeResponse(ChallengeHash(peerChallenge, challenge, userName), passwordHash)
+	if subtle.ConstantTimeCompare(expResp, ntResponse) != 1 {
+		res.AVPs = []*AVP{msVSA(MSCHAPErrorNumber, msCHAPError(ident, 16, "V=3 M=Authentication failed"))}
+		return res, nil
+	}
+	res.Authenticated = true
+	authResp := generateAuthenticatorResponseWithHash(challenge, peerChallenge, ntResponse, userName, passwordHash)
+	res.SendKey, res.RecvKey = GenerateMPPEKeys(passwordHash, ntResponse)
+	res.AVPs = []*AVP{
+		msVSA(MSCHAP2SuccessNumber, append([]byte{ident}, authResp...)),
+		msVSA(MSMPPESendKeyNumber, res.SendKey),
+		msVSA(MSMPPERecvKeyNumber, res.RecvKey),
+	}
+	return res, nil
+}
+
+// verifyMSCHAPv1 checks the NT-Response out of MS-CHAP-Response, rfc2548 2.1.3
+// Ident(1) + Flags(1) + LM-Response(24) + NT-Response(24)
+func verifyMSCHAPv1(challenge, resp, passwordHash []byte) (*MSCHAPResult, error) {
+	if len(challenge) != 8 {
+		return nil, fmt.Errorf("invalid MS-CHAP-Challenge length: %d", len(challenge))
+	}
+	if len(resp) != 50 {
+		return nil, fmt.Errorf("invalid MS-CHAP-Response length: %d", len(resp))
+	}
+	if resp[1]&0x01 == 0 { // LM-Response only
+		return nil, errors.New("unsupported MS-CHAP LM-Response")
+	}
+	res := &MSCHAPResult{Version: 1}
+	if subtle.ConstantTimeCompare(ChallengeResponse(challenge, passwordHash), resp[26:50]) != 1 {
+		res.AVPs = []*AVP{msVSA(MSCHAPErrorNumber, msCHAPError(resp[0], 8, "V=2"))}
+		return res, nil
+	}
+	res.Authenticated = true
+	return res, nil
+}
+
+// msCHAPError composes the MS-CHAP-Error value with a new challenge for retries, rfc2759 6
+// Ident(1) + "E=eeeeeeeeee R=r C=cccccccccccccccccccccccccccccccc V=vvvvvvvvvv M=<msg>"
+func msCHAPError(ident uint8, challengeLen int, suffix string) []byte {
+	challenge := make([]byte, challengeLen)
+	rand.Read(challenge)
+	return append([]byte{ident},
+		fmt.Sprintf("E=%d R=0 C=%X %s", MSCHAPAuthFailure, challenge, suffix)...)
+}
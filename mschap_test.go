@@ -0,0 +1,115 @@
+package radigo
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+)
+
+func testMSCHAPRequest(userName string, vsas ...*AVP) *Packet {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.AVPs = append(req.AVPs, &AVP{Number: 1, RawValue: []byte(userName)})
+	req.AVPs = append(req.AVPs, vsas...)
+	return req
+}
+
+func TestMSCHAPVerifyMSCHAPv2(t *testing.T) {
+	challenge := [16]byte{0x5B, 0x5D, 0x7C, 0x7D, 0x7B, 0x3F, 0x2F, 0x3E, 0x3C, 0x2C, 0x60, 0x21,
+		0x32, 0x26, 0x26, 0x28}
+	resp, err := GenerateClientMSCHAPResponse(challenge, "cgrates", "CGRateSPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := testMSCHAPRequest(`CGRATES\cgrates`, msVSA(MSCHAPChallengeNumber, challenge[:]),
+		msVSA(MSCHAP2ResponseNumber, resp))
+	res, err := req.VerifyMSCHAP("CGRateSPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Authenticated || res.Version != 2 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if len(res.AVPs) != 3 {
+		t.Fatalf("unexpected AVPs: %+v", res.AVPs)
+	}
+	authResp, err := GenerateAuthenticatorResponse(challenge[:], resp[2:18], resp[26:50], "cgrates", "CGRateSPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eSuccess := append([]byte{resp[0]}, authResp...)
+	if rcv := res.AVPs[0].RawValue[6:]; !bytes.Equal(eSuccess, rcv) {
+		t.Errorf("\nExpected: <%q>, \nReceived: <%q>", eSuccess, rcv)
+	}
+	rply := req.Reply()
+	rply.Code = AccessAccept
+	rply.AVPs = append(rply.AVPs, res.AVPs...)
+	if sendKey, recvKey := rply.MPPEKeys(); !bytes.Equal(sendKey, res.SendKey) || !bytes.Equal(recvKey, res.RecvKey) {
+		t.Errorf("unexpected MPPE keys: %+v, %+v", sendKey, recvKey)
+	}
+	if res, err = req.VerifyMSCHAP("WrongPassword"); err != nil {
+		t.Fatal(err)
+	}
+	if res.Authenticated || len(res.AVPs) != 1 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	eErr := regexp.MustCompile(`^E=691 R=0 C=[0-9A-F]{32} V=3 M=Authentication failed$`)
+	if rcv := res.AVPs[0].RawValue; rcv[4] != MSCHAPErrorNumber || rcv[6] != resp[0] ||
+		!eErr.Match(rcv[7:]) {
+		t.Errorf("unexpected MS-CHAP-Error: %q", rcv)
+	}
+}
+
+func TestMSCHAPVerifyMSCHAPv1(t *testing.T) {
+	challenge := []byte{0x10, 0x2D, 0xB5, 0xDF, 0x08, 0x5D, 0x30, 0x41}
+	passwordHash, err := NTPasswordHash("CGRateSPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 50)
+	resp[0], resp[1] = 7, 1
+	copy(resp[26:], ChallengeResponse(challenge, passwordHash))
+	req := testMSCHAPRequest("cgrates", msVSA(MSCHAPChallengeNumber, challenge),
+		msVSA(MSCHAPResponseNumber, resp))
+	if res, err := req.VerifyMSCHAPWithHash(passwordHash); err != nil {
+		t.Error(err)
+	} else if !res.Authenticated || res.Version != 1 || len(res.AVPs) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	res, err := req.VerifyMSCHAP("WrongPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eErr := regexp.MustCompile(`^\x07E=691 R=0 C=[0-9A-F]{16} V=2$`)
+	if res.Authenticated || len(res.AVPs) != 1 || !eErr.Match(res.AVPs[0].RawValue[6:]) {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	resp[1] = 0
+	req = testMSCHAPRequest("cgrates", msVSA(MSCHAPChallengeNumber, challenge),
+		msVSA(MSCHAPResponseNumber, resp))
+	if _, err := req.VerifyMSCHAPWithHash(passwordHash); err == nil {
+		t.Error("expecting error for LM-Response")
+	}
+}
+
+func TestMSCHAPVerifyMSCHAPErrors(t *testing.T) {
+	req := testMSCHAPRequest("cgrates")
+	if _, err := req.VerifyMSCHAP("CGRateSPassword"); err != ErrMSCHAPChallengeMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrMSCHAPChallengeMissing, err)
+	}
+	req = testMSCHAPRequest("cgrates", msVSA(MSCHAPChallengeNumber, make([]byte, 16)))
+	if _, err := req.VerifyMSCHAP("CGRateSPassword"); err != ErrMSCHAPResponseMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrMSCHAPResponseMissing, err)
+	}
+	req = testMSCHAPRequest("cgrates", msVSA(MSCHAPChallengeNumber, make([]byte, 8)),
+		msVSA(MSCHAP2ResponseNumber, make([]byte, 50)))
+	experr := "invalid MS-CHAP-Challenge length: 8"
+	if _, err := req.VerifyMSCHAP("CGRateSPassword"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	req = testMSCHAPRequest("cgrates", msVSA(MSCHAPChallengeNumber, make([]byte, 16)),
+		msVSA(MSCHAP2ResponseNumber, make([]byte, 49)))
+	experr = "invalid MS-CHAP2-Response length: 49"
+	if _, err := req.VerifyMSCHAP("CGRateSPassword"); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
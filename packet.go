@@ -2,6 +2,7 @@ package radigo
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"encoding/binary"
 	"errors"
@@ -18,7 +19,7 @@ const (
 	AccountingRequest    PacketCode = 4
 	AccountingResponse   PacketCode = 5
 	AccessChallenge      PacketCode = 11
-	StatusServer         PacketCode = 12 //(experimental)
+	StatusServer         PacketCode = 12 // rfc5997
 	StatusClient         PacketCode = 13 //(experimental)
 	DisconnectRequest    PacketCode = 40
 	DisconnectACK        PacketCode = 41
@@ -33,16 +34,27 @@ const (
 	NoVendor                        = 0
 )
 
+const (
+	UserPasswordNumber         = 2  // User-Password AVP number, always encrypted, rfc2865 5.2
+	MessageAuthenticatorNumber = 80 // Message-Authenticator AVP number, rfc2869 5.14
+	// Microsoft VSAs, rfc2548
+	MicrosoftVendor     = 311
+	MSMPPESendKeyNumber = 16
+	MSMPPERecvKeyNumber = 17
+)
+
 var (
-	ErrNotImplemented = errors.New("not implemented")
+	ErrNotImplemented              = errors.New("not implemented")
+	ErrMessageAuthenticatorMissing = errors.New("missing Message-Authenticator")
+	ErrInvalidMessageAuthenticator = errors.New("invalid Message-Authenticator")
 )
 
 // computeAuthenticator computes the authenticator based on packet code, raw data, and secret.
 func computeAuthenticator(raw []byte, secret string) (acator [16]byte) {
 	pCode := PacketCode(raw[0])
 	switch pCode {
-	case AccessRequest:
-		// For AccessRequest, use the authenticator provided in the request.
+	case AccessRequest, StatusServer:
+		// For AccessRequest and StatusServer, use the authenticator provided in the request.
 		copy(acator[:], raw[4:20])
 
 	case AccessAccept, AccessReject, AccessChallenge, AccountingRequest, AccountingResponse, DisconnectRequest, DisconnectACK, DisconnectNAK, CoARequest, CoAACK, CoANAK:
@@ -62,6 +74,63 @@ func computeAuthenticator(raw []byte, secret string) (acator [16]byte) {
 	return
 }
 
+// msgAuthAcator returns the authenticator used when computing the Message-Authenticator of a request
+// AccountingRequest, DisconnectRequest and CoARequest are signed with a null authenticator (rfc5176 3.1)
+func msgAuthAcator(rawReq []byte) (acator [16]byte) {
+	switch PacketCode(rawReq[0]) {
+	case AccountingRequest, DisconnectRequest, CoARequest:
+	default:
+		copy(acator[:], rawReq[4:20])
+	}
+	return
+}
+
+// msgAuthOffset returns the offset of the Message-Authenticator value inside the raw packet
+// returns -1 if the attribute is not present
+func msgAuthOffset(rawPkt []byte) int {
+	for i := 20; i+2 <= len(rawPkt); {
+		length := int(rawPkt[i+1])
+		if length < 2 || i+length > len(rawPkt) {
+			return -1
+		}
+		if rawPkt[i] == MessageAuthenticatorNumber && length == 18 {
+			return i + 2
+		}
+		i += length
+	}
+	return -1
+}
+
+// computeMessageAuthenticator computes the HMAC-MD5 of the raw packet, rfc3579 3.2
+// the Authenticator field is replaced with acator and the value at maOffset is zeroed for the computation
+func computeMessageAuthenticator(rawPkt []byte, secret string, acator [16]byte, maOffset int) []byte {
+	raw := make([]byte, len(rawPkt))
+	copy(raw, rawPkt)
+	copy(raw[4:20], acator[:])
+	copy(raw[maOffset:maOffset+16], make([]byte, 16))
+	hash := hmac.New(md5.New, []byte(secret))
+	hash.Write(raw)
+	return hash.Sum(nil)
+}
+
+// checkMessageAuthenticator verifies the Message-Authenticator inside rawPkt
+// acator is the authenticator used for signing (the request one for replies)
+// returns ErrMessageAuthenticatorMissing only if the attribute is required
+func checkMessageAuthenticator(rawPkt []byte, secret string, acator [16]byte, required bool) error {
+	maOffset := msgAuthOffset(rawPkt)
+	if maOffset == -1 {
+		if required {
+			return ErrMessageAuthenticatorMissing
+		}
+		return nil
+	}
+	if !hmac.Equal(rawPkt[maOffset:maOffset+16],
+		computeMessageAuthenticator(rawPkt, secret, acator, maOffset)) {
+		return ErrInvalidMessageAuthenticator
+	}
+	return nil
+}
+
 // IsAuthentic should be called by client to make sure the reply is authentic
 // reqAuthenticator is the original request authenticator to be matched against
 func isAuthentic(rawPkt []byte, secret string, reqAuthenticator [16]byte) bool {
@@ -140,6 +209,7 @@ type Packet struct {
 	Authenticator [16]byte
 	AVPs          []*AVP
 	addr          net.Addr
+	hidden        map[*AVP]uint8 // encryption methods enforced independent of dictionary (ie: proxied AVPs)
 }
 
 // Encode is used to encode the Packet into buffer b returning number of bytes written or error
@@ -151,13 +221,28 @@ func (p *Packet) Encode(b []byte) (n int, err error) {
 	copy(b[4:20], p.Authenticator[:])
 	written := 20
 	bb := b[20:]
+	maOffset := -1
+	var maAVP *AVP
 	for _, avp := range p.AVPs {
+		if avp.Number == MessageAuthenticatorNumber { // will be signed after all the AVPs are written
+			avp.RawValue = make([]byte, 16)
+			maOffset = written + 2
+			maAVP = avp
+		}
 		if avp.RawValue == nil { // Need to encode concrete into raw
 			if err := avp.SetRawValue(p.dict, p.coder); err != nil {
 				return 0, err
 			}
 		}
-		n, err = avp.Encode(bb)
+		wAVP, err := p.encryptAVP(avp) // RawValue of the original AVP stays in clear
+		if err != nil {
+			return written, err
+		}
+		if p.isConcat(wAVP) {
+			n, err = wAVP.encodeConcat(bb)
+		} else {
+			n, err = wAVP.Encode(bb)
+		}
 		written += n
 		if err != nil {
 			return written, err
@@ -165,6 +250,11 @@ func (p *Packet) Encode(b []byte) (n int, err error) {
 		bb = bb[n:]
 	}
 	binary.BigEndian.PutUint16(b[2:4], uint16(written))
+	if maAVP != nil {
+		maAVP.RawValue = computeMessageAuthenticator(b[:written], p.secret,
+			msgAuthAcator(b[:written]), maOffset)
+		copy(b[maOffset:maOffset+16], maAVP.RawValue)
+	}
 	p.Authenticator = computeAuthenticator(b[:written], p.secret)
 	copy(b[4:20], p.Authenticator[:])
 	return written, err
@@ -182,9 +272,18 @@ func (p *Packet) Decode(buf []byte) error {
 		avp := new(AVP)
 		avp.Number = b[0]
 		length := uint8(b[1])
-		if int(length) > len(b) {
+		if int(length) > len(b) || length < 2 {
 			return errors.New("invalid length")
 		}
+		if isExtendedNumber(avp.Number) {
+			n, err := avp.decodeExtended(b)
+			if err != nil {
+				return err
+			}
+			p.AVPs = append(p.AVPs, avp)
+			b = b[n:]
+			continue
+		}
 		avp.RawValue = append(avp.RawValue, b[2:length]...)
 		if validation, has := validation[avp.Number]; has {
 			if err := validation.Validate(p, avp); err != nil {
@@ -194,20 +293,208 @@ func (p *Packet) Decode(buf []byte) error {
 		p.AVPs = append(p.AVPs, avp)
 		b = b[length:]
 	}
+	p.concatAVPs()
+	switch p.Code { // replies are decrypted with the authenticator of their request
+	case AccessRequest, AccountingRequest, DisconnectRequest, CoARequest:
+		return p.decryptAVPs(p.hidingAuthenticator())
+	}
+	return nil
+}
+
+// rawDictAttribute returns the dictionary data for the AVP based on it's raw value
+// together with the offset of the attribute value inside the raw value
+func (p *Packet) rawDictAttribute(avp *AVP) (da *DictionaryAttribute, valOffset int) {
+	switch {
+	case avp.Number == VendorSpecificNumber:
+		if len(avp.RawValue) < 6 {
+			return
+		}
+		valOffset = 6
+		if p.dict != nil {
+			da = p.dict.AttributeWithNumber(avp.RawValue[4], binary.BigEndian.Uint32(avp.RawValue[0:4]))
+		}
+	case avp.isEVS():
+		if len(avp.RawValue) < 5 {
+			return
+		}
+		valOffset = 5
+		if p.dict != nil {
+			da = p.dict.AttributeWithExtendedNumber(avp.Number, avp.RawValue[4],
+				binary.BigEndian.Uint32(avp.RawValue[0:4]))
+		}
+	case p.dict == nil:
+	case isExtendedNumber(avp.Number):
+		da = p.dict.AttributeWithExtendedNumber(avp.Number, avp.ExtendedType, NoVendor)
+	default:
+		da = p.dict.AttributeWithNumber(avp.Number, NoVendor)
+	}
+	return
+}
+
+// encryptMethod returns the method hiding the AVP value, out of dictionary
+// MS-MPPE keys are always encrypted, rfc2548 2.4.2
+func encryptMethod(avp *AVP, da *DictionaryAttribute) uint8 {
+	if da != nil && da.Encrypt != 0 {
+		return da.Encrypt
+	}
+	if isMPPEKey(avp) {
+		return TunnelPasswordEncrypt
+	}
+	return 0
+}
+
+// isMPPEKey returns true for the MS-MPPE-Send-Key and MS-MPPE-Recv-Key VSAs
+func isMPPEKey(avp *AVP) bool {
+	return avp.Number == VendorSpecificNumber && len(avp.RawValue) >= 6 &&
+		binary.BigEndian.Uint32(avp.RawValue[0:4]) == MicrosoftVendor &&
+		(avp.RawValue[4] == MSMPPESendKeyNumber || avp.RawValue[4] == MSMPPERecvKeyNumber)
+}
+
+// isConcat checks in dictionary if the AVP value can be split over consecutive attributes
+func (p *Packet) isConcat(avp *AVP) bool {
+	if isExtendedNumber(avp.Number) {
+		return false
+	}
+	da, _ := p.rawDictAttribute(avp)
+	return da != nil && da.Concat
+}
+
+// hidingAuthenticator returns the authenticator used to hide the AVP values
+// requests with the Authenticator computed out of the packet itself use zeros, rfc5176 3.6
+func (p *Packet) hidingAuthenticator() (acator [16]byte) {
+	switch p.Code {
+	case AccountingRequest, DisconnectRequest, CoARequest:
+		return
+	}
+	return p.Authenticator
+}
+
+// encryptAVP returns a copy of the AVP with the value encrypted based on dictionary encrypt flag
+// the AVP is returned unchanged if no encryption is needed
+func (p *Packet) encryptAVP(avp *AVP) (*AVP, error) {
+	da, valOffset := p.rawDictAttribute(avp)
+	method := p.hiddenMethod(avp, da)
+	if method == 0 {
+		method = p.hidden[avp]
+	}
+	if method == 0 {
+		return avp, nil
+	}
+	if da != nil && da.HasTag { // tag is not encrypted
+		valOffset++
+	}
+	if len(avp.RawValue) < valOffset {
+		return nil, fmt.Errorf("invalid value for encrypted avp: %+v", avp)
+	}
+	enc, err := encryptValue(method, avp.RawValue[valOffset:], p.secret, p.hidingAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+	encAVP := &AVP{Number: avp.Number, ExtendedType: avp.ExtendedType,
+		RawValue: append(append([]byte{}, avp.RawValue[:valOffset]...), enc...)}
+	if avp.Number == VendorSpecificNumber {
+		encAVP.RawValue[5] = uint8(len(encAVP.RawValue) - 4)
+	}
+	return encAVP, nil
+}
+
+// hiddenMethod returns the method hiding the AVP value on the wire
+// User-Password is always encrypted, rfc2865 5.2
+func (p *Packet) hiddenMethod(avp *AVP, da *DictionaryAttribute) uint8 {
+	method := encryptMethod(avp, da)
+	if method == 0 && avp.Number == UserPasswordNumber {
+		method = UserPasswordEncrypt
+	}
+	return method
+}
+
+// decryptAVPs decrypts the values of the AVPs based on dictionary encrypt flag
+// acator is the authenticator of the request
+func (p *Packet) decryptAVPs(acator [16]byte) error {
+	for _, avp := range p.AVPs {
+		da, valOffset := p.rawDictAttribute(avp)
+		method := p.hiddenMethod(avp, da)
+		if method == 0 {
+			continue
+		}
+		if len(p.secret) == 0 {
+			return errors.New("empty secret")
+		}
+		if da != nil && da.HasTag {
+			valOffset++
+		}
+		if len(avp.RawValue) < valOffset {
+			return fmt.Errorf("invalid value for encrypted avp: %+v", avp)
+		}
+		dec, err := decryptValue(method, avp.RawValue[valOffset:], p.secret, acator)
+		if err != nil {
+			return err
+		}
+		avp.RawValue = append(avp.RawValue[:valOffset], dec...)
+		if avp.Number == VendorSpecificNumber {
+			avp.RawValue[5] = uint8(len(avp.RawValue) - 4)
+		}
+	}
 	return nil
 }
 
+// concatAVPs joins the consecutive instances of the concat attributes into one AVP
+func (p *Packet) concatAVPs() {
+	if len(p.AVPs) < 2 {
+		return
+	}
+	avps := p.AVPs[:1]
+	for _, avp := range p.AVPs[1:] {
+		prev := avps[len(avps)-1]
+		if prev.Number != avp.Number || !p.isConcat(avp) {
+			avps = append(avps, avp)
+			continue
+		}
+		if avp.Number != VendorSpecificNumber {
+			prev.RawValue = append(prev.RawValue, avp.RawValue...)
+			continue
+		}
+		if len(prev.RawValue) < 6 || len(avp.RawValue) < 6 ||
+			!bytes.Equal(prev.RawValue[:5], avp.RawValue[:5]) { // different vendor or type
+			avps = append(avps, avp)
+			continue
+		}
+		prev.RawValue = append(prev.RawValue, avp.RawValue[6:]...)
+		if vsaLen := len(prev.RawValue) - 4; vsaLen <= 255 {
+			prev.RawValue[5] = uint8(vsaLen)
+		}
+	}
+	p.AVPs = avps
+}
+
+// Reply creates the reply packet for a request
+// the Message-Authenticator is added automatically if the request contains one
 func (p *Packet) Reply() *Packet {
-	return &Packet{
+	rply := &Packet{
 		dict:          p.dict,
 		secret:        p.secret,
 		coder:         p.coder,
 		Identifier:    p.Identifier,
 		Authenticator: p.Authenticator,
 	}
+	if p.Has(MessageAuthenticatorNumber) {
+		rply.AddMessageAuthenticator()
+	}
+	return rply
+}
+
+// AddMessageAuthenticator adds a zeroed Message-Authenticator to the packet
+// the value will be computed on Encode
+func (p *Packet) AddMessageAuthenticator() {
+	if p.Has(MessageAuthenticatorNumber) {
+		return
+	}
+	p.AVPs = append(p.AVPs, &AVP{Number: MessageAuthenticatorNumber,
+		RawValue: make([]byte, 16)})
 }
 
 // NegativeReply generates a response packet indicating a failure or rejection based on the original request.
+// Returns nil for the requests without a negative reply, which should be discarded.
 func (p *Packet) NegativeReply(errMsg string) *Packet {
 	rply := p.Reply() // Create a reply packet based on the original request.
 
@@ -224,9 +511,12 @@ func (p *Packet) NegativeReply(errMsg string) *Packet {
 		rply.Code = CoANAK
 	case DisconnectRequest:
 		rply.Code = DisconnectNAK
+	case StatusServer:
+		// Status-Server is always answered positively, rfc5997 3.
+		rply.Code = AccessAccept
 	default:
-		// If the request type is not handled, return the original reply.
-		return rply
+		// No negative reply defined for the request type.
+		return nil
 	}
 
 	// Add the error message to the Reply-Message attribute.
@@ -316,12 +606,60 @@ func (p *Packet) AttributesWithNumber(attrNr uint8, vendorCode uint32) (avps []*
 	return
 }
 
-// Attributes queries AVPs matching the attrNr
+// AttributesWithExtendedNumber queries the rfc6929 extended AVPs nested into extNr
+// if vendorCode is defined, AttributesWithExtendedNumber will query the extended VSAs
+func (p *Packet) AttributesWithExtendedNumber(extNr, attrNr uint8, vendorCode uint32) (avps []*AVP) {
+	p.RLock()
+	defer p.RUnlock()
+	qryNr := attrNr
+	if vendorCode != NoVendor {
+		qryNr = VendorSpecificNumber
+	}
+	for _, avp := range p.AVPs {
+		if avp.Number != extNr || avp.ExtendedType != qryNr {
+			continue
+		}
+		if err := avp.SetValue(p.dict, p.coder); err != nil {
+			log.Printf("failed setting value for avp: %+v, err: %s\n", avp, err.Error())
+			continue
+		}
+		if vendorCode != NoVendor {
+			if vsa, ok := avp.Value.(*VSA); !ok {
+				log.Printf("failed converting VSA value for AVP: %+v\n", avp)
+				continue
+			} else if vsa.Vendor != vendorCode || vsa.Number != attrNr {
+				continue
+			}
+		}
+		avps = append(avps, avp)
+	}
+	return
+}
+
+// Attributes queries AVPs matching the attrName
+// tagged attributes can be filtered using the "Tunnel-Type:1" format of the attrName
 func (p *Packet) AttributesWithName(attrName, vendorName string) (avps []*AVP) {
+	attrName, tag, tagged, err := parseTaggedName(attrName)
+	if err != nil {
+		return
+	}
 	da := p.dict.AttributeWithName(attrName, vendorName)
 	if da == nil {
 		return
 	}
+	if tagged {
+		for _, avp := range p.attributesWithDict(da, vendorName) {
+			if avp.tag() == tag {
+				avps = append(avps, avp)
+			}
+		}
+		return
+	}
+	return p.attributesWithDict(da, vendorName)
+}
+
+// attributesWithDict queries AVPs matching the dictionary attribute
+func (p *Packet) attributesWithDict(da *DictionaryAttribute, vendorName string) (avps []*AVP) {
 	var vc uint32
 	if vendorName != "" {
 		if dv := p.dict.VendorWithName(vendorName); dv == nil {
@@ -330,6 +668,9 @@ func (p *Packet) AttributesWithName(attrName, vendorName string) (avps []*AVP) {
 			vc = dv.VendorNumber
 		}
 	}
+	if da.ExtendedNumber != 0 {
+		return p.AttributesWithExtendedNumber(da.ExtendedNumber, da.AttributeNumber, vc)
+	}
 	return p.AttributesWithNumber(da.AttributeNumber, vc)
 }
 
@@ -369,7 +710,12 @@ func (p *Packet) AddAVPWithNumber(attrNr uint8, val interface{}, vendorCode uint
 }
 
 // AddAVPWithName adds an AVP based on it's attribute name and string value
+// tagged attributes can be added using the "Tunnel-Type:1" format of the attrName
 func (p *Packet) AddAVPWithName(attrName, strVal, vendorName string) (err error) {
+	attrName, tag, tagged, err := parseTaggedName(attrName)
+	if err != nil {
+		return
+	}
 	d := p.dict.AttributeWithName(attrName, vendorName)
 	if d == nil {
 		errStr := fmt.Sprintf("DICTIONARY_NOT_FOUND, attributeName: <%s>", attrName)
@@ -378,6 +724,9 @@ func (p *Packet) AddAVPWithName(attrName, strVal, vendorName string) (err error)
 		}
 		return errors.New(errStr)
 	}
+	if tagged && !d.HasTag {
+		return fmt.Errorf("attribute <%s> is not tagged", attrName)
+	}
 	var avp *AVP
 	if vendorName == "" {
 		avp = &AVP{
@@ -385,19 +734,32 @@ func (p *Packet) AddAVPWithName(attrName, strVal, vendorName string) (err error)
 			Name:        attrName,
 			Type:        d.AttributeType,
 			StringValue: strVal,
+			Tag:         tag,
+		}
+		if d.ExtendedNumber != 0 {
+			avp.Number, avp.ExtendedType = d.ExtendedNumber, d.AttributeNumber
 		}
 	} else {
+		vsa := &VSA{
+			VendorName:     vendorName,
+			Number:         d.AttributeNumber,
+			ExtendedNumber: d.ExtendedNumber,
+			Name:           attrName,
+			Type:           d.AttributeType,
+			StringValue:    strVal,
+			Tag:            tag,
+		}
+		if dv := p.dict.VendorWithName(vendorName); dv != nil {
+			vsa.Vendor = dv.VendorNumber
+		}
 		avp = &AVP{
 			Number: VendorSpecificNumber,
 			Name:   VendorSpecificName,
 			Type:   StringValue,
-			Value: &VSA{
-				VendorName:  vendorName,
-				Number:      d.AttributeNumber,
-				Name:        attrName,
-				Type:        d.AttributeType,
-				StringValue: strVal,
-			},
+			Value:  vsa,
+		}
+		if d.ExtendedNumber != 0 {
+			avp.Number, avp.ExtendedType = d.ExtendedNumber, VendorSpecificNumber
 		}
 	}
 	if err = avp.SetRawValue(p.dict, p.coder); err != nil {
@@ -407,6 +769,31 @@ func (p *Packet) AddAVPWithName(attrName, strVal, vendorName string) (err error)
 	return
 }
 
+// AddMPPEKeys adds the MS-MPPE-Send-Key and MS-MPPE-Recv-Key VSAs
+// the keys are encrypted with the secret and request authenticator on Encode, rfc2548 2.4.2
+func (p *Packet) AddMPPEKeys(sendKey, recvKey []byte) {
+	p.Lock()
+	defer p.Unlock()
+	p.AVPs = append(p.AVPs, msVSA(MSMPPESendKeyNumber, sendKey), msVSA(MSMPPERecvKeyNumber, recvKey))
+}
+
+// MPPEKeys returns the decrypted MS-MPPE-Send-Key and MS-MPPE-Recv-Key out of packet
+func (p *Packet) MPPEKeys() (sendKey, recvKey []byte) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, avp := range p.AVPs {
+		if !isMPPEKey(avp) {
+			continue
+		}
+		if avp.RawValue[4] == MSMPPESendKeyNumber {
+			sendKey = avp.RawValue[6:]
+		} else {
+			recvKey = avp.RawValue[6:]
+		}
+	}
+	return
+}
+
 func (pk *Packet) RemoteAddr() net.Addr {
 	return pk.addr
 }
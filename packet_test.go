@@ -2,6 +2,8 @@ package radigo
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
 	"fmt"
 	"log"
 	"net"
@@ -369,6 +371,19 @@ func TestPacketNegativeReplyAccounting(t *testing.T) {
 	}
 }
 
+func TestPacketNegativeReplyStatusServer(t *testing.T) {
+	p := &Packet{
+		Code: StatusServer,
+	}
+	if rcv := p.NegativeReply("testError"); rcv == nil || rcv.Code != AccessAccept {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AccessAccept, rcv)
+	}
+	p.Code = AccountingResponse
+	if rcv := p.NegativeReply("testError"); rcv != nil {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, rcv)
+	}
+}
+
 func TestPacketSetAVPValuesFailSet(t *testing.T) {
 	p := &Packet{
 		dict:  &Dictionary{},
@@ -834,3 +849,521 @@ func TestPacketAttributesWithNumber3(t *testing.T) {
 		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", nil, rcv)
 	}
 }
+
+func TestPacketEncodeMessageAuthenticator(t *testing.T) {
+	pkt := &Packet{
+		secret:     "CGRateS.org",
+		Code:       AccessRequest,
+		Identifier: 1,
+		Authenticator: [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+			0x0d, 0x33, 0x67, 0xa2},
+		AVPs: []*AVP{
+			{
+				Number:   1,                                          // User-Name
+				RawValue: []byte{0x66, 0x6c, 0x6f, 0x70, 0x73, 0x79}, // flopsy
+			},
+		},
+	}
+	pkt.AddMessageAuthenticator()
+	pkt.AddMessageAuthenticator() // second call should not duplicate
+	if len(pkt.AVPs) != 2 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 2, len(pkt.AVPs))
+	}
+	var buf [4096]byte
+	n, err := pkt.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 46 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 46, n)
+	}
+	raw := make([]byte, n)
+	copy(raw, buf[:n])
+	copy(raw[30:46], make([]byte, 16))
+	hash := hmac.New(md5.New, []byte("CGRateS.org"))
+	hash.Write(raw)
+	if exp := hash.Sum(nil); !bytes.Equal(exp, buf[30:46]) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", exp, buf[30:46])
+	}
+	if !bytes.Equal(pkt.AVPs[1].RawValue, buf[30:46]) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", buf[30:46], pkt.AVPs[1].RawValue)
+	}
+	if err := checkMessageAuthenticator(buf[:n], "CGRateS.org", msgAuthAcator(buf[:n]), true); err != nil {
+		t.Error(err)
+	}
+	if err := checkMessageAuthenticator(buf[:n], "wrongSecret",
+		msgAuthAcator(buf[:n]), true); err != ErrInvalidMessageAuthenticator {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrInvalidMessageAuthenticator, err)
+	}
+}
+
+func TestPacketEncodeMessageAuthenticatorReply(t *testing.T) {
+	req := &Packet{
+		secret:     "CGRateS.org",
+		Code:       AccountingRequest,
+		Identifier: 2,
+		AVPs: []*AVP{
+			{
+				Number:   1,                                          // User-Name
+				RawValue: []byte{0x66, 0x6c, 0x6f, 0x70, 0x73, 0x79}, // flopsy
+			},
+		},
+	}
+	req.AddMessageAuthenticator()
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageAuthenticator(buf[:n], "CGRateS.org", msgAuthAcator(buf[:n]), true); err != nil {
+		t.Error(err)
+	}
+	if !isAuthenticReq(buf[:n], []byte("CGRateS.org")) {
+		t.Error("request not authentic")
+	}
+	rply := req.Reply()
+	rply.Code = AccountingResponse
+	if !rply.Has(MessageAuthenticatorNumber) {
+		t.Fatalf("reply without Message-Authenticator: %+v", rply.AVPs)
+	}
+	var rplyBuf [4096]byte
+	if n, err = rply.Encode(rplyBuf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMessageAuthenticator(rplyBuf[:n], "CGRateS.org", req.Authenticator, true); err != nil {
+		t.Error(err)
+	}
+	if !isAuthentic(rplyBuf[:n], "CGRateS.org", req.Authenticator) {
+		t.Error("reply not authentic")
+	}
+}
+
+func TestPacketcheckMessageAuthenticatorMissing(t *testing.T) {
+	raw := []byte{
+		0x01, 0x01, 0x00, 0x1a, 0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2, 0x01, 0x08, 0x66, 0x6c, 0x6f, 0x70, 0x73, 0x79,
+	}
+	if err := checkMessageAuthenticator(raw, "CGRateS.org", msgAuthAcator(raw), false); err != nil {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, err)
+	}
+	if err := checkMessageAuthenticator(raw, "CGRateS.org",
+		msgAuthAcator(raw), true); err != ErrMessageAuthenticatorMissing {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrMessageAuthenticatorMissing, err)
+	}
+}
+
+func TestPacketmsgAuthOffsetInvalidLength(t *testing.T) {
+	raw := []byte{
+		0x01, 0x01, 0x00, 0x1a, 0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2, 0x01, 0x01, 0x50, 0x12,
+	}
+	if rcv := msgAuthOffset(raw); rcv != -1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", -1, rcv)
+	}
+}
+
+func TestPacketExtendedAttributes(t *testing.T) {
+	dictStr := `
+ATTRIBUTE	Frag-Status	241.1	integer
+ATTRIBUTE	Long-Blob	245.1	string
+
+VENDOR		Cisco		9
+VENDOR		Nokia		94
+BEGIN-VENDOR	Cisco
+ATTRIBUTE	Cisco-NAS-Port	2	string
+END-VENDOR	Cisco
+BEGIN-VENDOR	Nokia	format=Extended-Vendor-Specific-5
+ATTRIBUTE	Nokia-Extended-Data	1	string
+END-VENDOR	Nokia
+`
+	dict := RFC2865Dictionary()
+	if err := dict.ParseFromReader(strings.NewReader(dictStr)); err != nil {
+		t.Fatal(err)
+	}
+	longVal := strings.Repeat("CGRateS.org", 50)
+	req := NewPacket(AccessRequest, 1, dict, NewCoder(), "CGRateS.org")
+	for _, avp := range [][]string{
+		{"Frag-Status", "1", ""},
+		{"Long-Blob", longVal, ""},
+		{"Nokia-Extended-Data", longVal, "Nokia"},
+		{"Cisco-NAS-Port", "CGR1", "Cisco"},
+	} {
+		if err := req.AddAVPWithName(avp[0], avp[1], avp[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := &Packet{dict: dict, coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(rcv.AVPs) != 4 {
+		t.Fatalf("unexpected AVPs: %+v", rcv.AVPs)
+	}
+	if avps := rcv.AttributesWithName("Frag-Status", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "1", avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Long-Blob", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != longVal {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", longVal, avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Nokia-Extended-Data", "Nokia"); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != longVal {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", longVal, avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Cisco-NAS-Port", "Cisco"); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "CGR1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CGR1", avps[0].GetStringValue())
+	}
+}
+
+func TestPacketConcatAttributes(t *testing.T) {
+	dictStr := `
+ATTRIBUTE	EAP-Message	79	octets	concat
+ATTRIBUTE	Class	25	octets
+
+VENDOR		Cisco		9
+BEGIN-VENDOR	Cisco
+ATTRIBUTE	Cisco-Blob	10	string	concat
+END-VENDOR	Cisco
+`
+	dict := RFC2865Dictionary()
+	if err := dict.ParseFromReader(strings.NewReader(dictStr)); err != nil {
+		t.Fatal(err)
+	}
+	eapVal := strings.Repeat("CGRateS.org", 50)
+	blobVal := strings.Repeat("CGRateS.org", 30)
+	req := NewPacket(AccessRequest, 1, dict, NewCoder(), "CGRateS.org")
+	for _, avp := range [][]string{
+		{"EAP-Message", eapVal, ""},
+		{"Class", "CGR1", ""},
+		{"Class", "CGR2", ""},
+		{"Cisco-Blob", blobVal, "Cisco"},
+	} {
+		if err := req.AddAVPWithName(avp[0], avp[1], avp[2]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 EAP-Message + 2 Class + 2 Cisco-Blob
+	var nrAttrs int
+	for b := buf[20:n]; len(b) != 0; b = b[b[1]:] {
+		nrAttrs++
+	}
+	if nrAttrs != 7 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 7, nrAttrs)
+	}
+	rcv := &Packet{dict: dict, coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(rcv.AVPs) != 4 {
+		t.Fatalf("unexpected AVPs: %+v", rcv.AVPs)
+	}
+	if avps := rcv.AttributesWithName("EAP-Message", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != eapVal {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eapVal, avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Class", ""); len(avps) != 2 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	}
+	if avps := rcv.AttributesWithName("Cisco-Blob", "Cisco"); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != blobVal {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", blobVal, avps[0].GetStringValue())
+	}
+}
+
+func TestPacketEncodeTooLongNoConcat(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if err := req.AddAVPWithName("Class", strings.Repeat("CGRateS.org", 30), ""); err != nil {
+		t.Fatal(err)
+	}
+	var buf [4096]byte
+	if _, err := req.Encode(buf[:]); err == nil {
+		t.Error("expecting error for value longer than one attribute")
+	}
+}
+
+func TestPacketTaggedAttributes(t *testing.T) {
+	dictStr := `
+ATTRIBUTE	Tunnel-Type			64	integer	has_tag
+ATTRIBUTE	Tunnel-Medium-Type		65	integer	has_tag
+ATTRIBUTE	Tunnel-Private-Group-Id		81	string	has_tag
+
+VALUE	Tunnel-Type		VLAN			13
+VALUE	Tunnel-Medium-Type	IEEE-802		6
+`
+	dict := RFC2865Dictionary()
+	if err := dict.ParseFromReader(strings.NewReader(dictStr)); err != nil {
+		t.Fatal(err)
+	}
+	req := NewPacket(AccessAccept, 1, dict, NewCoder(), "CGRateS.org")
+	for _, avp := range [][]string{
+		{"Tunnel-Type:1", "VLAN"},
+		{"Tunnel-Medium-Type:1", "IEEE-802"},
+		{"Tunnel-Private-Group-Id:1", "100"},
+		{"Tunnel-Private-Group-Id:2", "200"},
+		{"Tunnel-Private-Group-Id", "300"},
+	} {
+		if err := req.AddAVPWithName(avp[0], avp[1], ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eRaw := [][]byte{
+		{1, 0, 0, 13},
+		{1, 0, 0, 6},
+		{1, '1', '0', '0'},
+		{2, '2', '0', '0'},
+		{'3', '0', '0'},
+	}
+	for i, avp := range req.AVPs {
+		if !bytes.Equal(eRaw[i], avp.RawValue) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eRaw[i], avp.RawValue)
+		}
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := &Packet{dict: dict, coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if avps := rcv.AttributesWithName("Tunnel-Type:1", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "VLAN" || avps[0].Tag != 1 {
+		t.Errorf("unexpected AVP: %+v", avps[0])
+	}
+	if avps := rcv.AttributesWithName("Tunnel-Private-Group-Id", ""); len(avps) != 3 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	}
+	if avps := rcv.AttributesWithName("Tunnel-Private-Group-Id:2", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "200" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "200", avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Tunnel-Private-Group-Id:0", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "300" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "300", avps[0].GetStringValue())
+	}
+	if avps := rcv.AttributesWithName("Tunnel-Private-Group-Id:3", ""); len(avps) != 0 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	}
+	experr := "attribute <User-Name> is not tagged"
+	if err := req.AddAVPWithName("User-Name:1", "cgrates", ""); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	experr = "invalid tag for attribute: <Tunnel-Type:32>"
+	if err := req.AddAVPWithName("Tunnel-Type:32", "VLAN", ""); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestPacketEncryptedAttributes(t *testing.T) {
+	dictStr := `
+ATTRIBUTE	User-Password		2	string	encrypt=1
+ATTRIBUTE	Tunnel-Password		69	string	has_tag,encrypt=2
+ATTRIBUTE	Ascend-Send-Secret	214	string	encrypt=3
+
+VENDOR		Microsoft	311
+BEGIN-VENDOR	Microsoft
+ATTRIBUTE	MS-MPPE-Send-Key	16	octets	encrypt=2
+END-VENDOR	Microsoft
+`
+	dict := RFC2865Dictionary()
+	if err := dict.ParseFromReader(strings.NewReader(dictStr)); err != nil {
+		t.Fatal(err)
+	}
+	req := NewPacket(AccessRequest, 1, dict, NewCoder(), "CGRateS.org")
+	req.Authenticator = [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2}
+	if err := req.AddAVPWithName("User-Password", "CGRateSPassword", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.AddAVPWithName("Ascend-Send-Secret", "AscendSecret", ""); err != nil {
+		t.Fatal(err)
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], []byte("CGRateSPassword")) || bytes.Contains(buf[:n], []byte("AscendSecret")) {
+		t.Errorf("values not encrypted: %+v", buf[:n])
+	}
+	if string(req.AVPs[0].RawValue) != "CGRateSPassword" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CGRateSPassword", string(req.AVPs[0].RawValue))
+	}
+	srvReq := &Packet{secret: "CGRateS.org", dict: dict, coder: NewCoder()}
+	if err := srvReq.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if avps := srvReq.AttributesWithName("User-Password", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "CGRateSPassword" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CGRateSPassword", avps[0].GetStringValue())
+	}
+	if avps := srvReq.AttributesWithName("Ascend-Send-Secret", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "AscendSecret" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "AscendSecret", avps[0].GetStringValue())
+	}
+
+	rply := srvReq.Reply()
+	rply.Code = AccessAccept
+	if err := rply.AddAVPWithName("Tunnel-Password:1", "TunnelPassword", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := rply.AddAVPWithName("MS-MPPE-Send-Key", "MPPESendKey", "Microsoft"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = rply.Encode(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], []byte("TunnelPassword")) || bytes.Contains(buf[:n], []byte("MPPESendKey")) {
+		t.Errorf("values not encrypted: %+v", buf[:n])
+	}
+	clntRply := &Packet{secret: "CGRateS.org", dict: dict, coder: NewCoder()}
+	if err := clntRply.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err := clntRply.decryptAVPs(req.Authenticator); err != nil {
+		t.Fatal(err)
+	}
+	if avps := clntRply.AttributesWithName("Tunnel-Password:1", ""); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "TunnelPassword" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "TunnelPassword", avps[0].GetStringValue())
+	}
+	if avps := clntRply.AttributesWithName("MS-MPPE-Send-Key", "Microsoft"); len(avps) != 1 {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	} else if avps[0].GetStringValue() != "MPPESendKey" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "MPPESendKey", avps[0].GetStringValue())
+	}
+}
+
+func TestPacketDecodeUserPasswordEmptySecret(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if err := req.AddAVPWithNumber(UserPasswordNumber, "CGRateSPassword1", NoVendor); err != nil {
+		t.Fatal(err)
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv := &Packet{dict: RFC2865Dictionary(), coder: NewCoder()}
+	experr := "empty secret"
+	if err := rcv.Decode(buf[:n]); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	rcv = &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := rcv.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	} else if avps := rcv.AttributesWithNumber(UserPasswordNumber, NoVendor); len(avps) != 1 ||
+		avps[0].GetStringValue() != "CGRateSPassword1" {
+		t.Errorf("unexpected AVPs: %+v", avps)
+	}
+}
+
+func TestPacketUserPasswordDefaultDictionary(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	if err := req.AddAVPWithName("User-Password", "CGRateSPassword", ""); err != nil {
+		t.Fatal(err)
+	}
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], []byte("CGRateSPassword")) {
+		t.Errorf("User-Password not hidden: %+v", buf[:n])
+	}
+	if pass := buf[22:n]; len(pass) != 16 || !bytes.Equal(pass, EncodeUserPassword(padValue([]byte("CGRateSPassword")),
+		[]byte("CGRateS.org"), req.Authenticator[:])) {
+		t.Errorf("unexpected User-Password on the wire: %+v", pass)
+	}
+	srvReq := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := srvReq.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvReq.VerifyPassword("CGRateSPassword"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPacketHiddenAttributesCoA(t *testing.T) {
+	req := NewPacket(CoARequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.AVPs = append(req.AVPs, (&VSA{Vendor: MicrosoftVendor, Number: MSMPPESendKeyNumber,
+		RawValue: []byte("MPPESendKey")}).AVP())
+	var buf [4096]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], []byte("MPPESendKey")) {
+		t.Errorf("MS-MPPE-Send-Key not hidden: %+v", buf[:n])
+	}
+	if !isAuthenticReq(buf[:n], []byte("CGRateS.org")) {
+		t.Error("request not authentic")
+	}
+	srvReq := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := srvReq.Decode(buf[:n]); err != nil { // hidden with zero authenticator, rfc5176 3.6
+		t.Fatal(err)
+	}
+	if len(srvReq.AVPs) != 1 || !bytes.Equal(srvReq.AVPs[0].RawValue[6:], []byte("MPPESendKey")) {
+		t.Errorf("unexpected AVPs: %+v", srvReq.AVPs)
+	}
+}
+
+func TestPacketMPPEKeys(t *testing.T) {
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	req.Authenticator = [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2}
+	sendKey := []byte("CGRateSMPPESendK")
+	recvKey := []byte("CGRateSMPPERecvK")
+	rply := req.Reply()
+	rply.Code = AccessAccept
+	rply.AddMPPEKeys(sendKey, recvKey)
+	var buf [4096]byte
+	n, err := rply.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf[:n], sendKey) || bytes.Contains(buf[:n], recvKey) {
+		t.Errorf("keys not encrypted: %+v", buf[:n])
+	}
+	// 2 VSAs with salt (2) + encrypted length, key and padding (32)
+	if n != 20+2*(2+6+34) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 20+2*(2+6+34), n)
+	}
+	clntRply := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err := clntRply.Decode(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err := clntRply.decryptAVPs(req.Authenticator); err != nil {
+		t.Fatal(err)
+	}
+	if rcvSend, rcvRecv := clntRply.MPPEKeys(); !bytes.Equal(sendKey, rcvSend) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", sendKey, rcvSend)
+	} else if !bytes.Equal(recvKey, rcvRecv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", recvKey, rcvRecv)
+	}
+}
@@ -0,0 +1,268 @@
+package radigo
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MetaFailover   = "*failover"    // first server alive, in priority and definition order
+	MetaRoundRobin = "*round_robin" // servers of the best priority in turn, based on their weight
+	MetaHash       = "*hash"        // server of the best priority selected on the hash key, based on their weight
+
+	AcctSessionIDNumber = 44 // Acct-Session-Id AVP number, rfc2866 5.5
+
+	DefaultPoolProbeInterval = 10 * time.Second
+)
+
+var (
+	ErrNoServerAlive   = errors.New("no server alive in pool")
+	errUnknownStrategy = errors.New("unknown pool strategy")
+	errNoPoolServers   = errors.New("no servers in pool")
+)
+
+// PoolServer is a member of the ClientPool
+type PoolServer struct {
+	Server   HomeServer // usually a *Client
+	Priority int        // lower priorities are used first, the higher ones only when these are dead
+	Weight   int        // share of requests within the priority, for round robin and hash, 0 counts as 1
+}
+
+// contextSender is implemented by the servers able to stop sending on context, like Client
+type contextSender interface {
+	SendRequestContext(ctx context.Context, req *Packet) (*Packet, error)
+}
+
+// poolMember is the PoolServer with it's health state
+type poolMember struct {
+	*PoolServer
+	idx      int // definition order
+	dead     atomic.Bool
+	failures atomic.Int32 // consecutive
+}
+
+func (pm *poolMember) weight() float64 {
+	if pm.Weight <= 0 {
+		return 1
+	}
+	return float64(pm.Weight)
+}
+
+// HashOnAttribute returns a hash key function using the value of the attribute
+// ie: HashOnAttribute(AcctSessionIDNumber) keeps the accounting of a session on the same server
+func HashOnAttribute(attrNr uint8) func(*Packet) []byte {
+	return func(req *Packet) []byte {
+		return req.rawAttribute(attrNr)
+	}
+}
+
+// NewClientPool instantiates a ClientPool distributing the requests based on strategy
+// (MetaFailover, MetaRoundRobin or MetaHash)
+func NewClientPool(strategy string, servers []*PoolServer) (*ClientPool, error) {
+	switch strategy {
+	case MetaFailover, MetaRoundRobin, MetaHash:
+	default:
+		return nil, errUnknownStrategy
+	}
+	if len(servers) == 0 {
+		return nil, errNoPoolServers
+	}
+	cp := &ClientPool{strategy: strategy, hashKey: HashOnAttribute(AcctSessionIDNumber),
+		deadAfter: 1, probeInterval: DefaultPoolProbeInterval, stop: make(chan struct{})}
+	for i, srv := range servers {
+		cp.members = append(cp.members, &poolMember{PoolServer: srv, idx: i})
+	}
+	sort.SliceStable(cp.members, func(i, j int) bool {
+		return cp.members[i].Priority < cp.members[j].Priority
+	})
+	return cp, nil
+}
+
+// ClientPool sends the requests to a group of servers, failing over to the next ones on timeouts or connection losses
+// servers failing are marked dead and revived once they answer the Status-Server probes
+type ClientPool struct {
+	sync.RWMutex
+	strategy      string
+	members       []*poolMember // sorted on priority, then definition order
+	hashKey       func(*Packet) []byte
+	deadAfter     int32 // consecutive failures marking the server dead
+	probeInterval time.Duration
+	rrCounter     atomic.Uint64
+	stop          chan struct{} // stops the probing
+	stopOnce      sync.Once
+}
+
+// SetHashKey sets the key of the requests for MetaHash strategy, Acct-Session-Id by default
+// requests with empty key are sent using failover
+func (cp *ClientPool) SetHashKey(hashKey func(*Packet) []byte) {
+	cp.Lock()
+	cp.hashKey = hashKey
+	cp.Unlock()
+}
+
+// SetDeadDetection marks the servers dead after the number of consecutive failures (ie: timeouts)
+// the dead servers are probed with Status-Server at probeInterval, DefaultPoolProbeInterval if not positive
+func (cp *ClientPool) SetDeadDetection(failures int, probeInterval time.Duration) {
+	if probeInterval <= 0 {
+		probeInterval = DefaultPoolProbeInterval
+	}
+	cp.Lock()
+	cp.deadAfter, cp.probeInterval = int32(max(failures, 1)), probeInterval
+	cp.Unlock()
+}
+
+// Close stops probing the dead servers
+func (cp *ClientPool) Close() {
+	cp.stopOnce.Do(func() { close(cp.stop) })
+}
+
+// NewRequest produces a new request using the first server of the pool
+func (cp *ClientPool) NewRequest(code PacketCode, id uint8) *Packet {
+	return cp.members[0].Server.NewRequest(code, id)
+}
+
+// SendRequest sends the request to the server selected by strategy, failing over to the others on error
+func (cp *ClientPool) SendRequest(req *Packet) (*Packet, error) {
+	return cp.SendRequestContext(context.Background(), req)
+}
+
+// SendRequestContext is the SendRequest stopping the failover on ctx
+// ctx is passed to the servers implementing SendRequestContext
+func (cp *ClientPool) SendRequestContext(ctx context.Context, req *Packet) (rply *Packet, err error) {
+	candidates := cp.candidates(req)
+	if len(candidates) == 0 {
+		return nil, ErrNoServerAlive
+	}
+	for _, pm := range candidates {
+		if ctxSender, canCtx := pm.Server.(contextSender); canCtx {
+			rply, err = ctxSender.SendRequestContext(ctx, req)
+		} else {
+			rply, err = pm.Server.SendRequest(req)
+		}
+		if err == nil {
+			pm.failures.Store(0)
+			return
+		}
+		if ctx.Err() != nil { // not the fault of the server
+			return nil, ctx.Err()
+		}
+		if !isServerFailure(err) { // request errors (ie: encoding) would fail on the other servers too
+			return nil, err
+		}
+		cp.failed(pm)
+	}
+	return
+}
+
+// isServerFailure returns true for the errors counting against the server: timeouts and connection losses
+func isServerFailure(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, ErrTimeout) ||
+		errors.Is(err, ErrConnectionLost) ||
+		errors.Is(err, ErrNotConnected) ||
+		errors.Is(err, ErrClientClosed) ||
+		errors.As(err, &netErr)
+}
+
+// candidates returns the alive servers in the order they should be tried
+func (cp *ClientPool) candidates(req *Packet) (alive []*poolMember) {
+	for _, pm := range cp.members {
+		if !pm.dead.Load() {
+			alive = append(alive, pm)
+		}
+	}
+	if len(alive) < 2 || cp.strategy == MetaFailover {
+		return
+	}
+	var best int // members of the best priority, selected on strategy
+	for best < len(alive) && alive[best].Priority == alive[0].Priority {
+		best++
+	}
+	var first int
+	switch cp.strategy {
+	case MetaRoundRobin:
+		first = weightedIndex(alive[:best], float64(cp.rrCounter.Add(1)-1))
+	case MetaHash:
+		cp.RLock()
+		hashKey := cp.hashKey
+		cp.RUnlock()
+		req.RLock()
+		key := hashKey(req)
+		req.RUnlock()
+		if len(key) == 0 {
+			return
+		}
+		first = rendezvousIndex(alive[:best], key)
+	}
+	return append(append([]*poolMember{alive[first]}, alive[:first]...), alive[first+1:]...)
+}
+
+// weightedIndex returns the member owning the position n in the sequence of weights
+func weightedIndex(members []*poolMember, n float64) int {
+	var total float64
+	for _, pm := range members {
+		total += pm.weight()
+	}
+	n = math.Mod(n, total)
+	for i, pm := range members {
+		if n -= pm.weight(); n < 0 {
+			return i
+		}
+	}
+	return len(members) - 1
+}
+
+// rendezvousIndex returns the member with the highest weighted score for key
+// the key keeps it's server as long as that one is alive
+func rendezvousIndex(members []*poolMember, key []byte) (idx int) {
+	bestScore := math.Inf(-1)
+	for i, pm := range members {
+		h := fnv.New64a()
+		h.Write(key)
+		h.Write([]byte{byte(pm.idx >> 8), byte(pm.idx)})
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53) // uniform in (0, 1)
+		if score := -pm.weight() / math.Log(u); score > bestScore {
+			bestScore, idx = score, i
+		}
+	}
+	return
+}
+
+// failed counts the failure of the server, marking it dead and starting it's probing once deadAfter is reached
+func (cp *ClientPool) failed(pm *poolMember) {
+	cp.RLock()
+	deadAfter, probeInterval := cp.deadAfter, cp.probeInterval
+	cp.RUnlock()
+	if pm.failures.Add(1) < deadAfter || !pm.dead.CompareAndSwap(false, true) {
+		return
+	}
+	go cp.probe(pm, probeInterval)
+}
+
+// probe sends Status-Server to the dead server until it answers, rfc5997 4
+func (cp *ClientPool) probe(pm *poolMember, probeInterval time.Duration) {
+	tmr := time.NewTimer(probeInterval)
+	defer tmr.Stop()
+	for {
+		select {
+		case <-cp.stop:
+			return
+		case <-tmr.C:
+		}
+		req := pm.Server.NewRequest(StatusServer, 0)
+		req.AddMessageAuthenticator()
+		if _, err := pm.Server.SendRequest(req); err == nil {
+			pm.failures.Store(0)
+			pm.dead.Store(false)
+			return
+		}
+		tmr.Reset(probeInterval)
+	}
+}
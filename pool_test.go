@@ -0,0 +1,223 @@
+package radigo
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPoolServer answers with it's name in Reply-Message, times out while down
+type testPoolServer struct {
+	name   string
+	down   atomic.Bool
+	nrReqs atomic.Int32
+	probes atomic.Int32
+}
+
+func (ts *testPoolServer) NewRequest(code PacketCode, id uint8) *Packet {
+	return NewPacket(code, id, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+}
+
+func (ts *testPoolServer) SendRequest(req *Packet) (*Packet, error) {
+	if req.Code == StatusServer {
+		ts.probes.Add(1)
+	} else {
+		ts.nrReqs.Add(1)
+	}
+	if ts.down.Load() {
+		return nil, &TimeoutError{}
+	}
+	var buf [MaxPacketLen]byte
+	if _, err := req.Encode(buf[:]); err != nil {
+		return nil, err
+	}
+	rply := req.Reply()
+	rply.Code = AccessAccept
+	rply.AVPs = append(rply.AVPs, &AVP{Number: ReplyMessage, RawValue: []byte(ts.name)})
+	return rply, nil
+}
+
+// testPoolSend returns the name of the server answering
+func testPoolSend(t *testing.T, cp *ClientPool, acctSessionID string) string {
+	req := cp.NewRequest(AccessRequest, 1)
+	if acctSessionID != "" {
+		req.AVPs = append(req.AVPs, &AVP{Number: AcctSessionIDNumber, RawValue: []byte(acctSessionID)})
+	}
+	rply, err := cp.SendRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(rply.rawAttribute(ReplyMessage))
+}
+
+func TestClientPoolFailover(t *testing.T) {
+	srv1, srv2, srv3 := &testPoolServer{name: "srv1"}, &testPoolServer{name: "srv2"}, &testPoolServer{name: "srv3"}
+	cp, err := NewClientPool(MetaFailover, []*PoolServer{
+		{Server: srv3, Priority: 1},
+		{Server: srv1},
+		{Server: srv2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	cp.SetDeadDetection(1, 10*time.Millisecond)
+	if name := testPoolSend(t, cp, ""); name != "srv1" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv1", name)
+	}
+	srv1.down.Store(true)
+	srv2.down.Store(true)
+	if name := testPoolSend(t, cp, ""); name != "srv3" { // lower priority used once the others are dead
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv3", name)
+	}
+	if name := testPoolSend(t, cp, ""); name != "srv3" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv3", name)
+	}
+	if nrReqs := srv1.nrReqs.Load(); nrReqs != 2 { // not tried while dead
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, nrReqs)
+	}
+	srv3.down.Store(true)
+	if _, err := cp.SendRequest(cp.NewRequest(AccessRequest, 1)); err == nil {
+		t.Error("expecting error")
+	}
+	if _, err := cp.SendRequest(cp.NewRequest(AccessRequest, 1)); err != ErrNoServerAlive {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrNoServerAlive, err)
+	}
+	srv1.down.Store(false)
+	time.Sleep(50 * time.Millisecond) // revived by Status-Server
+	if probes := srv1.probes.Load(); probes == 0 {
+		t.Error("no Status-Server probes")
+	}
+	if name := testPoolSend(t, cp, ""); name != "srv1" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv1", name)
+	}
+}
+
+func TestClientPoolRoundRobin(t *testing.T) {
+	srv1, srv2, srv3 := &testPoolServer{name: "srv1"}, &testPoolServer{name: "srv2"}, &testPoolServer{name: "srv3"}
+	cp, err := NewClientPool(MetaRoundRobin, []*PoolServer{
+		{Server: srv1, Weight: 2},
+		{Server: srv2},
+		{Server: srv3, Priority: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	served := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		served[testPoolSend(t, cp, "")]++
+	}
+	if served["srv1"] != 4 || served["srv2"] != 2 || served["srv3"] != 0 {
+		t.Errorf("Unexpected distribution: %+v", served)
+	}
+	srv2.down.Store(true)
+	for i := 0; i < 3; i++ {
+		if name := testPoolSend(t, cp, ""); name != "srv1" {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv1", name)
+		}
+	}
+}
+
+func TestClientPoolHash(t *testing.T) {
+	srvs := []*testPoolServer{{name: "srv1"}, {name: "srv2"}, {name: "srv3"}}
+	cp, err := NewClientPool(MetaHash, []*PoolServer{{Server: srvs[0]}, {Server: srvs[1]}, {Server: srvs[2]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	cp.SetDeadDetection(1, time.Hour)
+	sessions := make(map[string]string)
+	served := make(map[string]bool)
+	for _, sessionID := range []string{"sess1", "sess2", "sess3", "sess4", "sess5", "sess6", "sess7", "sess8"} {
+		name := testPoolSend(t, cp, sessionID)
+		if again := testPoolSend(t, cp, sessionID); again != name {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", name, again)
+		}
+		sessions[sessionID] = name
+		served[name] = true
+	}
+	if len(served) < 2 {
+		t.Errorf("sessions not distributed: %+v", sessions)
+	}
+	srvs[0].down.Store(true)
+	for sessionID, name := range sessions {
+		if rcv := testPoolSend(t, cp, sessionID); name != "srv1" && rcv != name { // only the sessions of srv1 move
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", name, rcv)
+		} else if rcv == "srv1" {
+			t.Errorf("session %s served by dead server", sessionID)
+		}
+	}
+}
+
+func TestClientPoolSetDeadDetection(t *testing.T) {
+	cp, err := NewClientPool(MetaFailover, []*PoolServer{{Server: &testPoolServer{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	cp.SetDeadDetection(0, 0)
+	if cp.deadAfter != 1 || cp.probeInterval != DefaultPoolProbeInterval {
+		t.Errorf("Unexpected dead detection: %d, %s", cp.deadAfter, cp.probeInterval)
+	}
+	cp.SetDeadDetection(3, -time.Second)
+	if cp.deadAfter != 3 || cp.probeInterval != DefaultPoolProbeInterval {
+		t.Errorf("Unexpected dead detection: %d, %s", cp.deadAfter, cp.probeInterval)
+	}
+}
+
+func TestNewClientPoolErrors(t *testing.T) {
+	if _, err := NewClientPool("*random", []*PoolServer{{Server: &testPoolServer{}}}); err != errUnknownStrategy {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", errUnknownStrategy, err)
+	}
+	if _, err := NewClientPool(MetaFailover, nil); err != errNoPoolServers {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", errNoPoolServers, err)
+	}
+}
+
+func TestClientPoolSendRequestContext(t *testing.T) {
+	srv1, srv2 := &testPoolServer{name: "srv1"}, &testPoolServer{name: "srv2"}
+	cp, err := NewClientPool(MetaFailover, []*PoolServer{{Server: srv1}, {Server: srv2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	srv1.down.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cp.SendRequestContext(ctx, cp.NewRequest(AccessRequest, 1)); err != context.Canceled {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+	}
+	if nrReqs := srv2.nrReqs.Load(); nrReqs != 0 { // no failover once cancelled
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 0, nrReqs)
+	}
+	if cp.members[0].dead.Load() {
+		t.Error("server marked dead on cancelled context")
+	}
+}
+
+func TestClientPoolRequestError(t *testing.T) {
+	srv1, srv2 := &testPoolServer{name: "srv1"}, &testPoolServer{name: "srv2"}
+	cp, err := NewClientPool(MetaFailover, []*PoolServer{{Server: srv1}, {Server: srv2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cp.Close()
+	req := cp.NewRequest(AccessRequest, 1)
+	req.AVPs = append(req.AVPs, &AVP{Name: "Unknown-Attribute", Value: "CGRateS"})
+	if _, err := cp.SendRequest(req); err == nil {
+		t.Error("expecting encoding error")
+	}
+	if nrReqs := srv2.nrReqs.Load(); nrReqs != 0 { // no failover for request errors
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 0, nrReqs)
+	}
+	for _, pm := range cp.members {
+		if pm.dead.Load() || pm.failures.Load() != 0 {
+			t.Errorf("server %s failed on request error", pm.Server.(*testPoolServer).name)
+		}
+	}
+	if name := testPoolSend(t, cp, ""); name != "srv1" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "srv1", name)
+	}
+}
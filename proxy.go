@@ -0,0 +1,205 @@
+package radigo
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	ProxyStateNumber = 33 // Proxy-State AVP number, rfc2865 5.33
+	proxyIDLen       = 8  // length of the Proxy identifier prefixing it's Proxy-State values
+)
+
+var (
+	ErrProxyLoop    = errors.New("proxy loop detected")
+	ErrNoHomeServer = errors.New("no home server answered")
+	ErrNoProxyRoute = errors.New("no proxy route")
+)
+
+// HomeServer is the destination of the proxied requests, implemented by Client and ClientPool
+type HomeServer interface {
+	NewRequest(code PacketCode, id uint8) *Packet
+	SendRequest(req *Packet) (*Packet, error)
+}
+
+// ProxyRoute lists the home servers of a realm, tried in order until one answers
+type ProxyRoute struct {
+	HomeServers []HomeServer
+	StripRealm  bool // remove the realm out of User-Name before forwarding
+}
+
+// RealmFromUserName extracts the realm out of "user@realm" or "DOMAIN\user" User-Name
+// returns empty realm if none is present
+func RealmFromUserName(userName string) (realm, user string) {
+	if idx := strings.LastIndexByte(userName, '@'); idx != -1 {
+		return userName[idx+1:], userName[:idx]
+	}
+	if idx := strings.IndexByte(userName, '\\'); idx != -1 {
+		return userName[:idx], userName[idx+1:]
+	}
+	return "", userName
+}
+
+// NewProxy instantiates a Proxy
+// fallback handles locally the requests without route or unanswered by the home servers, nil to reject them
+func NewProxy(fallback func(*Packet) (*Packet, error)) *Proxy {
+	px := &Proxy{id: make([]byte, proxyIDLen), routes: make(map[string]*ProxyRoute), fallback: fallback}
+	rand.Read(px.id)
+	return px
+}
+
+// Proxy forwards the requests to home servers based on their realm
+// HandleRequest should be registered as the server handler of the proxied packet codes
+type Proxy struct {
+	sync.RWMutex
+	id       []byte                 // unique identifier, detecting loops in Proxy-State
+	routes   map[string]*ProxyRoute // routes indexed on lower case realm, MetaDefault for any other realm
+	matcher  func(req *Packet) string
+	fallback func(*Packet) (*Packet, error)
+	nextID   atomic.Uint32 // Identifier of the forwarded requests
+}
+
+// AddRoute routes the requests of the realm to the home servers, MetaDefault matches any other realm
+func (px *Proxy) AddRoute(realm string, route *ProxyRoute) {
+	px.Lock()
+	px.routes[strings.ToLower(realm)] = route
+	px.Unlock()
+}
+
+// SetRealmMatcher replaces the User-Name based realm detection (ie: matching on Called-Station-Id)
+func (px *Proxy) SetRealmMatcher(matcher func(req *Packet) string) {
+	px.Lock()
+	px.matcher = matcher
+	px.Unlock()
+}
+
+// route returns the route of the request, nil if the request should be handled locally
+func (px *Proxy) route(req *Packet) *ProxyRoute {
+	px.RLock()
+	defer px.RUnlock()
+	var realm string
+	if px.matcher != nil {
+		realm = px.matcher(req)
+	} else {
+		req.RLock()
+		realm, _ = RealmFromUserName(string(req.rawAttribute(1))) // User-Name
+		req.RUnlock()
+	}
+	if realm == "" {
+		return nil
+	}
+	if route, has := px.routes[strings.ToLower(realm)]; has {
+		return route
+	}
+	return px.routes[MetaDefault]
+}
+
+// isLoop checks the Proxy-State values of the request for the ones added by us
+func (px *Proxy) isLoop(req *Packet) bool {
+	req.RLock()
+	defer req.RUnlock()
+	for _, avp := range req.AVPs {
+		if px.isOwnState(avp) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnState returns true for the Proxy-State added by us
+func (px *Proxy) isOwnState(avp *AVP) bool {
+	return avp.Number == ProxyStateNumber && len(avp.RawValue) == proxyIDLen+4 &&
+		bytes.Equal(avp.RawValue[:proxyIDLen], px.id)
+}
+
+// HandleRequest forwards the request to the home servers of it's realm and returns their reply
+// requests without route are passed to the fallback handler
+func (px *Proxy) HandleRequest(req *Packet) (*Packet, error) {
+	if px.isLoop(req) {
+		return nil, ErrProxyLoop
+	}
+	route := px.route(req)
+	if route == nil {
+		if px.fallback == nil {
+			return nil, ErrNoProxyRoute
+		}
+		return px.fallback(req)
+	}
+	for _, hs := range route.HomeServers {
+		if rply, err := px.forward(hs, req, route.StripRealm); err == nil {
+			return rply, nil
+		}
+	}
+	if px.fallback == nil {
+		return nil, ErrNoHomeServer
+	}
+	return px.fallback(req)
+}
+
+// forward sends the request to the home server, returning the reply for the original client
+func (px *Proxy) forward(hs HomeServer, req *Packet, stripRealm bool) (*Packet, error) {
+	state := binary.BigEndian.AppendUint32(append([]byte{}, px.id...), px.nextID.Add(1))
+	out := hs.NewRequest(req.Code, state[proxyIDLen+3])
+	req.RLock()
+	out.copyAVPs(req, func(avp *AVP) bool { return avp.Number != MessageAuthenticatorNumber })
+	withMsgAuth := req.Has(MessageAuthenticatorNumber)
+	if req.Has(CHAPPasswordNumber) && !req.Has(CHAPChallengeNumber) {
+		// the CHAP response was computed over the original Authenticator, rfc2865 2.2
+		out.AVPs = append(out.AVPs, &AVP{Number: CHAPChallengeNumber,
+			RawValue: append([]byte{}, req.Authenticator[:]...)})
+	}
+	req.RUnlock()
+	if stripRealm {
+		for i, avp := range out.AVPs {
+			if avp.Number == 1 { // User-Name
+				_, user := RealmFromUserName(string(avp.RawValue))
+				out.AVPs[i] = &AVP{Number: 1, RawValue: []byte(user)}
+			}
+		}
+	}
+	out.AVPs = append(out.AVPs, &AVP{Number: ProxyStateNumber, RawValue: state})
+	if withMsgAuth {
+		out.AddMessageAuthenticator()
+	}
+	hsRply, err := hs.SendRequest(out)
+	if err != nil {
+		return nil, err
+	}
+	rply := req.Reply()
+	rply.Code = hsRply.Code
+	hsRply.RLock()
+	rply.copyAVPs(hsRply, func(avp *AVP) bool {
+		return avp.Number != MessageAuthenticatorNumber && !px.isOwnState(avp)
+	})
+	hsRply.RUnlock()
+	return rply, nil
+}
+
+// copyAVPs appends copies of the src AVPs accepted by filter
+// encrypted values stay hidden on Encode, even if not flagged in the dictionary of p
+func (p *Packet) copyAVPs(src *Packet, filter func(*AVP) bool) {
+	for _, avp := range src.AVPs {
+		if !filter(avp) {
+			continue
+		}
+		cpAVP := &AVP{Number: avp.Number, ExtendedType: avp.ExtendedType,
+			RawValue: append([]byte{}, avp.RawValue...)}
+		da, _ := src.rawDictAttribute(avp)
+		method := encryptMethod(avp, da)
+		if src.Code == AccessRequest {
+			method = src.hiddenMethod(avp, da)
+		}
+		if method != 0 {
+			if p.hidden == nil {
+				p.hidden = make(map[*AVP]uint8)
+			}
+			p.hidden[cpAVP] = method
+		}
+		p.AVPs = append(p.AVPs, cpAVP)
+	}
+}
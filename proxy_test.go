@@ -0,0 +1,209 @@
+package radigo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProxyRealmFromUserName(t *testing.T) {
+	for userName, exp := range map[string][2]string{
+		"flopsy@cgrates.org":      {"cgrates.org", "flopsy"},
+		"flopsy@home@cgrates.org": {"cgrates.org", "flopsy@home"},
+		"CGRATES\\flopsy":         {"CGRATES", "flopsy"},
+		"flopsy":                  {"", "flopsy"},
+	} {
+		if realm, user := RealmFromUserName(userName); realm != exp[0] || user != exp[1] {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, [2]string{realm, user})
+		}
+	}
+}
+
+// testProxyNASDict hides User-Password based on dictionary, unlike the default one used by the home server
+func testProxyNASDict(t *testing.T) *Dictionary {
+	dict := RFC2865Dictionary()
+	if err := dict.ParseFromReader(strings.NewReader("ATTRIBUTE\tUser-Password\t2\tstring\tencrypt=1\n")); err != nil {
+		t.Fatal(err)
+	}
+	return dict
+}
+
+// testProxyRequest sends the Access-Request of userName from the NAS to the proxy
+func testProxyRequest(t *testing.T, px *Proxy, userName string) (*Packet, error) {
+	nas := newLoopback(px.HandleRequest, testProxyNASDict(t), "nasSecret")
+	req := nas.NewRequest(AccessRequest, 1)
+	req.AVPs = append(req.AVPs,
+		&AVP{Number: 1, RawValue: []byte(userName)},
+		&AVP{Number: UserPasswordNumber, RawValue: []byte("CGRateSPassword1")},
+		&AVP{Number: ProxyStateNumber, RawValue: []byte("nasState")})
+	req.AddMessageAuthenticator()
+	return nas.SendRequest(req)
+}
+
+// testProxyHome answers like a home server, checking the forwarded request
+func testProxyHome(t *testing.T, expUserName string) func(*Packet) (*Packet, error) {
+	return func(req *Packet) (*Packet, error) {
+		if userName := string(req.rawAttribute(1)); userName != expUserName {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", expUserName, userName)
+		}
+		if pass := string(req.rawAttribute(UserPasswordNumber)); pass != "CGRateSPassword1" {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "CGRateSPassword1", pass)
+		}
+		var states []string
+		for _, avp := range req.AVPs {
+			if avp.Number == ProxyStateNumber {
+				states = append(states, string(avp.RawValue))
+			}
+		}
+		if len(states) != 2 || states[0] != "nasState" {
+			t.Errorf("Unexpected Proxy-States: %q", states)
+		}
+		if !req.Has(MessageAuthenticatorNumber) {
+			t.Error("missing Message-Authenticator")
+		}
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		for _, avp := range req.AVPs {
+			if avp.Number == ProxyStateNumber {
+				rply.AVPs = append(rply.AVPs, avp)
+			}
+		}
+		rply.AddMPPEKeys([]byte("0123456789abcdef0123456789abcdef"), []byte("fedcba9876543210fedcba9876543210"))
+		return rply, nil
+	}
+}
+
+func TestProxyForward(t *testing.T) {
+	px := NewProxy(nil)
+	px.AddRoute("CGRateS.org", &ProxyRoute{StripRealm: true,
+		HomeServers: []HomeServer{newLoopback(testProxyHome(t, "flopsy"), RFC2865Dictionary(), "homeSecret")}})
+	rply, err := testProxyRequest(t, px, "flopsy@cgrates.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	var states []string
+	for _, avp := range rply.AVPs {
+		if avp.Number == ProxyStateNumber {
+			states = append(states, string(avp.RawValue))
+		}
+	}
+	if exp := []string{"nasState"}; !reflect.DeepEqual(exp, states) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, states)
+	}
+	sendKey, recvKey := rply.MPPEKeys() // decrypted with the NAS secret
+	if string(sendKey) != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "0123456789abcdef0123456789abcdef", string(sendKey))
+	}
+	if string(recvKey) != "fedcba9876543210fedcba9876543210" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", "fedcba9876543210fedcba9876543210", string(recvKey))
+	}
+}
+
+func TestProxyForwardCHAP(t *testing.T) {
+	px := NewProxy(nil)
+	px.AddRoute(MetaDefault, &ProxyRoute{HomeServers: []HomeServer{newLoopback(func(req *Packet) (*Packet, error) {
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		if err := req.VerifyCHAP("CGRateSPassword1"); err != nil {
+			rply.Code = AccessReject
+		}
+		return rply, nil
+	}, RFC2865Dictionary(), "homeSecret")}})
+	nas := newLoopback(px.HandleRequest, RFC2865Dictionary(), "nasSecret")
+	req := nas.NewRequest(AccessRequest, 1)
+	req.AVPs = append(req.AVPs,
+		&AVP{Number: 1, RawValue: []byte("flopsy@cgrates.org")},
+		&AVP{Number: CHAPPasswordNumber, RawValue: EncodeCHAPPassword([]byte("CGRateSPassword1"), req.Authenticator[:])})
+	req.AddMessageAuthenticator()
+	if rply, err := nas.SendRequest(req); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+}
+
+func TestProxyDefaultRouteFailover(t *testing.T) {
+	px := NewProxy(nil)
+	px.AddRoute(MetaDefault, &ProxyRoute{HomeServers: []HomeServer{
+		newLoopback(func(*Packet) (*Packet, error) { return nil, nil }, RFC2865Dictionary(), "homeSecret"), // no reply
+		newLoopback(testProxyHome(t, "flopsy@other.org"), RFC2865Dictionary(), "homeSecret2"),
+	}})
+	if rply, err := testProxyRequest(t, px, "flopsy@other.org"); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	if rply, err := testProxyRequest(t, px, "flopsy"); err != nil { // no realm, no fallback
+		t.Fatal(err)
+	} else if rply.Code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, rply.Code)
+	} else if msg := string(rply.rawAttribute(ReplyMessage)); msg != ErrNoProxyRoute.Error() {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrNoProxyRoute.Error(), msg)
+	}
+}
+
+func TestProxyFallback(t *testing.T) {
+	var fallbacks int
+	px := NewProxy(func(req *Packet) (*Packet, error) {
+		fallbacks++
+		if pass := string(req.rawAttribute(UserPasswordNumber)); pass != "CGRateSPassword1" {
+			return nil, errors.New("wrong password")
+		}
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply, nil
+	})
+	px.AddRoute("cgrates.org", &ProxyRoute{HomeServers: []HomeServer{
+		newLoopback(func(*Packet) (*Packet, error) { return nil, nil }, RFC2865Dictionary(), "homeSecret")}})
+	for _, userName := range []string{"flopsy", "flopsy@cgrates.org"} {
+		if rply, err := testProxyRequest(t, px, userName); err != nil {
+			t.Fatal(err)
+		} else if rply.Code != AccessAccept {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+		}
+	}
+	if fallbacks != 2 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, fallbacks)
+	}
+}
+
+func TestProxyLoop(t *testing.T) {
+	px := NewProxy(nil)
+	px.AddRoute("cgrates.org", &ProxyRoute{HomeServers: []HomeServer{
+		newLoopback(px.HandleRequest, RFC2865Dictionary(), "homeSecret")}}) // forwarding to itself
+	rply, err := testProxyRequest(t, px, "flopsy@cgrates.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rply.Code != AccessReject {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessReject, rply.Code)
+	} else if msg := string(rply.rawAttribute(ReplyMessage)); msg != ErrProxyLoop.Error() {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrProxyLoop.Error(), msg)
+	}
+}
+
+func TestProxyRealmMatcher(t *testing.T) {
+	px := NewProxy(nil)
+	px.SetRealmMatcher(func(req *Packet) string {
+		return string(req.rawAttribute(30)) // Called-Station-Id
+	})
+	px.AddRoute("hotspot", &ProxyRoute{HomeServers: []HomeServer{
+		newLoopback(testProxyHome(t, "flopsy"), RFC2865Dictionary(), "homeSecret")}})
+	nas := newLoopback(px.HandleRequest, testProxyNASDict(t), "nasSecret")
+	req := nas.NewRequest(AccessRequest, 1)
+	req.AVPs = append(req.AVPs,
+		&AVP{Number: 1, RawValue: []byte("flopsy")},
+		&AVP{Number: UserPasswordNumber, RawValue: []byte("CGRateSPassword1")},
+		&AVP{Number: 30, RawValue: []byte("HotSpot")},
+		&AVP{Number: ProxyStateNumber, RawValue: []byte("nasState")})
+	req.AddMessageAuthenticator()
+	if rply, err := nas.SendRequest(req); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+}
@@ -0,0 +1,215 @@
+package radigo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ClientState is the health of the Client connection
+type ClientState uint8
+
+const (
+	ClientConnected    ClientState = iota // at least one connection is open
+	ClientReconnecting                    // connection lost, reconnecting in the background
+	ClientDisconnected                    // reconnection failed after connAttempts, retried on the next request
+	ClientClosed                          // closed by the user
+)
+
+func (cs ClientState) String() string {
+	switch cs {
+	case ClientConnected:
+		return "connected"
+	case ClientReconnecting:
+		return "reconnecting"
+	case ClientDisconnected:
+		return "disconnected"
+	case ClientClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+const (
+	MetaFail  = "*fail"  // requests fail while the client is not connected
+	MetaQueue = "*queue" // requests wait for the reconnection, the ones in flight are sent again
+
+	clientStateQueue = 16 // state changes buffered before dropping
+)
+
+var (
+	ErrConnectionLost = errors.New("connection lost")
+	ErrNotConnected   = errors.New("client not connected")
+	ErrClientClosed   = errors.New("client closed")
+)
+
+// State returns the current state of the connection
+func (c *Client) State() ClientState {
+	c.aReqsMux.Lock()
+	defer c.aReqsMux.Unlock()
+	return c.state
+}
+
+// StateChanges returns the channel publishing the state changes, closed when the client is closed
+// changes are dropped if not consumed
+func (c *Client) StateChanges() <-chan ClientState {
+	return c.stateChn
+}
+
+// SetDisconnectPolicy controls the requests while the client is not connected, MetaFail (default) or MetaQueue
+// queued requests wait for the reconnection until their context is done
+func (c *Client) SetDisconnectPolicy(policy string) {
+	c.aReqsMux.Lock()
+	c.queueDisconnected = policy == MetaQueue
+	c.aReqsMux.Unlock()
+}
+
+// Close disconnects the client, failing the requests in flight and stopping the reconnects
+func (c *Client) Close() error {
+	c.aReqsMux.Lock()
+	c.setState(ClientClosed)
+	c.aReqsMux.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.disconnect()
+	return nil
+}
+
+// setState changes the state, publishing it, called with aReqsMux locked
+// the closed state is final
+func (c *Client) setState(state ClientState) {
+	if c.state == state || c.state == ClientClosed {
+		return
+	}
+	c.state = state
+	if c.stateChg != nil { // wake up the waiters
+		close(c.stateChg)
+		c.stateChg = nil
+	}
+	select {
+	case c.stateChn <- state:
+	default:
+	}
+	if state == ClientClosed && c.stateChn != nil {
+		close(c.stateChn)
+	}
+}
+
+// connLost closes the socket after a read error, reconnecting in the background if it was the last one
+func (c *Client) connLost(sock *clientSocket) {
+	c.aReqsMux.Lock()
+	if c.closeSocket(sock) && len(c.socks) == 0 && c.state == ClientConnected {
+		c.startReconnect()
+	}
+	c.aReqsMux.Unlock()
+}
+
+// startReconnect reconnects in the background, called with aReqsMux locked
+func (c *Client) startReconnect() {
+	c.setState(ClientReconnecting)
+	go c.reconnect()
+}
+
+// reconnect dials a new connection, retrying on Fibonacci backoff until connAttempts, -1 for infinite
+func (c *Client) reconnect() {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	connAttempts := c.connAttempts
+	if connAttempts == 0 {
+		connAttempts = 1
+	}
+	connDelay := fib()
+	for i := 1; ; i++ {
+		conn, err := c.dial(ctx)
+		c.aReqsMux.Lock()
+		if c.state == ClientClosed {
+			c.aReqsMux.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err == nil {
+			c.addSocket(conn)
+			c.setState(ClientConnected)
+			c.aReqsMux.Unlock()
+			return
+		}
+		if connAttempts != -1 && i >= connAttempts {
+			c.setState(ClientDisconnected)
+			c.aReqsMux.Unlock()
+			return
+		}
+		c.aReqsMux.Unlock()
+		tmr := time.NewTimer(time.Duration(connDelay()) * time.Second)
+		select {
+		case <-ctx.Done():
+			tmr.Stop()
+			return
+		case <-tmr.C:
+		}
+	}
+}
+
+// waitReconnect blocks until the reconnection ends, returning nil if connected
+func (c *Client) waitReconnect(ctx context.Context) error {
+	for {
+		c.aReqsMux.Lock()
+		state := c.state
+		if c.stateChg == nil {
+			c.stateChg = make(chan struct{})
+		}
+		stateChg := c.stateChg
+		c.aReqsMux.Unlock()
+		switch state {
+		case ClientConnected:
+			return nil
+		case ClientDisconnected:
+			return ErrNotConnected
+		case ClientClosed:
+			return ErrClientClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stateChg:
+		}
+	}
+}
+
+// transmitConnected transmits the request, waiting for the reconnection with MetaQueue policy
+func (c *Client) transmitConnected(ctx context.Context, req *Packet,
+	rplyChn chan *Packet) (sock *clientSocket, b []byte, err error) {
+	for {
+		if sock, b, err = c.transmit(ctx, req, rplyChn); err != ErrNotConnected {
+			return
+		}
+		c.aReqsMux.Lock()
+		queue := c.queueDisconnected
+		c.aReqsMux.Unlock()
+		if !queue {
+			return
+		}
+		if err = c.waitReconnect(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// resend transmits again the request which lost it's connection, based on the disconnect policy
+func (c *Client) resend(ctx context.Context, req *Packet,
+	rplyChn chan *Packet) (sock *clientSocket, b []byte, err error) {
+	c.aReqsMux.Lock()
+	state, queue := c.state, c.queueDisconnected
+	c.aReqsMux.Unlock()
+	if state == ClientClosed {
+		return nil, nil, ErrClientClosed
+	}
+	if !queue {
+		return nil, nil, ErrConnectionLost
+	}
+	return c.transmitConnected(ctx, req, rplyChn)
+}
@@ -0,0 +1,141 @@
+package radigo
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testReconnectServer accepts the TCP requests, closing the connection instead of answering while drop is set
+func testReconnectServer(t *testing.T, drop *atomic.Bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					b := make([]byte, MaxPacketLen)
+					if _, err := io.ReadFull(conn, b[:4]); err != nil {
+						return
+					}
+					pktLen := binary.BigEndian.Uint16(b[2:4])
+					if _, err := io.ReadFull(conn, b[4:pktLen]); err != nil {
+						return
+					}
+					if drop.CompareAndSwap(true, false) {
+						return
+					}
+					req := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+					if err := req.Decode(b[:pktLen]); err != nil {
+						t.Error(err)
+						return
+					}
+					rply := req.Reply()
+					rply.Code = AccessAccept
+					n, err := rply.Encode(b)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					conn.Write(b[:n])
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testStateChange returns the next state published by the client
+func testStateChange(t *testing.T, clnt *Client) ClientState {
+	select {
+	case state := <-clnt.StateChanges():
+		return state
+	case <-time.After(time.Second):
+		t.Fatal("no state change")
+	}
+	return 0
+}
+
+func TestClientReconnectQueue(t *testing.T) {
+	var drop atomic.Bool
+	clnt, err := NewClient("tcp", testReconnectServer(t, &drop), "CGRateS.org", RFC2865Dictionary(), 3, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Close()
+	clnt.SetDisconnectPolicy(MetaQueue)
+	drop.Store(true)
+	if rply, err := clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != nil { // sent again after reconnect
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	if state := testStateChange(t, clnt); state != ClientReconnecting {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ClientReconnecting, state)
+	}
+	if state := testStateChange(t, clnt); state != ClientConnected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ClientConnected, state)
+	}
+	if state := clnt.State(); state != ClientConnected {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ClientConnected, state)
+	}
+}
+
+func TestClientReconnectFail(t *testing.T) {
+	var drop atomic.Bool
+	clnt, err := NewClient("tcp", testReconnectServer(t, &drop), "CGRateS.org", RFC2865Dictionary(), 3, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clnt.Close()
+	drop.Store(true)
+	if _, err = clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != ErrConnectionLost {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrConnectionLost, err)
+	}
+	testStateChange(t, clnt) // ClientReconnecting
+	if state := testStateChange(t, clnt); state != ClientConnected {
+		t.Fatalf("Expected: <%+v>, \nReceived: <%+v>", ClientConnected, state)
+	}
+	if rply, err := clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	var drop atomic.Bool
+	clnt, err := NewClient("tcp", testReconnectServer(t, &drop), "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if state := clnt.State(); state != ClientClosed {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ClientClosed, state)
+	}
+	if _, err = clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != ErrClientClosed {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrClientClosed, err)
+	}
+	if state := testStateChange(t, clnt); state != ClientClosed {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ClientClosed, state)
+	}
+	if _, open := <-clnt.StateChanges(); open {
+		t.Error("state changes not closed")
+	}
+	if err = clnt.Close(); err != nil { // idempotent
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,113 @@
+package radigo
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// ReplyCacheTTL is the default lifetime of the cached replies, covering the NAS retransmissions
+	ReplyCacheTTL = 5 * time.Second
+	// ReplyCacheMaxEntries is the default limit of the cached replies
+	ReplyCacheMaxEntries = 8192
+)
+
+// replyCacheKey identifies the request for duplicate detection, rfc5080 2.2.2
+// client is the source address (IP and port) of the request
+func replyCacheKey(client string, rawReq []byte) string {
+	return client + "/" + string(rawReq[1:2]) + string(rawReq[4:20])
+}
+
+func newReplyCache(ttl time.Duration, maxEntries int) *replyCache {
+	return &replyCache{ttl: ttl, maxEntries: maxEntries,
+		entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// replyCache remembers the requests processed recently together with their reply
+type replyCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	order      *list.List // *replyCacheEntry, oldest first
+}
+
+type replyCacheEntry struct {
+	key     string
+	done    bool   // reply was sent
+	rply    []byte // wire bytes of the reply, nil if none was sent
+	expires time.Time
+}
+
+// start registers the request, returning true if it is a duplicate
+// rply is the cached reply of a processed duplicate, nil if the original is still in flight
+func (rc *replyCache) start(key string) (rply []byte, isDup bool) {
+	now := time.Now()
+	rc.Lock()
+	defer rc.Unlock()
+	for elm := rc.order.Front(); elm != nil; elm = rc.order.Front() { // remove the expired entries
+		if entry := elm.Value.(*replyCacheEntry); now.Before(entry.expires) &&
+			len(rc.entries) < rc.maxEntries {
+			break
+		}
+		rc.remove(elm)
+	}
+	if elm, has := rc.entries[key]; has {
+		entry := elm.Value.(*replyCacheEntry)
+		return entry.rply, true
+	}
+	rc.entries[key] = rc.order.PushBack(&replyCacheEntry{key: key, expires: now.Add(rc.ttl)})
+	return nil, false
+}
+
+// finish caches the reply of the request, nil if no reply was sent
+func (rc *replyCache) finish(key string, rply []byte) {
+	rc.Lock()
+	defer rc.Unlock()
+	elm, has := rc.entries[key]
+	if !has { // evicted in the meantime
+		return
+	}
+	entry := elm.Value.(*replyCacheEntry)
+	entry.done, entry.rply, entry.expires = true, rply, time.Now().Add(rc.ttl)
+	rc.order.MoveToBack(elm)
+}
+
+// forget removes the request not processed, so it's retransmissions are not considered duplicates
+func (rc *replyCache) forget(key string) {
+	rc.Lock()
+	defer rc.Unlock()
+	if elm, has := rc.entries[key]; has {
+		rc.remove(elm)
+	}
+}
+
+func (rc *replyCache) remove(elm *list.Element) {
+	delete(rc.entries, elm.Value.(*replyCacheEntry).key)
+	rc.order.Remove(elm)
+}
+
+// SetReplyCache enables the duplicate detection for requests, rfc5080 2.2.2
+// retransmissions of a request in flight are dropped, the ones of a processed request receive the cached reply
+// ttl of 0 disables the cache, maxEntries bounds it's memory usage
+func (s *Server) SetReplyCache(ttl time.Duration, maxEntries int) {
+	var rc *replyCache
+	if ttl > 0 {
+		if maxEntries <= 0 {
+			maxEntries = ReplyCacheMaxEntries
+		}
+		rc = newReplyCache(ttl, maxEntries)
+	}
+	s.rcMux.Lock()
+	s.rplyCache = rc
+	s.rcMux.Unlock()
+}
+
+// replyCache returns the reply cache, nil if disabled
+func (s *Server) replyCache() (rc *replyCache) {
+	s.rcMux.RLock()
+	rc = s.rplyCache
+	s.rcMux.RUnlock()
+	return
+}
@@ -0,0 +1,98 @@
+package radigo
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplyCache(t *testing.T) {
+	rc := newReplyCache(20*time.Millisecond, 2)
+	if _, isDup := rc.start("req1"); isDup {
+		t.Error("first request detected as duplicate")
+	}
+	if rply, isDup := rc.start("req1"); !isDup || rply != nil { // in flight
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", []interface{}{nil, true}, []interface{}{rply, isDup})
+	}
+	rc.finish("req1", []byte("rply1"))
+	if rply, isDup := rc.start("req1"); !isDup || string(rply) != "rply1" {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", []interface{}{"rply1", true}, []interface{}{string(rply), isDup})
+	}
+	rc.start("req2")
+	rc.start("req3") // evicts req1 as oldest
+	if len(rc.entries) != 2 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, len(rc.entries))
+	}
+	if _, has := rc.entries["req1"]; has {
+		t.Error("req1 not evicted")
+	}
+	rc.finish("req1", []byte("rply1")) // evicted, ignored
+	time.Sleep(30 * time.Millisecond)
+	if _, isDup := rc.start("req2"); isDup {
+		t.Error("expired request detected as duplicate")
+	}
+	if len(rc.entries) != 1 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, len(rc.entries))
+	}
+}
+
+func TestServerReplyCache(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	srv := NewServer("udp", ":1812", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){AccessRequest: func(req *Packet) (*Packet, error) {
+			calls.Add(1)
+			<-release
+			rply := req.Reply()
+			rply.Code = AccessAccept
+			return rply, nil
+		}}, nil, nil)
+	srv.SetReplyCache(ReplyCacheTTL, 0)
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	copy(req.Authenticator[:], "0123456789abcdef")
+	var buf [MaxPacketLen]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 2)}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	srv.handleRcvedBytes(buf[:n], synConn) // in flight, dropped
+	close(release)
+	var rply []byte
+	select {
+	case rply = <-synConn.rplyChn:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("no reply received")
+	}
+	srv.handleRcvedBytes(buf[:n], synConn) // processed, cached reply sent
+	select {
+	case b := <-synConn.rplyChn:
+		if !bytes.Equal(rply, b) {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", rply, b)
+		}
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("no cached reply received")
+	}
+	if nrCalls := calls.Load(); nrCalls != 1 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, nrCalls)
+	}
+	if dups := srv.Stats().AuthDuplicates; dups != 2 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, dups)
+	}
+	req.Identifier = 2 // new request, processed again
+	if n, err = req.Encode(buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	select {
+	case <-synConn.rplyChn:
+	case <-time.After(50 * time.Millisecond):
+		t.Fatal("no reply received")
+	}
+	if nrCalls := calls.Load(); nrCalls != 2 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, nrCalls)
+	}
+}
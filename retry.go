@@ -0,0 +1,123 @@
+package radigo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const AcctDelayTimeNumber = 41 // Acct-Delay-Time AVP number, rfc2866 5.2
+
+var (
+	// DefaultRetryPolicy waits one second for the reply, without retransmissions
+	DefaultRetryPolicy = RetryPolicy{IRT: time.Second, MRD: time.Second}
+	// RFC5080RetryPolicy uses the values recommended in rfc5080 2.2.1
+	RFC5080RetryPolicy = RetryPolicy{IRT: 2 * time.Second, MRC: 5, MRT: 16 * time.Second,
+		MRD: 30 * time.Second, Jitter: 0.1}
+
+	ErrTimeout           = errors.New("timeout waiting for reply")
+	ErrReplyNotAuthentic = errors.New("reply not authentic")
+	errInvalidIRT        = errors.New("initial retransmission time should be positive")
+)
+
+// RetryPolicy controls the retransmissions of the client requests, rfc5080 2.2.1
+// the retransmissions stop on MRC or MRD, whichever is hit first, 0 disabling the limit
+// over stream transports the requests are not retransmitted, the policy gives only the time to wait for the reply
+type RetryPolicy struct {
+	IRT    time.Duration // initial retransmission time
+	MRT    time.Duration // maximum retransmission time, 0 for no limit
+	MRC    int           // maximum retransmission count, 0 for no limit
+	MRD    time.Duration // maximum retransmission duration, 0 for no limit
+	Jitter float64       // randomization factor of the retransmission times, 0.1 in rfc5080
+}
+
+// jitter randomizes rt with the Jitter factor
+func (rp RetryPolicy) jitter(rt time.Duration) time.Duration {
+	return rt + time.Duration((rand.Float64()*2-1)*rp.Jitter*float64(rt))
+}
+
+// initialRT returns the time to wait for the reply of the first transmission
+func (rp RetryPolicy) initialRT() time.Duration {
+	return rp.limitRT(rp.jitter(rp.IRT), 0)
+}
+
+// nextRT returns the time to wait after a retransmission, doubling the previous one up to MRT
+func (rp RetryPolicy) nextRT(rt, elapsed time.Duration) time.Duration {
+	rt = rp.jitter(2 * rt)
+	if rp.MRT != 0 && rt > rp.MRT {
+		rt = rp.jitter(rp.MRT)
+	}
+	return rp.limitRT(rt, elapsed)
+}
+
+// limitRT cuts rt so the waiting stops on MRD
+func (rp RetryPolicy) limitRT(rt, elapsed time.Duration) time.Duration {
+	if rp.MRD != 0 && elapsed+rt > rp.MRD {
+		rt = rp.MRD - elapsed
+	}
+	return rt
+}
+
+// exhausted returns true when no more retransmissions are allowed
+func (rp RetryPolicy) exhausted(retrans int, elapsed time.Duration) bool {
+	return (rp.MRC != 0 && retrans >= rp.MRC) ||
+		(rp.MRD != 0 && elapsed >= rp.MRD)
+}
+
+// TimeoutError is returned when the request is not answered within the RetryPolicy limits
+// matches ErrTimeout with errors.Is
+type TimeoutError struct {
+	Retransmissions int
+	Elapsed         time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("%s after %d retransmissions in %s", ErrTimeout, err.Retransmissions, err.Elapsed)
+}
+
+func (err *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// Timeout is part of net.Error interface
+func (err *TimeoutError) Timeout() bool {
+	return true
+}
+
+// SetRetryPolicy sets the retransmissions of the requests sent by the client
+func (c *Client) SetRetryPolicy(rp RetryPolicy) error {
+	if rp.IRT <= 0 {
+		return errInvalidIRT
+	}
+	c.aReqsMux.Lock()
+	c.retryPolicy = rp
+	c.aReqsMux.Unlock()
+	return nil
+}
+
+// acctDelayTime returns the Acct-Delay-Time AVP of the accounting request, nil if none
+func acctDelayTime(req *Packet) *AVP {
+	if req.Code != AccountingRequest {
+		return nil
+	}
+	for _, avp := range req.AVPs {
+		if avp.Number == AcctDelayTimeNumber && len(avp.RawValue) == 4 {
+			return avp
+		}
+	}
+	return nil
+}
+
+// setAcctDelayTime updates the Acct-Delay-Time, returning false if the value did not change
+func setAcctDelayTime(avp *AVP, delay uint32) bool {
+	if binary.BigEndian.Uint32(avp.RawValue) == delay {
+		return false
+	}
+	avp.RawValue = binary.BigEndian.AppendUint32(nil, delay)
+	avp.Value = delay
+	avp.StringValue = strconv.FormatUint(uint64(delay), 10)
+	return true
+}
@@ -0,0 +1,197 @@
+package radigo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyRT(t *testing.T) {
+	rp := RetryPolicy{IRT: 2 * time.Second, MRT: 5 * time.Second, MRD: 12 * time.Second}
+	if rt := rp.initialRT(); rt != 2*time.Second {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2*time.Second, rt)
+	}
+	if rt := rp.nextRT(2*time.Second, 2*time.Second); rt != 4*time.Second {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 4*time.Second, rt)
+	}
+	if rt := rp.nextRT(4*time.Second, 6*time.Second); rt != 5*time.Second { // MRT
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 5*time.Second, rt)
+	}
+	if rt := rp.nextRT(5*time.Second, 11*time.Second); rt != time.Second { // MRD
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", time.Second, rt)
+	}
+	rp.Jitter = 0.1
+	for i := 0; i < 100; i++ {
+		if rt := rp.initialRT(); rt < 1800*time.Millisecond || rt > 2200*time.Millisecond {
+			t.Fatalf("Unexpected initial RT: %s", rt)
+		}
+	}
+	if !rp.exhausted(0, 12*time.Second) {
+		t.Error("MRD not reached")
+	}
+	rp.MRC = 3
+	if rp.exhausted(2, time.Second) || !rp.exhausted(3, time.Second) {
+		t.Error("MRC not considered")
+	}
+}
+
+// testRetryServer answers the UDP requests with the reply returned by hndlr, none if nil
+// hndlr is called with mux locked
+func testRetryServer(t *testing.T, mux *sync.Mutex, hndlr func(req *Packet, b []byte) *Packet) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		var buf [MaxPacketLen]byte
+		for {
+			n, addr, err := pc.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			req := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+			if err = req.Decode(buf[:n]); err != nil {
+				t.Error(err)
+				continue
+			}
+			mux.Lock()
+			rply := hndlr(req, buf[:n])
+			mux.Unlock()
+			if rply == nil {
+				continue
+			}
+			var rplyBuf [MaxPacketLen]byte
+			if n, err = rply.Encode(rplyBuf[:]); err != nil {
+				t.Error(err)
+				continue
+			}
+			pc.WriteTo(rplyBuf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestClientSendRequestRetransmit(t *testing.T) {
+	var rcvd [][]byte
+	var mux sync.Mutex
+	addr := testRetryServer(t, &mux, func(req *Packet, b []byte) *Packet {
+		if rcvd = append(rcvd, append([]byte{}, b...)); len(rcvd) == 1 { // lose the first transmission
+			return nil
+		}
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply
+	})
+	clnt, err := NewClient("udp", addr, "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.SetRetryPolicy(RetryPolicy{IRT: 20 * time.Millisecond, MRC: 3}); err != nil {
+		t.Fatal(err)
+	}
+	req := clnt.NewRequest(AccessRequest, 1)
+	req.AVPs = append(req.AVPs, &AVP{Number: 1, RawValue: []byte("flopsy")})
+	if rply, err := clnt.SendRequest(req); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(rcvd) != 2 {
+		t.Fatalf("Expected: <%+v>, \nReceived: <%+v>", 2, len(rcvd))
+	}
+	if !bytes.Equal(rcvd[0], rcvd[1]) { // same Identifier and Authenticator
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", rcvd[0], rcvd[1])
+	}
+}
+
+func TestClientSendRequestAcctDelayTime(t *testing.T) {
+	var rcvd []*Packet
+	var mux sync.Mutex
+	addr := testRetryServer(t, &mux, func(req *Packet, b []byte) *Packet {
+		if rcvd = append(rcvd, req); len(rcvd) == 1 {
+			return nil
+		}
+		rply := req.Reply()
+		rply.Code = AccountingResponse
+		return rply
+	})
+	clnt, err := NewClient("udp", addr, "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.SetRetryPolicy(RetryPolicy{IRT: 1100 * time.Millisecond, MRC: 1}); err != nil {
+		t.Fatal(err)
+	}
+	req := clnt.NewRequest(AccountingRequest, 1)
+	req.AVPs = append(req.AVPs, &AVP{Number: AcctDelayTimeNumber, RawValue: []byte{0, 0, 0, 2}})
+	if rply, err := clnt.SendRequest(req); err != nil {
+		t.Fatal(err)
+	} else if rply.Code != AccountingResponse {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccountingResponse, rply.Code)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(rcvd) != 2 {
+		t.Fatalf("Expected: <%+v>, \nReceived: <%+v>", 2, len(rcvd))
+	}
+	if delay := binary.BigEndian.Uint32(rcvd[1].rawAttribute(AcctDelayTimeNumber)); delay != 3 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 3, delay)
+	}
+	if rcvd[0].Identifier == rcvd[1].Identifier {
+		t.Errorf("Identifier not changed: %d", rcvd[1].Identifier)
+	}
+}
+
+func TestClientSendRequestErrors(t *testing.T) {
+	var nrRcvd int
+	var mux sync.Mutex
+	addr := testRetryServer(t, &mux, func(req *Packet, b []byte) *Packet {
+		nrRcvd++
+		return nil
+	})
+	clnt, err := NewClient("udp", addr, "CGRateS.org", RFC2865Dictionary(), 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.SetRetryPolicy(RetryPolicy{IRT: 10 * time.Millisecond, MRC: 2}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = clnt.SendRequest(clnt.NewRequest(AccessRequest, 1))
+	var tErr *TimeoutError
+	if !errors.Is(err, ErrTimeout) || !errors.As(err, &tErr) {
+		t.Fatalf("Expected: <%+v>, \nReceived: <%+v>", ErrTimeout, err)
+	} else if tErr.Retransmissions != 2 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 2, tErr.Retransmissions)
+	}
+	mux.Lock()
+	if nrRcvd != 3 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 3, nrRcvd)
+	}
+	mux.Unlock()
+
+	addr = testRetryServer(t, &mux, func(req *Packet, b []byte) *Packet {
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		rply.secret = "InvalidSecret"
+		return rply
+	})
+	if clnt, err = NewClient("udp", addr, "CGRateS.org", RFC2865Dictionary(), 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = clnt.SetRetryPolicy(RetryPolicy{IRT: 10 * time.Millisecond, MRC: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = clnt.SendRequest(clnt.NewRequest(AccessRequest, 1)); err != ErrReplyNotAuthentic {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", ErrReplyNotAuthentic, err)
+	}
+	if err = clnt.SetRetryPolicy(RetryPolicy{}); err != errInvalidIRT {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", errInvalidIRT, err)
+	}
+}
@@ -1,21 +1,25 @@
 package radigo
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cgrates/radigo/codecs"
 )
 
 const (
 	MetaDefault  = "*default" // default client
-	MaxPacketLen = 4095
+	MaxPacketLen = 4096       // rfc2865 3
 )
 
 // NewSecrets intantiates Secrets
@@ -29,7 +33,9 @@ func NewSecrets(sts map[string]string) *Secrets {
 // Secrets centralizes RADIUS secrets so it can be safely accessed over different server instances
 type Secrets struct {
 	sync.RWMutex
-	secrets map[string]string
+	secrets    map[string]string
+	reqMsgAuth map[string]bool // clients requiring Message-Authenticator in AccessRequest
+	reqDTLS    map[string]bool // clients not allowed to send plain RADIUS/UDP on DTLS listeners
 }
 
 // GetSecret returns secret for specific instanceID
@@ -44,6 +50,60 @@ func (sts *Secrets) GetSecret(instanceID string) (scrt string) {
 	return
 }
 
+// SetRequireMessageAuthenticator enforces Message-Authenticator in the AccessRequests of instanceID
+// use MetaDefault for server wide enforcement
+func (sts *Secrets) SetRequireMessageAuthenticator(instanceID string, require bool) {
+	sts.Lock()
+	if sts.reqMsgAuth == nil {
+		sts.reqMsgAuth = make(map[string]bool)
+	}
+	sts.reqMsgAuth[instanceID] = require
+	sts.Unlock()
+}
+
+// RequireMessageAuthenticator returns true if the AccessRequests of instanceID should contain Message-Authenticator
+// Returns default if no instanceID found
+func (sts *Secrets) RequireMessageAuthenticator(instanceID string) (req bool) {
+	sts.RLock()
+	req, hasKey := sts.reqMsgAuth[instanceID]
+	if !hasKey {
+		req = sts.reqMsgAuth[MetaDefault]
+	}
+	sts.RUnlock()
+	return
+}
+
+// SetRequireDTLS refuses plain RADIUS/UDP from instanceID on DTLS listeners, rfc7360 5.1
+// use MetaDefault for server wide enforcement
+func (sts *Secrets) SetRequireDTLS(instanceID string, require bool) {
+	sts.Lock()
+	if sts.reqDTLS == nil {
+		sts.reqDTLS = make(map[string]bool)
+	}
+	sts.reqDTLS[instanceID] = require
+	sts.Unlock()
+}
+
+// RequireDTLS returns true if instanceID is allowed to communicate only over DTLS
+// Returns default if no instanceID found
+func (sts *Secrets) RequireDTLS(instanceID string) (req bool) {
+	sts.RLock()
+	req, hasKey := sts.reqDTLS[instanceID]
+	if !hasKey {
+		req = sts.reqDTLS[MetaDefault]
+	}
+	sts.RUnlock()
+	return
+}
+
+// getSecret returns the secret for instanceID without considering the default
+func (sts *Secrets) getSecret(instanceID string) (scrt string, has bool) {
+	sts.RLock()
+	scrt, has = sts.secrets[instanceID]
+	sts.RUnlock()
+	return
+}
+
 func connIDFromAddr(addr string) (connID string) {
 	if idx := strings.Index(addr, "]:"); idx != -1 {
 		connID = addr[1:idx] // ipv6 addr
@@ -53,16 +113,26 @@ func connIDFromAddr(addr string) (connID string) {
 	return
 }
 
-// syncedTCPConn writes replies over a TCP connection
+// syncedTCPConn writes replies over a connection oriented transport (TCP, TLS, DTLS session)
 type syncedTCPConn struct {
-	connID string
-	conn   net.Conn
+	connID   string
+	secret   string // fixed secret (ie: RadSec), Secrets are queried if empty
+	conn     net.Conn
+	network  string            // tcp, tls or dtls
+	peerCert *x509.Certificate // presented by the client on the secure transports
 }
 
 func (c *syncedTCPConn) getConnID() string {
 	return c.connID
 }
 
+func (c *syncedTCPConn) getSecret(sts *Secrets) string {
+	if c.secret != "" {
+		return c.secret
+	}
+	return sts.GetSecret(c.connID)
+}
+
 func (c *syncedTCPConn) write(b []byte) (err error) {
 	_, err = c.conn.Write(b)
 	return
@@ -72,10 +142,23 @@ func (c *syncedTCPConn) remoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+func (c *syncedTCPConn) localAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *syncedTCPConn) transport() string {
+	return c.network
+}
+
+func (c *syncedTCPConn) peerCertificate() *x509.Certificate {
+	return c.peerCert
+}
+
 // syncedUDPConn write replies over a UDP connection
 type syncedUDPConn struct {
 	connID string
 	addr   net.Addr
+	laddr  net.Addr // listener address
 	pc     net.PacketConn
 }
 
@@ -83,6 +166,10 @@ func (c *syncedUDPConn) getConnID() string {
 	return c.connID
 }
 
+func (c *syncedUDPConn) getSecret(sts *Secrets) string {
+	return sts.GetSecret(c.connID)
+}
+
 func (c *syncedUDPConn) write(b []byte) (err error) {
 	_, err = c.pc.WriteTo(b, c.addr)
 	return
@@ -92,11 +179,27 @@ func (c *syncedUDPConn) remoteAddr() net.Addr {
 	return c.addr
 }
 
+func (c *syncedUDPConn) localAddr() net.Addr {
+	return c.laddr
+}
+
+func (c *syncedUDPConn) transport() string {
+	return "udp"
+}
+
+func (c *syncedUDPConn) peerCertificate() *x509.Certificate {
+	return nil
+}
+
 // syncedConn is the interface for securely writing on both UDP and TCP connections
 type syncedConn interface {
 	getConnID() string
+	getSecret(*Secrets) string
 	write([]byte) error
 	remoteAddr() net.Addr
+	localAddr() net.Addr
+	transport() string
+	peerCertificate() *x509.Certificate
 }
 
 // sendReply writes the reply over the synced connection
@@ -110,12 +213,27 @@ func sendReply(synConn syncedConn, rply *Packet) (err error) {
 	return synConn.write(buf[:n])
 }
 
+// sendCachedReply sends the reply, keeping it in rc for the retransmissions of the request
+// nil rc sends the reply without caching
+func sendCachedReply(synConn syncedConn, rply *Packet, rc *replyCache, rcKey string) (err error) {
+	if rc == nil {
+		return sendReply(synConn, rply)
+	}
+	var buf [MaxPacketLen]byte
+	var n int
+	if n, err = rply.Encode(buf[:]); err != nil {
+		rc.finish(rcKey, nil) // drop the retransmissions
+		return
+	}
+	b := append([]byte{}, buf[:n]...)
+	rc.finish(rcKey, b)
+	return synConn.write(b)
+}
+
 func NewServer(net, addr string, secrets *Secrets, dicts *Dictionaries,
 	reqHandlers map[PacketCode]func(*Packet) (*Packet, error),
 	avpCoders map[string]codecs.AVPCoder, l logger) *Server {
-	if l == nil || (reflect.ValueOf(l).Kind() == reflect.Ptr && reflect.ValueOf(l).IsNil()) {
-		l = nopLogger{}
-	}
+	l = orNopLogger(l)
 	coder := NewCoder()
 	for k, v := range avpCoders {
 		coder[k] = v
@@ -124,16 +242,39 @@ func NewServer(net, addr string, secrets *Secrets, dicts *Dictionaries,
 		dicts: dicts, reqHandlers: reqHandlers, coder: coder, l: l}
 }
 
+// NewTLSServer creates a Server over a secure transport (tls, dtls)
+func NewTLSServer(net, addr string, tlsCfg *tls.Config, secrets *Secrets, dicts *Dictionaries,
+	reqHandlers map[PacketCode]func(*Packet) (*Packet, error),
+	avpCoders map[string]codecs.AVPCoder, l logger) *Server {
+	srv := NewServer(net, addr, secrets, dicts, reqHandlers, avpCoders, l)
+	srv.tlsCfg = tlsCfg
+	return srv
+}
+
 // Server represents a single listener on a port
 type Server struct {
-	net         string                                        // tcp, udp ...
+	net         string                                        // tcp, udp, tls, dtls ...
 	addr        string                                        // host:port or :port
+	tlsCfg      *tls.Config                                   // used by the secure transports
 	secrets     *Secrets                                      // client bounded secrets, *default for server wide
 	dicts       *Dictionaries                                 // client bounded dictionaries, *default for server wide
 	reqHandlers map[PacketCode]func(*Packet) (*Packet, error) // map[PacketCode]handler, 0 for default
+	ctxHandlers map[PacketCode]HandlerFunc                    // context aware handlers, taking precedence
+	mws         []Middleware                                  // wrapping all the handlers
+	codeMws     map[PacketCode][]Middleware                   // wrapping the handler of the packet code
 	coder       Coder                                         // codecs for AVP values
-	rhMux       sync.RWMutex                                  // protects reqHandlers
+	rhMux       sync.RWMutex                                  // protects the handlers, middlewares and ctx
+	ctx         context.Context                               // cancelled on shutdown
+	reqTimeout  atomic.Int64                                  // handler deadline, 0 for none
 	l           logger
+	stats       serverStats // counters, reported in Status-Server replies if statusStats
+	statusStats atomic.Bool
+	acctServer  atomic.Bool // accounting listener, answering Status-Server with Accounting-Response
+	rplyCache   *replyCache // duplicate detection, nil if disabled
+	rcMux       sync.RWMutex
+	wp          *workerPool     // bounded request processing, nil for one goroutine per request
+	serving     <-chan struct{} // stopChan while serving, nil otherwise
+	wpMux       sync.RWMutex    // protects wp and serving
 }
 
 // RegisterHandler registers a new handler after the server was instantiated
@@ -141,70 +282,140 @@ type Server struct {
 func (s *Server) RegisterHandler(code PacketCode, hndlr func(*Packet) (*Packet, error)) {
 	s.rhMux.Lock()
 	s.reqHandlers[code] = hndlr
+	delete(s.ctxHandlers, code)
 	s.rhMux.Unlock()
 }
 
 // handleRcvBytes is common method for both udp and tcp to handle received bytes over network
 func (s *Server) handleRcvedBytes(rcv []byte, synConn syncedConn) {
-	if !isAuthenticReq(rcv, []byte(s.secrets.GetSecret(synConn.getConnID()))) {
+	rcvd := time.Now()
+	s.stats.started()
+	secret := synConn.getSecret(s.secrets)
+	if !isAuthenticReq(rcv, []byte(secret)) {
+		if len(rcv) != 0 {
+			s.stats.invalid(PacketCode(rcv[0]))
+		}
 		return
 	}
-	pkt := &Packet{secret: s.secrets.GetSecret(synConn.getConnID()),
+	code := PacketCode(rcv[0])
+	if err := checkMessageAuthenticator(rcv, secret, msgAuthAcator(rcv),
+		code == StatusServer || // rfc5997 3
+			(code == AccessRequest && s.secrets.RequireMessageAuthenticator(synConn.getConnID()))); err != nil {
+		log.Printf("error: <%s> when authenticating packet", err.Error())
+		s.stats.invalid(code)
+		return
+	}
+	pkt := &Packet{secret: secret,
 		dict:  s.dicts.GetInstance(synConn.getConnID()),
 		coder: s.coder, addr: synConn.remoteAddr()}
 	if err := pkt.Decode(rcv); err != nil {
 		log.Printf("error: <%s> when decoding packet", err.Error())
+		s.stats.malformed(code)
 		return
 	}
-	s.rhMux.RLock()
-	hndlr, hasKey := s.reqHandlers[pkt.Code]
-	s.rhMux.RUnlock()
+	s.stats.received(pkt.Code)
+	rc := s.replyCache()
+	var rcKey string
+	if rc != nil {
+		client := synConn.getConnID()
+		if addr := synConn.remoteAddr(); addr != nil {
+			client = addr.String()
+		}
+		rcKey = replyCacheKey(client, rcv)
+		if cached, isDup := rc.start(rcKey); isDup {
+			s.stats.duplicate(pkt.Code)
+			if cached != nil { // original processed, retransmit it's reply
+				if err := synConn.write(cached); err != nil {
+					log.Printf("error: <%s> sending reply", err.Error())
+				}
+			}
+			return
+		}
+	}
+	hndlr, hasKey := s.handler(pkt.Code)
+	if !hasKey && pkt.Code == StatusServer {
+		hndlr, hasKey = ContextHandler(s.statusServerReply), true
+	}
+	if hasKey {
+		hndlr = s.chain(pkt.Code, hndlr)
+	}
 	var rply *Packet
 	if !hasKey {
+		s.stats.unknownTypes.Add(1)
 		log.Printf("error: <no handler for packet with code: %d>", pkt.Code)
-		rply = pkt.NegativeReply("no handler")
-		go func() {
-			if err := sendReply(synConn, rply); err != nil {
+		if rply = s.negativeReply(pkt, "no handler"); rply == nil {
+			if rc != nil {
+				rc.finish(rcKey, nil)
+			}
+			return
+		}
+		if !s.dispatch(pkt.Code, func() {
+			if err := sendCachedReply(synConn, rply, rc, rcKey); err != nil {
 				log.Printf("error: <%s> sending reply", err.Error())
 			}
-		}()
+		}) {
+			s.overflow(pkt, synConn, rc, rcKey)
+		}
 		return
 	}
 
-	go func() { // execute the handler asynchronously
-		rply, err := hndlr(pkt)
+	if !s.dispatch(pkt.Code, func() { // execute the handler asynchronously
+		ctx, cancel := s.requestContext(newRequestInfo(synConn, rcvd))
+		defer cancel()
+		rply, err := hndlr(ctx, pkt)
 		if err != nil {
-			rply = pkt.NegativeReply(err.Error())
+			rply = s.negativeReply(pkt, err.Error())
 		}
 		if rply == nil {
+			if rc != nil {
+				rc.finish(rcKey, nil)
+			}
 			log.Printf("warning: empty reply received from handler")
 			return
 		}
-		if err := sendReply(synConn, rply); err != nil {
+		if err := sendCachedReply(synConn, rply, rc, rcKey); err != nil {
 			log.Printf("error: <%s> sending reply", err.Error())
+			return
 		}
-	}()
+		s.stats.sent(rply.Code)
+	}) {
+		s.overflow(pkt, synConn, rc, rcKey)
+	}
 }
 
-// handleConnection will listen on a single inbound connection for packets
-// disconnects on error or unexpected packet length
-// calls the handler synchronously and returns it's answer
+// handleTCPConn will listen on a single inbound connection for packets
+// disconnects on read error or framing violation, invalid packets are silently discarded (rfc6613 2.6.4)
 func (s *Server) handleTCPConn(conn net.Conn) {
-	synConn := &syncedTCPConn{conn: conn,
+	synConn := &syncedTCPConn{conn: conn, network: "tcp",
 		connID: connIDFromAddr(conn.RemoteAddr().String())}
-	for {
-		var b [MaxPacketLen]byte
-		n, err := conn.Read(b[:])
-		if err != nil {
-			s.l.Debug(fmt.Sprintf("error: <%s> when reading packets, disconnecting...", err.Error()))
+	if tlsConn, isTLS := conn.(*tls.Conn); isTLS {
+		synConn.network = "tls"
+		conn.SetDeadline(time.Now().Add(TLSHandshakeTimeout)) // peers not completing the handshake are dropped
+		if err := tlsConn.Handshake(); err != nil {
+			s.l.Debug(fmt.Sprintf("error: <%s> on TLS handshake, disconnecting...", err.Error()))
 			conn.Close()
 			return
-		} else if uint16(n) != binary.BigEndian.Uint16(b[2:4]) {
+		}
+		conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		if len(state.PeerCertificates) != 0 {
+			synConn.peerCert = state.PeerCertificates[0]
+		}
+		synConn.connID, synConn.secret = s.tlsClientID(state, synConn.connID)
+	}
+	psr := newPacketStreamReader(conn)
+	for {
+		b, err := psr.readPacket()
+		if err == errFramingViolation {
 			log.Printf("error: unexpected packet length, disconnecting...")
 			conn.Close()
 			return
+		} else if err != nil {
+			s.l.Debug(fmt.Sprintf("error: <%s> when reading packets, disconnecting...", err.Error()))
+			conn.Close()
+			return
 		}
-		s.handleRcvedBytes(b[:n], synConn)
+		s.handleRcvedBytes(b, synConn)
 	}
 }
 
@@ -240,7 +451,7 @@ func (s *Server) serveUDP(stopChan <-chan struct{}, pc net.PacketConn) error {
 				uint16(n), binary.BigEndian.Uint16(b[2:4]))
 		}
 		s.handleRcvedBytes(b[:n],
-			&syncedUDPConn{connID: connIDFromAddr(addr.String()), addr: addr, pc: pc})
+			&syncedUDPConn{connID: connIDFromAddr(addr.String()), addr: addr, laddr: pc.LocalAddr(), pc: pc})
 	}
 }
 
@@ -257,6 +468,21 @@ func (s *Server) listenAndServeTCP(stopChan <-chan struct{}) error {
 	return s.serveTCP(stopChan, ln)
 }
 
+func (s *Server) listenAndServeTLS(stopChan <-chan struct{}) error {
+	if s.tlsCfg == nil {
+		return errNoTLSConfig
+	}
+	ln, err := tls.Listen("tcp", s.addr, s.tlsCfg)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-stopChan
+		ln.Close()
+	}()
+	return s.serveTCP(stopChan, ln)
+}
+
 func (s *Server) serveTCP(stopChan <-chan struct{}, ln net.Listener) error {
 	for {
 		select {
@@ -277,12 +503,18 @@ func (s *Server) serveTCP(stopChan <-chan struct{}, ln net.Listener) error {
 }
 
 // ListenAndServe binds to a port and serves requests
+// the handler contexts are cancelled once stopChan is closed
 func (s *Server) ListenAndServe(stopChan <-chan struct{}) error {
+	s.serveContext(stopChan)
 	switch s.net {
 	case "udp":
 		return s.listenAndServeUDP(stopChan)
 	case "tcp":
 		return s.listenAndServeTCP(stopChan)
+	case "tls":
+		return s.listenAndServeTLS(stopChan)
+	case "dtls":
+		return s.listenAndServeDTLS(stopChan)
 	default:
 		return fmt.Errorf("unsupported network: <%s>", s.net)
 	}
@@ -0,0 +1,235 @@
+package radigo
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// FreeRADIUS statistics VSAs, used to report the server counters in Status-Server replies
+const (
+	FreeRADIUSVendor                        = 11344
+	FreeRADIUSTotalAccessRequestsNumber     = 128
+	FreeRADIUSTotalAccessAcceptsNumber      = 129
+	FreeRADIUSTotalAccessRejectsNumber      = 130
+	FreeRADIUSTotalAccessChallengesNumber   = 131
+	FreeRADIUSTotalAuthResponsesNumber      = 132
+	FreeRADIUSTotalAuthDuplicateNumber      = 133
+	FreeRADIUSTotalAuthMalformedNumber      = 134
+	FreeRADIUSTotalAuthInvalidNumber        = 135
+	FreeRADIUSTotalAuthDroppedNumber        = 136
+	FreeRADIUSTotalAuthUnknownTypesNumber   = 137
+	FreeRADIUSTotalAccountingRequestsNumber = 138
+	FreeRADIUSTotalAccountingRespNumber     = 139
+	FreeRADIUSTotalAcctDuplicateNumber      = 140
+	FreeRADIUSTotalAcctMalformedNumber      = 141
+	FreeRADIUSTotalAcctInvalidNumber        = 142
+	FreeRADIUSTotalAcctDroppedNumber        = 143
+	FreeRADIUSStatsStartTimeNumber          = 176
+)
+
+// ServerStats is a snapshot of the Server counters
+type ServerStats struct {
+	StartTime           time.Time // first packet received
+	AccessRequests      uint64
+	AccessAccepts       uint64
+	AccessRejects       uint64
+	AccessChallenges    uint64
+	AuthMalformed       uint64 // authentication requests failing to decode
+	AuthInvalid         uint64 // authentication requests failing authenticity checks
+	AuthDuplicates      uint64 // authentication retransmissions detected by the reply cache
+	AuthDropped         uint64 // authentication requests dropped on overload
+	UnknownTypes        uint64 // requests with no handler
+	AccountingRequests  uint64
+	AccountingResponses uint64
+	AcctMalformed       uint64
+	AcctInvalid         uint64
+	AcctDuplicates      uint64
+	AcctDropped         uint64
+}
+
+// serverStats are the counters updated while serving
+type serverStats struct {
+	startTime           atomic.Int64 // unix nanoseconds
+	accessRequests      atomic.Uint64
+	accessAccepts       atomic.Uint64
+	accessRejects       atomic.Uint64
+	accessChallenges    atomic.Uint64
+	authMalformed       atomic.Uint64
+	authInvalid         atomic.Uint64
+	authDuplicates      atomic.Uint64
+	authDropped         atomic.Uint64
+	unknownTypes        atomic.Uint64
+	accountingRequests  atomic.Uint64
+	accountingResponses atomic.Uint64
+	acctMalformed       atomic.Uint64
+	acctInvalid         atomic.Uint64
+	acctDuplicates      atomic.Uint64
+	acctDropped         atomic.Uint64
+}
+
+// started records the start time on first packet
+func (st *serverStats) started() {
+	if st.startTime.Load() == 0 {
+		st.startTime.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// received counts the valid request
+func (st *serverStats) received(code PacketCode) {
+	switch code {
+	case AccessRequest:
+		st.accessRequests.Add(1)
+	case AccountingRequest:
+		st.accountingRequests.Add(1)
+	}
+}
+
+// sent counts the reply written
+func (st *serverStats) sent(code PacketCode) {
+	switch code {
+	case AccessAccept:
+		st.accessAccepts.Add(1)
+	case AccessReject:
+		st.accessRejects.Add(1)
+	case AccessChallenge:
+		st.accessChallenges.Add(1)
+	case AccountingResponse:
+		st.accountingResponses.Add(1)
+	}
+}
+
+// invalid counts the request failing the authenticity checks
+func (st *serverStats) invalid(code PacketCode) {
+	if code == AccountingRequest {
+		st.acctInvalid.Add(1)
+	} else {
+		st.authInvalid.Add(1)
+	}
+}
+
+// malformed counts the request failing to decode
+func (st *serverStats) malformed(code PacketCode) {
+	if code == AccountingRequest {
+		st.acctMalformed.Add(1)
+	} else {
+		st.authMalformed.Add(1)
+	}
+}
+
+// duplicate counts the retransmitted request
+func (st *serverStats) duplicate(code PacketCode) {
+	if code == AccountingRequest {
+		st.acctDuplicates.Add(1)
+	} else {
+		st.authDuplicates.Add(1)
+	}
+}
+
+// dropped counts the request refused by the overloaded workers
+func (st *serverStats) dropped(code PacketCode) {
+	if code == AccountingRequest {
+		st.acctDropped.Add(1)
+	} else {
+		st.authDropped.Add(1)
+	}
+}
+
+func (st *serverStats) snapshot() (ss ServerStats) {
+	if startTime := st.startTime.Load(); startTime != 0 {
+		ss.StartTime = time.Unix(0, startTime)
+	}
+	ss.AccessRequests = st.accessRequests.Load()
+	ss.AccessAccepts = st.accessAccepts.Load()
+	ss.AccessRejects = st.accessRejects.Load()
+	ss.AccessChallenges = st.accessChallenges.Load()
+	ss.AuthMalformed = st.authMalformed.Load()
+	ss.AuthInvalid = st.authInvalid.Load()
+	ss.AuthDuplicates = st.authDuplicates.Load()
+	ss.AuthDropped = st.authDropped.Load()
+	ss.UnknownTypes = st.unknownTypes.Load()
+	ss.AccountingRequests = st.accountingRequests.Load()
+	ss.AccountingResponses = st.accountingResponses.Load()
+	ss.AcctMalformed = st.acctMalformed.Load()
+	ss.AcctInvalid = st.acctInvalid.Load()
+	ss.AcctDuplicates = st.acctDuplicates.Load()
+	ss.AcctDropped = st.acctDropped.Load()
+	return
+}
+
+// AVPs returns the statistics as FreeRADIUS VSAs, counters are truncated to 32 bits
+// the start time is omitted before the first packet is received
+func (ss ServerStats) AVPs() (avps []*AVP) {
+	for _, stat := range []struct {
+		attrNr uint8
+		val    uint64
+	}{
+		{FreeRADIUSTotalAccessRequestsNumber, ss.AccessRequests},
+		{FreeRADIUSTotalAccessAcceptsNumber, ss.AccessAccepts},
+		{FreeRADIUSTotalAccessRejectsNumber, ss.AccessRejects},
+		{FreeRADIUSTotalAccessChallengesNumber, ss.AccessChallenges},
+		{FreeRADIUSTotalAuthResponsesNumber, ss.AccessAccepts + ss.AccessRejects + ss.AccessChallenges},
+		{FreeRADIUSTotalAuthDuplicateNumber, ss.AuthDuplicates},
+		{FreeRADIUSTotalAuthMalformedNumber, ss.AuthMalformed},
+		{FreeRADIUSTotalAuthInvalidNumber, ss.AuthInvalid},
+		{FreeRADIUSTotalAuthDroppedNumber, ss.AuthDropped},
+		{FreeRADIUSTotalAuthUnknownTypesNumber, ss.UnknownTypes},
+		{FreeRADIUSTotalAccountingRequestsNumber, ss.AccountingRequests},
+		{FreeRADIUSTotalAccountingRespNumber, ss.AccountingResponses},
+		{FreeRADIUSTotalAcctDuplicateNumber, ss.AcctDuplicates},
+		{FreeRADIUSTotalAcctMalformedNumber, ss.AcctMalformed},
+		{FreeRADIUSTotalAcctInvalidNumber, ss.AcctInvalid},
+		{FreeRADIUSTotalAcctDroppedNumber, ss.AcctDropped},
+		{FreeRADIUSStatsStartTimeNumber, uint64(ss.StartTime.Unix())},
+	} {
+		if stat.attrNr == FreeRADIUSStatsStartTimeNumber && ss.StartTime.IsZero() {
+			continue
+		}
+		avps = append(avps, (&VSA{Vendor: FreeRADIUSVendor, Number: stat.attrNr,
+			RawValue: binary.BigEndian.AppendUint32(nil, uint32(stat.val))}).AVP())
+	}
+	return
+}
+
+// Stats returns the counters of the Server
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// SetStatusServerStats includes the server statistics in the Status-Server replies
+func (s *Server) SetStatusServerStats(enable bool) {
+	s.statusStats.Store(enable)
+}
+
+// SetAccountingServer marks the Server as listening for accounting, answering Status-Server with
+// Accounting-Response instead of Access-Accept, rfc5997 3
+func (s *Server) SetAccountingServer(acct bool) {
+	s.acctServer.Store(acct)
+}
+
+// statusReplyCode returns Access-Accept on authentication listeners, Accounting-Response on accounting ones
+func (s *Server) statusReplyCode() PacketCode {
+	if s.acctServer.Load() {
+		return AccountingResponse
+	}
+	return AccessAccept
+}
+
+// negativeReply returns the NegativeReply of the request, answering Status-Server as statusServerReply
+func (s *Server) negativeReply(req *Packet, errMsg string) (rply *Packet) {
+	if rply = req.NegativeReply(errMsg); rply != nil && req.Code == StatusServer {
+		rply.Code = s.statusReplyCode()
+	}
+	return
+}
+
+// statusServerReply answers the Status-Server, used when no handler is registered for it, rfc5997 3
+// Access-Accept on authentication listeners, Accounting-Response on accounting ones
+func (s *Server) statusServerReply(req *Packet) (*Packet, error) {
+	rply := req.Reply()
+	rply.Code = s.statusReplyCode()
+	if s.statusStats.Load() {
+		rply.AVPs = append(rply.AVPs, s.Stats().AVPs()...)
+	}
+	return rply, nil
+}
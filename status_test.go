@@ -0,0 +1,192 @@
+package radigo
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testSyncedConn captures the replies written by the server
+type testSyncedConn struct {
+	rplyChn chan []byte
+}
+
+func (c *testSyncedConn) getConnID() string {
+	return "127.0.0.1"
+}
+
+func (c *testSyncedConn) getSecret(sts *Secrets) string {
+	return sts.GetSecret(c.getConnID())
+}
+
+func (c *testSyncedConn) write(b []byte) error {
+	c.rplyChn <- append([]byte{}, b...)
+	return nil
+}
+
+func (c *testSyncedConn) remoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}}
+}
+
+func (c *testSyncedConn) localAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1812}
+}
+
+func (c *testSyncedConn) transport() string {
+	return "udp"
+}
+
+func (c *testSyncedConn) peerCertificate() *x509.Certificate {
+	return nil
+}
+
+// testStatusServer sends the Status-Server to srv, returning the decoded reply or nil if none
+func testStatusServer(t *testing.T, srv *Server, withMsgAuth bool) *Packet {
+	req := NewPacket(StatusServer, 7, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	copy(req.Authenticator[:], "0123456789abcdef")
+	if withMsgAuth {
+		req.AddMessageAuthenticator()
+	}
+	var buf [MaxPacketLen]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 1)}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	var b []byte
+	select {
+	case b = <-synConn.rplyChn:
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+	if err = checkMessageAuthenticator(b, "CGRateS.org", req.Authenticator, true); err != nil {
+		t.Error(err)
+	}
+	rply := &Packet{secret: "CGRateS.org", dict: RFC2865Dictionary(), coder: NewCoder()}
+	if err = rply.Decode(b); err != nil {
+		t.Fatal(err)
+	}
+	if !isAuthentic(b, "CGRateS.org", req.Authenticator) {
+		t.Error("reply not authentic")
+	}
+	if rply.Identifier != 7 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 7, rply.Identifier)
+	}
+	return rply
+}
+
+func testStatusHandler(req *Packet) (*Packet, error) {
+	rply := req.Reply()
+	rply.Code = AccessAccept
+	return rply, nil
+}
+
+func TestServerStatusServer(t *testing.T) {
+	srv := NewServer("udp", ":1812", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){AccessRequest: testStatusHandler}, nil, nil)
+	if rply := testStatusServer(t, srv, true); rply == nil {
+		t.Fatal("no reply for Status-Server")
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	} else if len(rply.AVPs) != 1 { // only the Message-Authenticator
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, len(rply.AVPs))
+	}
+	if rply := testStatusServer(t, srv, false); rply != nil {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", nil, rply)
+	}
+	if stats := srv.Stats(); stats.AuthInvalid != 1 || stats.StartTime.IsZero() {
+		t.Errorf("Received: <%+v>", stats)
+	}
+}
+
+func TestServerStatusServerAccounting(t *testing.T) {
+	srv := NewServer("udp", ":1813", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){AccountingRequest: testStatusHandler}, nil, nil)
+	if rply := testStatusServer(t, srv, true); rply == nil { // role not derived from the handlers
+		t.Fatal("no reply for Status-Server")
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+	srv.SetAccountingServer(true)
+	if rply := testStatusServer(t, srv, true); rply == nil {
+		t.Fatal("no reply for Status-Server")
+	} else if rply.Code != AccountingResponse {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccountingResponse, rply.Code)
+	}
+	srv.RegisterHandler(StatusServer, func(req *Packet) (*Packet, error) { // failing handler answers as the server
+		return nil, errors.New("status unknown")
+	})
+	if rply := testStatusServer(t, srv, true); rply == nil {
+		t.Fatal("no reply for Status-Server")
+	} else if rply.Code != AccountingResponse {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccountingResponse, rply.Code)
+	}
+	srv.RegisterHandler(StatusServer, func(req *Packet) (*Packet, error) { // custom handler takes precedence
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply, nil
+	})
+	if rply := testStatusServer(t, srv, true); rply == nil {
+		t.Fatal("no reply for Status-Server")
+	} else if rply.Code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, rply.Code)
+	}
+}
+
+func TestServerStatusServerStats(t *testing.T) {
+	srv := NewServer("udp", ":1812", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){AccessRequest: testStatusHandler}, nil, nil)
+	srv.SetStatusServerStats(true)
+	req := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	var buf [MaxPacketLen]byte
+	n, err := req.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 1)}
+	srv.handleRcvedBytes(buf[:n], synConn)
+	<-synConn.rplyChn
+	rply := testStatusServer(t, srv, true)
+	if rply == nil {
+		t.Fatal("no reply for Status-Server")
+	}
+	stats := make(map[uint8]uint32)
+	for _, avp := range rply.AVPs {
+		if avp.Number != VendorSpecificNumber {
+			continue
+		}
+		vsa, err := NewVSAFromAVP(avp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vsa.Vendor != FreeRADIUSVendor {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", FreeRADIUSVendor, vsa.Vendor)
+		}
+		stats[vsa.Number] = binary.BigEndian.Uint32(vsa.RawValue)
+	}
+	if reqs := stats[FreeRADIUSTotalAccessRequestsNumber]; reqs != 1 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, reqs)
+	}
+	if startTime := stats[FreeRADIUSStatsStartTimeNumber]; startTime == 0 {
+		t.Error("missing start time")
+	}
+	if len(stats) != 17 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 17, len(stats))
+	}
+}
+
+func TestServerStatsAVPsStartTime(t *testing.T) {
+	if avps := (ServerStats{}).AVPs(); len(avps) != 16 { // no start time before the first packet
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 16, len(avps))
+	}
+	if avps := (ServerStats{StartTime: time.Now()}).AVPs(); len(avps) != 17 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 17, len(avps))
+	}
+}
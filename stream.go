@@ -0,0 +1,45 @@
+package radigo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	minPacketLen = 20 // code, identifier, length and authenticator
+)
+
+// errFramingViolation signals a length field we cannot resynchronize the stream after
+var errFramingViolation = errors.New("unexpected packet length")
+
+// newPacketStreamReader instantiates a packetStreamReader on top of the stream
+func newPacketStreamReader(r io.Reader) *packetStreamReader {
+	return &packetStreamReader{rdr: bufio.NewReaderSize(r, MaxPacketLen)}
+}
+
+// packetStreamReader splits a stream (TCP, TLS) into RADIUS packets, rfc6613 2.2
+// partial reads are reassembled and concatenated packets are split based on the length field
+type packetStreamReader struct {
+	rdr *bufio.Reader
+}
+
+// readPacket returns the next packet out of the stream
+// errFramingViolation is returned if the length field is out of bounds, the connection should be closed then
+func (psr *packetStreamReader) readPacket() (b []byte, err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(psr.rdr, hdr[:]); err != nil {
+		return
+	}
+	length := int(binary.BigEndian.Uint16(hdr[2:4]))
+	if length < minPacketLen || length > MaxPacketLen {
+		return nil, errFramingViolation
+	}
+	b = make([]byte, length)
+	copy(b, hdr[:])
+	if _, err = io.ReadFull(psr.rdr, b[4:]); err != nil {
+		return nil, err
+	}
+	return
+}
@@ -0,0 +1,87 @@
+package radigo
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	testStreamPkt1 = []byte{
+		0x01, 0x01, 0x00, 0x1c, 0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2, 0x01, 0x08, 0x66, 0x6c, 0x6f, 0x70, 0x73, 0x79,
+	}
+	testStreamPkt2 = []byte{
+		0x04, 0x02, 0x00, 0x14, 0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2,
+	}
+)
+
+func TestStreamreadPacketConcatenated(t *testing.T) {
+	stream := append(append([]byte{}, testStreamPkt1...), testStreamPkt2...)
+	psr := newPacketStreamReader(bytes.NewReader(stream))
+	if b, err := psr.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(testStreamPkt1, b) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", testStreamPkt1, b)
+	}
+	if b, err := psr.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(testStreamPkt2, b) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", testStreamPkt2, b)
+	}
+	if _, err := psr.readPacket(); err != io.EOF {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.EOF, err)
+	}
+}
+
+func TestStreamreadPacketPartialReads(t *testing.T) {
+	psr := newPacketStreamReader(iotest.OneByteReader(bytes.NewReader(testStreamPkt1)))
+	if b, err := psr.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(testStreamPkt1, b) {
+		t.Errorf("\nExpected: <% x>, \nReceived: <% x>", testStreamPkt1, b)
+	}
+}
+
+func TestStreamreadPacketMaxLen(t *testing.T) {
+	pkt := NewPacket(AccessRequest, 1, RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+	for i := 0; i < 15; i++ { // 20 + 15*255 + 251 = MaxPacketLen
+		pkt.AVPs = append(pkt.AVPs, &AVP{Number: ProxyStateNumber, RawValue: make([]byte, 253)})
+	}
+	pkt.AVPs = append(pkt.AVPs, &AVP{Number: ProxyStateNumber, RawValue: make([]byte, 249)})
+	var buf [MaxPacketLen]byte
+	n, err := pkt.Encode(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	} else if n != MaxPacketLen {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", MaxPacketLen, n)
+	}
+	psr := newPacketStreamReader(bytes.NewReader(buf[:n]))
+	if b, err := psr.readPacket(); err != nil {
+		t.Fatal(err)
+	} else if len(b) != MaxPacketLen {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", MaxPacketLen, len(b))
+	}
+}
+
+func TestStreamreadPacketFramingViolation(t *testing.T) {
+	for _, hdr := range [][]byte{
+		{0x01, 0x01, 0x00, 0x13},
+		{0x01, 0x01, 0x10, 0x01},
+	} {
+		psr := newPacketStreamReader(bytes.NewReader(hdr))
+		if _, err := psr.readPacket(); err != errFramingViolation {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", errFramingViolation, err)
+		}
+	}
+}
+
+func TestStreamreadPacketTruncated(t *testing.T) {
+	psr := newPacketStreamReader(bytes.NewReader(testStreamPkt1[:10]))
+	if _, err := psr.readPacket(); err != io.ErrUnexpectedEOF {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.ErrUnexpectedEOF, err)
+	}
+}
@@ -0,0 +1,60 @@
+package radigo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+const (
+	RadSecSecret = "radsec" // fixed shared secret used over TLS, rfc6614 2.3
+)
+
+var (
+	// TLSHandshakeTimeout limits the handshake of the TLS connections and DTLS sessions
+	TLSHandshakeTimeout = 10 * time.Second
+
+	errNoTLSConfig = errors.New("missing TLS config")
+)
+
+// certIdentities returns the identities presented in a peer certificate
+// DNS SANs take precedence over the CommonName
+func certIdentities(cert *x509.Certificate) (ids []string) {
+	ids = append(ids, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		ids = append(ids, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		ids = append(ids, uri.String())
+	}
+	if cert.Subject.CommonName != "" {
+		ids = append(ids, cert.Subject.CommonName)
+	}
+	return
+}
+
+// tlsClientID returns the client ID and secret for a TLS connection
+// the secret defaults to RadSecSecret unless one is configured for the certificate identity
+func (s *Server) tlsClientID(state tls.ConnectionState, addrID string) (connID, secret string) {
+	return s.peerClientID(state.PeerCertificates, addrID, RadSecSecret)
+}
+
+// peerClientID returns the client ID and secret for a secure connection
+// the peer certificate identity stands in for the remote IP if configured in secrets or dictionaries
+// the secret defaults to dfltSecret unless one is configured for the certificate identity
+func (s *Server) peerClientID(peerCerts []*x509.Certificate, addrID, dfltSecret string) (connID, secret string) {
+	connID, secret = addrID, dfltSecret
+	if len(peerCerts) == 0 {
+		return
+	}
+	for _, id := range certIdentities(peerCerts[0]) {
+		if scrt, has := s.secrets.getSecret(id); has {
+			return id, scrt
+		}
+		if s.dicts.hasInstance(id) {
+			return id, dfltSecret
+		}
+	}
+	return
+}
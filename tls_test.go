@@ -0,0 +1,206 @@
+package radigo
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCertificate generates a certificate signed by parent (self-signed if parent is nil)
+func testCertificate(t *testing.T, cn string, dnsNames []string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, interface{}(key)
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.IPAddresses = nil
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testTLSConfigs returns server and client configs authenticating each other with a common CA
+func testTLSConfigs(t *testing.T) (srvCfg, clntCfg *tls.Config) {
+	ca := testCertificate(t, "CGRateS CA", nil, nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	srvCfg = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "radius.cgrates.org", []string{"localhost"}, &ca)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	clntCfg = &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "nas1", []string{"nas1.cgrates.org"}, &ca)},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	}
+	return
+}
+
+func TestTLScertIdentities(t *testing.T) {
+	ca := testCertificate(t, "CGRateS CA", nil, nil)
+	cert := testCertificate(t, "nas1", []string{"nas1.cgrates.org"}, &ca)
+
+	exp := []string{"nas1.cgrates.org", "127.0.0.1", "nas1"}
+	if rcv := certIdentities(cert.Leaf); !reflect.DeepEqual(exp, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
+	}
+}
+
+func TestTLStlsClientID(t *testing.T) {
+	ca := testCertificate(t, "CGRateS CA", nil, nil)
+	cert := testCertificate(t, "nas1", []string{"nas1.cgrates.org"}, &ca)
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	srv := &Server{
+		secrets: NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		dicts:   NewDictionaries(nil),
+	}
+	if connID, secret := srv.tlsClientID(tls.ConnectionState{}, "127.0.0.2"); connID != "127.0.0.2" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "127.0.0.2", connID)
+	} else if secret != RadSecSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", RadSecSecret, secret)
+	}
+	if connID, secret := srv.tlsClientID(state, "127.0.0.2"); connID != "127.0.0.2" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "127.0.0.2", connID)
+	} else if secret != RadSecSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", RadSecSecret, secret)
+	}
+	srv.dicts = NewDictionaries(map[string]*Dictionary{"nas1": RFC2865Dictionary()})
+	if connID, secret := srv.tlsClientID(state, "127.0.0.2"); connID != "nas1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "nas1", connID)
+	} else if secret != RadSecSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", RadSecSecret, secret)
+	}
+	srv.secrets = NewSecrets(map[string]string{"nas1.cgrates.org": "CGRateS.org"})
+	if connID, secret := srv.tlsClientID(state, "127.0.0.2"); connID != "nas1.cgrates.org" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "nas1.cgrates.org", connID)
+	} else if secret != "CGRateS.org" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CGRateS.org", secret)
+	}
+}
+
+func TestTLSpeerClientID(t *testing.T) {
+	ca := testCertificate(t, "CGRateS CA", nil, nil)
+	cert := testCertificate(t, "nas1", nil, &ca)
+	peerCerts := []*x509.Certificate{cert.Leaf}
+	srv := &Server{
+		secrets: NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		dicts:   NewDictionaries(map[string]*Dictionary{"127.0.0.1": RFC2865Dictionary()}),
+	}
+	if connID, secret := srv.peerClientID(peerCerts, "127.0.0.2", DTLSSecret); connID != "127.0.0.1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "127.0.0.1", connID)
+	} else if secret != DTLSSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", DTLSSecret, secret)
+	}
+}
+
+func TestTLSClientServer(t *testing.T) {
+	srvCfg, clntCfg := testTLSConfigs(t)
+	dict := RFC2865Dictionary()
+	srv := NewTLSServer("tls", "127.0.0.1:0", srvCfg, NewSecrets(nil),
+		NewDictionaries(map[string]*Dictionary{"nas1.cgrates.org": dict}),
+		map[PacketCode]func(*Packet) (*Packet, error){
+			AccessRequest: func(req *Packet) (*Packet, error) {
+				if avps := req.AttributesWithName("User-Name", ""); len(avps) != 1 ||
+					avps[0].GetStringValue() != "flopsy" {
+					return nil, fmt.Errorf("unexpected AVPs: %+v", avps)
+				}
+				rpl := req.Reply()
+				rpl.Code = AccessAccept
+				return rpl, nil
+			},
+		}, nil, nil)
+	ln, err := tls.Listen("tcp", srv.addr, srv.tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	go func() {
+		<-stopChan
+		ln.Close()
+	}()
+	go srv.serveTCP(stopChan, ln)
+
+	clnt, err := NewTLSClient("tls", ln.Addr().String(), clntCfg, dict, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clnt.secret != RadSecSecret {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", RadSecSecret, clnt.secret)
+	}
+	req := clnt.NewRequest(AccessRequest, 1)
+	if err := req.AddAVPWithName("User-Name", "flopsy", ""); err != nil {
+		t.Fatal(err)
+	}
+	req.AddMessageAuthenticator()
+	if rpl, err := clnt.SendRequest(req); err != nil {
+		t.Error(err)
+	} else if rpl.Code != AccessAccept {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", AccessAccept, rpl.Code)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { TLSHandshakeTimeout = timeout }(TLSHandshakeTimeout)
+	TLSHandshakeTimeout = 10 * time.Millisecond
+	srvCfg, _ := testTLSConfigs(t)
+	srv := NewTLSServer("tls", "127.0.0.1:0", srvCfg, NewSecrets(nil), NewDictionaries(nil), nil, nil, nil)
+	srvConn, clntConn := net.Pipe()
+	defer clntConn.Close()
+	done := make(chan struct{})
+	go func() {
+		srv.handleTCPConn(tls.Server(srvConn, srv.tlsCfg)) // client never sends the ClientHello
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection kept without handshake")
+	}
+}
+
+func TestTLSListenAndServeMissingConfig(t *testing.T) {
+	srv := &Server{
+		net: "tls",
+	}
+	experr := "missing TLS config"
+	if err := srv.ListenAndServe(make(chan struct{})); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
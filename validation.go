@@ -42,6 +42,10 @@ func (v Validation) Validate(p *Packet, attr *AVP) error {
 	return nil
 }
 
+// DecodeUserPassword decrypts the User-Password of the request in place
+//
+// Deprecated: Packet.Decode reveals the User-Password transparently, calling this on a decoded packet
+// decrypts the cleartext a second time.
 func DecodeUserPassword(p *Packet, a *AVP) error {
 	if len(p.secret) == 0 {
 		return errors.New("empty secret")
@@ -78,15 +82,19 @@ func DecodeUserPassword(p *Packet, a *AVP) error {
 }
 
 var validation = map[uint8]Validation{
-	1: {1, UNLIMITED, nil},           //UserName
-	2: {16, 128, DecodeUserPassword}, //UserPassword
-	3: {17, 17, nil},                 //CHAPPassword
-	4: {4, 4, nil},                   //NASIPAddress
-	5: {1, 4, nil},                   //NASPort
+	1:  {1, UNLIMITED, nil}, //UserName
+	2:  {16, 128, nil},      //UserPassword, decrypted based on encrypt flag
+	3:  {17, 17, nil},       //CHAPPassword
+	4:  {4, 4, nil},         //NASIPAddress
+	5:  {1, 4, nil},         //NASPort
+	80: {16, 16, nil},       //MessageAuthenticator
 }
 
 // EncodeUserPassword encodes the plaintext, where plaintext's length needs to
 // be greater than 16 and a multiple of 16.
+//
+// Deprecated: Packet.Encode hides the User-Password transparently, setting the output of this as RawValue
+// gets it encrypted a second time.
 func EncodeUserPassword(plaintext, secret, requestAuthenticator []byte) []byte {
 	enc := make([]byte, 0, len(plaintext))
 	hash := md5.New()
@@ -109,6 +117,138 @@ func EncodeUserPassword(plaintext, secret, requestAuthenticator []byte) []byte {
 	return enc
 }
 
+// padValue pads the value with zeros up to a multiple of 16
+func padValue(val []byte) []byte {
+	padded := make([]byte, len(val)+(16-len(val)%16)%16)
+	copy(padded, val)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	return padded
+}
+
+// encryptValue hides the value using the method defined in dictionary
+// acator is the authenticator of the request
+func encryptValue(method uint8, val []byte, secret string, acator [16]byte) ([]byte, error) {
+	switch method {
+	case UserPasswordEncrypt:
+		if len(val) > 128 {
+			return nil, errors.New("value too long for encryption")
+		}
+		return EncodeUserPassword(padValue(val), []byte(secret), acator[:]), nil
+	case TunnelPasswordEncrypt:
+		if len(val) > 239 {
+			return nil, errors.New("value too long for encryption")
+		}
+		salt := make([]byte, 2)
+		rand.Read(salt)
+		salt[0] |= 0x80 // most significant bit must be set, rfc2868 3.5
+		return append(salt, encodeSaltedValue(val, []byte(secret), acator[:], salt)...), nil
+	case AscendSecretEncrypt:
+		if len(val) > 16 {
+			return nil, errors.New("value too long for encryption")
+		}
+		return ascendSecretCrypt(padValue(val), secret, acator), nil
+	}
+	return nil, fmt.Errorf("unsupported encryption method: <%d>", method)
+}
+
+// decryptValue reveals the value hidden with the method defined in dictionary
+// acator is the authenticator of the request
+func decryptValue(method uint8, val []byte, secret string, acator [16]byte) ([]byte, error) {
+	switch method {
+	case UserPasswordEncrypt:
+		if len(val) == 0 || len(val)%16 != 0 {
+			return nil, errors.New("invalid encrypted value length")
+		}
+		dec := make([]byte, 0, len(val))
+		hash := md5.New()
+		for i := 0; i < len(val); i += 16 {
+			hash.Reset()
+			hash.Write([]byte(secret))
+			if i == 0 {
+				hash.Write(acator[:])
+			} else {
+				hash.Write(val[i-16 : i])
+			}
+			dec = hash.Sum(dec)
+			for j, b := range val[i : i+16] {
+				dec[i+j] ^= b
+			}
+		}
+		return bytes.TrimRight(dec, "\x00"), nil
+	case TunnelPasswordEncrypt:
+		if len(val) < 18 || (len(val)-2)%16 != 0 {
+			return nil, errors.New("invalid encrypted value length")
+		}
+		return decodeSaltedValue(val[2:], []byte(secret), acator[:], val[:2])
+	case AscendSecretEncrypt:
+		if len(val) != 16 {
+			return nil, errors.New("invalid encrypted value length")
+		}
+		return bytes.TrimRight(ascendSecretCrypt(val, secret, acator), "\x00"), nil
+	}
+	return nil, fmt.Errorf("unsupported encryption method: <%d>", method)
+}
+
+// encodeSaltedValue encrypts the value prefixed by it's length, rfc2868 3.5 and rfc2548 2.4.2
+func encodeSaltedValue(val, secret, acator, salt []byte) []byte {
+	plain := padValue(append([]byte{uint8(len(val))}, val...))
+	enc := make([]byte, 0, len(plain))
+	hash := md5.New()
+	for i := 0; i < len(plain); i += 16 {
+		hash.Reset()
+		hash.Write(secret)
+		if i == 0 {
+			hash.Write(acator)
+			hash.Write(salt)
+		} else {
+			hash.Write(enc[i-16 : i])
+		}
+		enc = hash.Sum(enc)
+		for j, b := range plain[i : i+16] {
+			enc[i+j] ^= b
+		}
+	}
+	return enc
+}
+
+// decodeSaltedValue decrypts the value encrypted with encodeSaltedValue
+func decodeSaltedValue(enc, secret, acator, salt []byte) ([]byte, error) {
+	dec := make([]byte, 0, len(enc))
+	hash := md5.New()
+	for i := 0; i < len(enc); i += 16 {
+		hash.Reset()
+		hash.Write(secret)
+		if i == 0 {
+			hash.Write(acator)
+			hash.Write(salt)
+		} else {
+			hash.Write(enc[i-16 : i])
+		}
+		dec = hash.Sum(dec)
+		for j, b := range enc[i : i+16] {
+			dec[i+j] ^= b
+		}
+	}
+	if int(dec[0]) > len(dec)-1 {
+		return nil, errors.New("invalid decrypted value length")
+	}
+	return dec[1 : 1+int(dec[0])], nil
+}
+
+// ascendSecretCrypt both encrypts and decrypts the Ascend-Send-Secret value
+func ascendSecretCrypt(val []byte, secret string, acator [16]byte) []byte {
+	hash := md5.New()
+	hash.Write(acator[:])
+	hash.Write([]byte(secret))
+	out := hash.Sum(nil)
+	for i, b := range val {
+		out[i] ^= b
+	}
+	return out
+}
+
 // AuthenticateCHAP receive the password as plaintext and verify against the chap challenge
 func AuthenticateCHAP(password, authenticator, chapChallenge []byte) bool {
 	h := md5.New()
@@ -261,8 +401,12 @@ func GenerateAuthenticatorResponse(authenticatorChallenge, peerChallenge, ntResp
 	if err != nil {
 		return "", err // unable to check this error
 	}
+	return generateAuthenticatorResponseWithHash(authenticatorChallenge, peerChallenge, ntResponse,
+		username, HashPassword(ucs2Password)), nil
+}
 
-	passwordHash := HashPassword(ucs2Password)
+// generateAuthenticatorResponseWithHash - rfc2759, 8.7, out of password hash
+func generateAuthenticatorResponseWithHash(authenticatorChallenge, peerChallenge, ntResponse []byte, username string, passwordHash []byte) string {
 	passwordHashHash := HashPassword(passwordHash)
 
 	magic1 := []byte{
@@ -291,7 +435,7 @@ func GenerateAuthenticatorResponse(authenticatorChallenge, peerChallenge, ntResp
 	sha.Write(magic2)
 	digest = sha.Sum(nil)
 
-	return fmt.Sprintf("S=%s", strings.ToUpper(hex.EncodeToString(digest))), nil
+	return fmt.Sprintf("S=%s", strings.ToUpper(hex.EncodeToString(digest)))
 }
 
 func GenerateClientMSCHAPResponse(authenticator [16]byte, userName, password string) ([]byte, error) {
@@ -316,3 +460,41 @@ func GenerateClientMSCHAPResponse(authenticator [16]byte, userName, password str
 	copy(respVal[26:50], peerResp)
 	return respVal, nil
 }
+
+// GetMasterKey - rfc3079, 3.4
+func GetMasterKey(passwordHashHash, ntResponse []byte) []byte {
+	magic1 := []byte("This is the MPPE Master Key")
+	sha := sha1.New()
+	sha.Write(passwordHashHash)
+	sha.Write(ntResponse)
+	sha.Write(magic1)
+	return sha.Sum(nil)[:16]
+}
+
+// GetAsymmetricStartKey - rfc3079, 3.4
+func GetAsymmetricStartKey(masterKey []byte, sessionKeyLength int, isSend, isServer bool) []byte {
+	magic2 := []byte("On the client side, this is the send key; " +
+		"on the server side, it is the receive key.")
+	magic3 := []byte("On the client side, this is the receive key; " +
+		"on the server side, it is the send key.")
+	shsPad1 := make([]byte, 40)
+	shsPad2 := bytes.Repeat([]byte{0xf2}, 40)
+	s := magic2
+	if isSend == isServer {
+		s = magic3
+	}
+	sha := sha1.New()
+	sha.Write(masterKey)
+	sha.Write(shsPad1)
+	sha.Write(s)
+	sha.Write(shsPad2)
+	return sha.Sum(nil)[:sessionKeyLength]
+}
+
+// GenerateMPPEKeys derives the 128-bit MS-MPPE-Send-Key and MS-MPPE-Recv-Key
+// returned by server on MS-CHAPv2 success, out of NT password hash and NT-Response
+func GenerateMPPEKeys(passwordHash, ntResponse []byte) (sendKey, recvKey []byte) {
+	masterKey := GetMasterKey(HashPassword(passwordHash), ntResponse)
+	return GetAsymmetricStartKey(masterKey, 16, true, true),
+		GetAsymmetricStartKey(masterKey, 16, false, true)
+}
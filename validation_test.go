@@ -1,6 +1,7 @@
 package radigo
 
 import (
+	"bytes"
 	"crypto/md5"
 	"fmt"
 	"reflect"
@@ -268,3 +269,92 @@ func TestValidationGenerateClientMSCHAPResponseSuccess(t *testing.T) {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, rcv)
 	}
 }
+
+func TestValidationEncryptDecryptValue(t *testing.T) {
+	acator := [16]byte{0x2a, 0xee, 0x86, 0xf0, 0x8d, 0x0d, 0x55, 0x96, 0x9c, 0xa5, 0x97, 0x8e,
+		0x0d, 0x33, 0x67, 0xa2}
+	for _, method := range []uint8{UserPasswordEncrypt, TunnelPasswordEncrypt, AscendSecretEncrypt} {
+		for _, val := range []string{"", "CGRateS", "CGRateSPassword1", "CGRateSPassword12"} {
+			if method == AscendSecretEncrypt && len(val) > 16 {
+				continue
+			}
+			enc, err := encryptValue(method, []byte(val), "CGRateS.org", acator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if val != "" && bytes.Contains(enc, []byte(val)) {
+				t.Errorf("value not encrypted for method %d: %+v", method, enc)
+			}
+			if dec, err := decryptValue(method, enc, "CGRateS.org", acator); err != nil {
+				t.Error(err)
+			} else if string(dec) != val {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", val, string(dec))
+			}
+		}
+	}
+}
+
+func TestValidationEncryptValueTunnelPasswordSalt(t *testing.T) {
+	enc, err := encryptValue(TunnelPasswordEncrypt, []byte("CGRateS"), "CGRateS.org", [16]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) != 18 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 18, len(enc))
+	}
+	if enc[0]&0x80 == 0 {
+		t.Errorf("most significant bit of the salt not set: %+v", enc[:2])
+	}
+}
+
+func TestValidationEncryptDecryptValueErrors(t *testing.T) {
+	if _, err := encryptValue(AscendSecretEncrypt, make([]byte, 17), "CGRateS.org", [16]byte{}); err == nil {
+		t.Error("expecting error for too long value")
+	}
+	if _, err := encryptValue(UserPasswordEncrypt, make([]byte, 129), "CGRateS.org", [16]byte{}); err == nil {
+		t.Error("expecting error for too long value")
+	}
+	experr := "unsupported encryption method: <4>"
+	if _, err := encryptValue(4, []byte("CGRateS"), "CGRateS.org", [16]byte{}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	experr = "invalid encrypted value length"
+	if _, err := decryptValue(UserPasswordEncrypt, make([]byte, 17), "CGRateS.org", [16]byte{}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+	if _, err := decryptValue(TunnelPasswordEncrypt, make([]byte, 16), "CGRateS.org", [16]byte{}); err == nil || err.Error() != experr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", experr, err)
+	}
+}
+
+func TestValidationGenerateMPPEKeys(t *testing.T) {
+	// rfc3079, 3.5.3
+	ntResponse := []byte{0x82, 0x30, 0x9E, 0xCD, 0x8D, 0x70, 0x8B, 0x5E, 0xA0, 0x8F, 0xAA, 0x39,
+		0x81, 0xCD, 0x83, 0x54, 0x42, 0x33, 0x11, 0x4A, 0x3D, 0x85, 0xD6, 0xDF}
+	ucs2Password, err := ToUTF16("clientPass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordHash := HashPassword(ucs2Password)
+	eMasterKey := []byte{0xFD, 0xEC, 0xE3, 0x71, 0x7A, 0x8C, 0x83, 0x8C, 0xB3, 0x88, 0xE5, 0x27,
+		0xAE, 0x3C, 0xDD, 0x31}
+	if masterKey := GetMasterKey(HashPassword(passwordHash), ntResponse); !reflect.DeepEqual(eMasterKey, masterKey) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eMasterKey, masterKey)
+	}
+	eSendKey := []byte{0x8B, 0x7C, 0xDC, 0x14, 0x9B, 0x99, 0x3A, 0x1B, 0xA1, 0x18, 0xCB, 0x15,
+		0x3F, 0x56, 0xDC, 0xCB}
+	eRecvKey := []byte{0xD5, 0xF0, 0xE9, 0x52, 0x1E, 0x3E, 0xA9, 0x58, 0x96, 0x45, 0xE8, 0x60,
+		0x51, 0xC8, 0x22, 0x26}
+	sendKey, recvKey := GenerateMPPEKeys(passwordHash, ntResponse)
+	if !reflect.DeepEqual(eSendKey, sendKey) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eSendKey, sendKey)
+	}
+	if !reflect.DeepEqual(eRecvKey, recvKey) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", eRecvKey, recvKey)
+	}
+	// client side keys are mirrored
+	if clntRecvKey := GetAsymmetricStartKey(GetMasterKey(HashPassword(passwordHash), ntResponse),
+		16, false, false); !reflect.DeepEqual(sendKey, clntRecvKey) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", sendKey, clntRecvKey)
+	}
+}
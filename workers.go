@@ -0,0 +1,320 @@
+package radigo
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+const (
+	MetaDrop   = "*drop"   // requests over the queue depth are discarded, leaving the client to retransmit
+	MetaReject = "*reject" // requests over the queue depth are answered negatively when possible, dropped otherwise
+
+	DefaultWorkerQueueDepth = 1024
+	workerOverloadQueue     = 16 // overload changes buffered before dropping
+)
+
+// WorkerQueue configures the queue of one PacketCode
+type WorkerQueue struct {
+	Priority int // lower priorities are served first
+	MaxDepth int // requests waiting for a worker, DefaultWorkerQueueDepth if 0
+}
+
+// defaultWorkerQueue returns the queue of the codes not configured
+// authentication and Status-Server are served ahead of the others (ie: accounting)
+func defaultWorkerQueue(code PacketCode) WorkerQueue {
+	if code == AccessRequest || code == StatusServer {
+		return WorkerQueue{MaxDepth: DefaultWorkerQueueDepth}
+	}
+	return WorkerQueue{Priority: 1, MaxDepth: DefaultWorkerQueueDepth}
+}
+
+// workQueue holds the jobs of one PacketCode
+type workQueue struct {
+	WorkerQueue
+	code PacketCode
+	jobs []func()
+}
+
+// newWorkerPool instantiates a workerPool
+func newWorkerPool(workers int, overflow string, queues map[PacketCode]WorkerQueue) *workerPool {
+	wp := &workerPool{workers: workers, reject: overflow == MetaReject,
+		queues:      make(map[PacketCode]*workQueue),
+		overloadChn: make(chan bool, workerOverloadQueue)}
+	wp.cond = sync.NewCond(&wp.Mutex)
+	for code, wq := range queues {
+		wp.queue(code).WorkerQueue = wq
+	}
+	return wp
+}
+
+// workerPool executes the jobs with a fixed number of goroutines, serving the queues in priority order
+type workerPool struct {
+	sync.Mutex
+	cond        *sync.Cond
+	workers     int
+	reject      bool                      // MetaReject overflow policy
+	queues      map[PacketCode]*workQueue // indexed on code
+	ordered     []*workQueue              // sorted on priority
+	pending     int                       // jobs in all queues
+	running     bool                      // accepting jobs
+	gen         int                       // incremented on start, stopping the workers of the previous ones
+	overloaded  bool                      // a queue reached it's depth, cleared once all are below half
+	overloadChn chan bool                 // publishes the overload changes
+}
+
+// queue returns the queue of code, creating it if not already there, called with the lock held
+func (wp *workerPool) queue(code PacketCode) (wq *workQueue) {
+	if wq = wp.queues[code]; wq != nil {
+		return
+	}
+	wq = &workQueue{WorkerQueue: defaultWorkerQueue(code), code: code}
+	wp.queues[code] = wq
+	wp.ordered = append(wp.ordered, wq)
+	sort.SliceStable(wp.ordered, func(i, j int) bool {
+		return wp.ordered[i].Priority < wp.ordered[j].Priority
+	})
+	return
+}
+
+// start runs the workers until stopChan is closed, the jobs still queued are discarded
+// replaces the workers of the previous start, if any
+func (wp *workerPool) start(stopChan <-chan struct{}) {
+	wp.Lock()
+	wp.running = true
+	wp.gen++
+	wp.setOverloaded(false)
+	gen := wp.gen
+	wp.cond.Broadcast() // previous workers exit
+	wp.Unlock()
+	for i := 0; i < wp.workers; i++ {
+		go wp.work(gen)
+	}
+	go func() {
+		<-stopChan
+		wp.Lock()
+		if wp.gen == gen {
+			wp.running = false
+			for _, wq := range wp.queues {
+				wq.jobs = nil
+			}
+			wp.pending = 0
+			wp.setOverloaded(false)
+			wp.cond.Broadcast()
+		}
+		wp.Unlock()
+	}()
+}
+
+// retire stops accepting jobs, the workers exit once the queued ones are done
+func (wp *workerPool) retire() {
+	wp.Lock()
+	wp.running = false
+	wp.cond.Broadcast()
+	wp.Unlock()
+}
+
+// submit queues the job, returning false if the pool is not running or the queue of code is full
+func (wp *workerPool) submit(code PacketCode, job func()) bool {
+	wp.Lock()
+	defer wp.Unlock()
+	if !wp.running {
+		return false
+	}
+	wq := wp.queue(code)
+	maxDepth := wq.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultWorkerQueueDepth
+	}
+	if len(wq.jobs) >= maxDepth {
+		wp.setOverloaded(true)
+		return false
+	}
+	wq.jobs = append(wq.jobs, job)
+	wp.pending++
+	wp.cond.Signal()
+	return true
+}
+
+// work executes the jobs of the queue with the lowest priority first
+// exits once the pool is not running and the queues are empty or the pool was started again
+func (wp *workerPool) work(gen int) {
+	for {
+		wp.Lock()
+		for wp.pending == 0 && wp.running && wp.gen == gen {
+			wp.cond.Wait()
+		}
+		if wp.gen != gen || wp.pending == 0 {
+			wp.Unlock()
+			return
+		}
+		var job func()
+		for _, wq := range wp.ordered {
+			if len(wq.jobs) != 0 {
+				job = wq.jobs[0]
+				wq.jobs[0] = nil
+				wq.jobs = wq.jobs[1:]
+				break
+			}
+		}
+		wp.pending--
+		if wp.overloaded && wp.relieved() {
+			wp.setOverloaded(false)
+		}
+		wp.Unlock()
+		job()
+	}
+}
+
+// relieved returns true if all the queues are below half of their depth, called with the lock held
+func (wp *workerPool) relieved() bool {
+	for _, wq := range wp.queues {
+		maxDepth := wq.MaxDepth
+		if maxDepth <= 0 {
+			maxDepth = DefaultWorkerQueueDepth
+		}
+		if len(wq.jobs) > maxDepth/2 {
+			return false
+		}
+	}
+	return true
+}
+
+// setOverloaded changes the overload state, publishing it, called with the lock held
+func (wp *workerPool) setOverloaded(overloaded bool) {
+	if wp.overloaded == overloaded {
+		return
+	}
+	wp.overloaded = overloaded
+	select {
+	case wp.overloadChn <- overloaded:
+	default:
+	}
+}
+
+// rejecting returns true if the requests refused while running are answered negatively
+func (wp *workerPool) rejecting() bool {
+	wp.Lock()
+	defer wp.Unlock()
+	return wp.reject && wp.running
+}
+
+// depths returns the number of jobs waiting per code
+func (wp *workerPool) depths() map[PacketCode]int {
+	wp.Lock()
+	defer wp.Unlock()
+	depths := make(map[PacketCode]int, len(wp.queues))
+	for code, wq := range wp.queues {
+		depths[code] = len(wq.jobs)
+	}
+	return depths
+}
+
+// SetWorkers serves the requests with a pool of workers instead of one goroutine per request, 0 to disable
+// the queues not configured get DefaultWorkerQueueDepth with authentication served ahead of accounting
+// overflow is the policy for the requests over the queue depth, MetaDrop or MetaReject
+// the workers run while serving, the ones replaced on a running server finish their queued requests
+func (s *Server) SetWorkers(workers int, overflow string, queues map[PacketCode]WorkerQueue) {
+	var wp *workerPool
+	if workers > 0 {
+		wp = newWorkerPool(workers, overflow, queues)
+	}
+	s.wpMux.Lock()
+	oldWp, serving := s.wp, s.serving
+	s.wp = wp
+	s.wpMux.Unlock()
+	if oldWp != nil {
+		oldWp.retire()
+	}
+	if wp != nil && serving != nil {
+		wp.start(serving)
+	}
+}
+
+// startWorkers runs the workers until stopChan is closed
+func (s *Server) startWorkers(stopChan <-chan struct{}) {
+	s.wpMux.Lock()
+	s.serving = stopChan
+	wp := s.wp
+	s.wpMux.Unlock()
+	if wp != nil {
+		wp.start(stopChan)
+	}
+	go func() {
+		<-stopChan
+		s.wpMux.Lock()
+		if s.serving == stopChan {
+			s.serving = nil
+		}
+		s.wpMux.Unlock()
+	}()
+}
+
+// workerPool returns the pool of workers, nil if disabled
+func (s *Server) workerPool() (wp *workerPool) {
+	s.wpMux.RLock()
+	wp = s.wp
+	s.wpMux.RUnlock()
+	return
+}
+
+// Overloaded returns true while the worker queues are full, until all of them drain below half
+func (s *Server) Overloaded() bool {
+	wp := s.workerPool()
+	if wp == nil {
+		return false
+	}
+	wp.Lock()
+	defer wp.Unlock()
+	return wp.overloaded
+}
+
+// OverloadChanges returns the channel publishing the overload changes, nil if the workers are disabled
+// changes are dropped if not consumed
+func (s *Server) OverloadChanges() <-chan bool {
+	wp := s.workerPool()
+	if wp == nil {
+		return nil
+	}
+	return wp.overloadChn
+}
+
+// WorkerQueueDepths returns the number of requests waiting for a worker per PacketCode
+func (s *Server) WorkerQueueDepths() map[PacketCode]int {
+	wp := s.workerPool()
+	if wp == nil {
+		return nil
+	}
+	return wp.depths()
+}
+
+// dispatch executes the job on the worker pool, if enabled, returning false if the queue of code is full
+func (s *Server) dispatch(code PacketCode, job func()) bool {
+	wp := s.workerPool()
+	if wp == nil {
+		go job()
+		return true
+	}
+	return wp.submit(code, job)
+}
+
+// overflow applies the overflow policy to the request refused by the workers
+func (s *Server) overflow(pkt *Packet, synConn syncedConn, rc *replyCache, rcKey string) {
+	wp := s.workerPool()
+	if wp != nil && wp.rejecting() { // a stopped pool is not overloaded, the request is dropped
+		switch pkt.Code {
+		case AccessRequest, CoARequest, DisconnectRequest: // accounting would be acknowledged by a negative reply
+			rply := s.negativeReply(pkt, "server overloaded")
+			if err := sendCachedReply(synConn, rply, rc, rcKey); err != nil {
+				log.Printf("error: <%s> sending reply", err.Error())
+				return
+			}
+			s.stats.sent(rply.Code)
+			return
+		}
+	}
+	if rc != nil { // process the retransmission once the queue drains
+		rc.forget(rcKey)
+	}
+	s.stats.dropped(pkt.Code)
+}
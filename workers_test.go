@@ -0,0 +1,256 @@
+package radigo
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPriority(t *testing.T) {
+	wp := newWorkerPool(1, MetaDrop, nil)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	wp.start(stopChan)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.submit(AccessRequest, func() { // keeps the only worker busy
+		close(started)
+		<-release
+	})
+	<-started
+	var mux sync.Mutex
+	var served []PacketCode
+	var wg sync.WaitGroup
+	for _, code := range []PacketCode{AccountingRequest, AccountingRequest, AccessRequest, StatusServer} {
+		wg.Add(1)
+		code := code
+		if !wp.submit(code, func() {
+			mux.Lock()
+			served = append(served, code)
+			mux.Unlock()
+			wg.Done()
+		}) {
+			t.Fatalf("job with code %d refused", code)
+		}
+	}
+	if depths := wp.depths(); depths[AccountingRequest] != 2 || depths[AccessRequest] != 1 {
+		t.Errorf("Unexpected depths: %+v", depths)
+	}
+	close(release)
+	wg.Wait()
+	if exp := []PacketCode{AccessRequest, StatusServer, AccountingRequest, AccountingRequest}; !reflect.DeepEqual(exp, served) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, served)
+	}
+}
+
+func TestWorkerPoolOverload(t *testing.T) {
+	wp := newWorkerPool(1, MetaDrop, map[PacketCode]WorkerQueue{AccountingRequest: {MaxDepth: 2}})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	wp.start(stopChan)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.submit(AccountingRequest, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	for i := 0; i < 2; i++ {
+		if !wp.submit(AccountingRequest, func() {}) {
+			t.Fatal("job refused under the queue depth")
+		}
+	}
+	if wp.submit(AccountingRequest, func() {}) {
+		t.Error("job accepted over the queue depth")
+	}
+	if !wp.submit(AccessRequest, func() {}) { // other queues not affected
+		t.Error("authentication refused")
+	}
+	select {
+	case overloaded := <-wp.overloadChn:
+		if !overloaded {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", true, overloaded)
+		}
+	default:
+		t.Fatal("overload not published")
+	}
+	close(release)
+	select {
+	case overloaded := <-wp.overloadChn:
+		if overloaded {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", false, overloaded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overload not cleared")
+	}
+}
+
+func TestWorkerPoolStopped(t *testing.T) {
+	wp := newWorkerPool(1, MetaReject, map[PacketCode]WorkerQueue{AccountingRequest: {MaxDepth: 1}})
+	if wp.submit(AccessRequest, func() {}) {
+		t.Error("job accepted before start")
+	}
+	if wp.overloaded || len(wp.overloadChn) != 0 || wp.rejecting() {
+		t.Error("stopped pool reported overloaded")
+	}
+	stopChan := make(chan struct{})
+	wp.start(stopChan)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.submit(AccountingRequest, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	wp.submit(AccountingRequest, func() {})
+	if wp.submit(AccountingRequest, func() {}) {
+		t.Error("job accepted over the queue depth")
+	}
+	close(stopChan)
+	time.Sleep(10 * time.Millisecond)
+	wp.Lock()
+	overloaded := wp.overloaded
+	wp.Unlock()
+	if overloaded {
+		t.Error("overload kept after stop")
+	}
+	close(release)
+	stopChan = make(chan struct{})
+	defer close(stopChan)
+	wp.start(stopChan)
+	if !wp.submit(AccountingRequest, func() {}) {
+		t.Error("job refused after restart")
+	}
+	var changes []bool
+	for len(wp.overloadChn) != 0 {
+		changes = append(changes, <-wp.overloadChn)
+	}
+	if exp := []bool{true, false}; !reflect.DeepEqual(exp, changes) {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", exp, changes)
+	}
+}
+
+func TestServerWorkersOverflow(t *testing.T) {
+	release, started := make(chan struct{}), make(chan struct{}, 3)
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}), nil, nil, nil)
+	srv.RegisterHandlerContext(AccessRequest, func(ctx context.Context, req *Packet) (*Packet, error) {
+		started <- struct{}{}
+		<-release
+		rply := req.Reply()
+		rply.Code = AccessAccept
+		return rply, nil
+	})
+	srv.SetWorkers(1, MetaReject, map[PacketCode]WorkerQueue{AccessRequest: {MaxDepth: 1}})
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	srv.serveContext(stopChan)
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 3)}
+	for i := 0; i < 3; i++ { // first one in the worker, second queued, third rejected
+		req := NewPacket(AccessRequest, uint8(i), RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+		var buf [MaxPacketLen]byte
+		n, err := req.Encode(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.handleRcvedBytes(buf[:n], synConn)
+		if i == 0 {
+			<-started // picked up by the worker
+		}
+	}
+	select {
+	case b := <-synConn.rplyChn:
+		if PacketCode(b[0]) != AccessReject || b[1] != 2 {
+			t.Errorf("Unexpected reply code: %d, identifier: %d", b[0], b[1])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no reject on overflow")
+	}
+	if !srv.Overloaded() {
+		t.Error("server not overloaded")
+	}
+	if depths := srv.WorkerQueueDepths(); depths[AccessRequest] != 1 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, depths[AccessRequest])
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if b := <-synConn.rplyChn; PacketCode(b[0]) != AccessAccept {
+			t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, PacketCode(b[0]))
+		}
+	}
+	if overloaded := <-srv.OverloadChanges(); !overloaded {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", true, overloaded)
+	}
+
+}
+
+func TestServerWorkersDrop(t *testing.T) {
+	release, started := make(chan struct{}), make(chan struct{}, 3)
+	defer close(release)
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}), nil, nil, nil)
+	srv.RegisterHandlerContext(AccountingRequest, func(ctx context.Context, req *Packet) (*Packet, error) {
+		started <- struct{}{}
+		<-release
+		return nil, nil
+	})
+	srv.SetWorkers(1, MetaReject, map[PacketCode]WorkerQueue{AccountingRequest: {MaxDepth: 1}})
+	srv.SetReplyCache(time.Second, 0)
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+	srv.serveContext(stopChan)
+	synConn := &testSyncedConn{rplyChn: make(chan []byte, 3)}
+	var rcvd []byte
+	for i := 0; i < 3; i++ { // first one in the worker, second queued, third dropped
+		req := NewPacket(AccountingRequest, uint8(i), RFC2865Dictionary(), NewCoder(), "CGRateS.org")
+		var buf [MaxPacketLen]byte
+		n, err := req.Encode(buf[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rcvd = append([]byte{}, buf[:n]...)
+		srv.handleRcvedBytes(rcvd, synConn)
+		if i == 0 {
+			<-started // picked up by the worker
+		}
+	}
+	select { // accounting not answered negatively
+	case b := <-synConn.rplyChn:
+		t.Errorf("Unexpected reply code: %d", b[0])
+	case <-time.After(20 * time.Millisecond):
+	}
+	if dropped := srv.Stats().AcctDropped; dropped != 1 {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", 1, dropped)
+	}
+	if _, isDup := srv.replyCache().start(replyCacheKey(synConn.remoteAddr().String(), rcvd)); isDup {
+		t.Error("dropped request kept in the reply cache")
+	}
+}
+
+func TestServerSetWorkersServing(t *testing.T) {
+	srv := NewServer("udp", "127.0.0.1:0", NewSecrets(map[string]string{MetaDefault: "CGRateS.org"}),
+		NewDictionaries(map[string]*Dictionary{MetaDefault: RFC2865Dictionary()}),
+		map[PacketCode]func(*Packet) (*Packet, error){AccessRequest: testStatusHandler}, nil, nil)
+	stopChan := make(chan struct{})
+	srv.serveContext(stopChan)
+	srv.SetWorkers(2, MetaDrop, nil) // started on the running server
+	if code := testServerReply(t, srv, AccessRequest); code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, code)
+	}
+	srv.SetWorkers(1, MetaDrop, nil) // replaced while serving
+	if code := testServerReply(t, srv, AccessRequest); code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, code)
+	}
+	close(stopChan)
+	stopChan = make(chan struct{})
+	defer close(stopChan)
+	srv.serveContext(stopChan) // served again after restart
+	if code := testServerReply(t, srv, AccessRequest); code != AccessAccept {
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", AccessAccept, code)
+	}
+	if code := testServerReply(t, srv, CoARequest); code != CoANAK { // no handler, answered by the workers
+		t.Errorf("Expected: <%+v>, \nReceived: <%+v>", CoANAK, code)
+	}
+}